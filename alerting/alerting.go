@@ -0,0 +1,439 @@
+package alerting
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+// Alert states
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Rule is a declarative alerting rule.
+// Timing metrics are compared in milliseconds.
+type Rule struct {
+	Name   string `json:"name" config:"required"`
+	Metric string `json:"metric" config:"required"`
+	// Tags are `key:value` matchers, the value may be a glob pattern.
+	Tags []string `json:"tags"`
+	// Aggregate is one of avg, min, max or last and is applied over Window.
+	Aggregate  string  `json:"aggregate"`
+	Comparator string  `json:"comparator"`
+	Threshold  float64 `json:"threshold"`
+	Window     string  `json:"window" config:"duration"`
+	// For is how long the condition must hold before the alert fires.
+	For string `json:"for" config:"duration"`
+	// RepeatInterval re-sends a firing alert this often, in sample time, disabled when empty.
+	RepeatInterval string `json:"repeat_interval" config:"duration"`
+
+	window         time.Duration
+	forDuration    time.Duration
+	repeatInterval time.Duration
+}
+
+// Validate reports whether the rule is valid, it implements config.Validator
+func (r Rule) Validate() error {
+	return r.parse()
+}
+
+// parse validates the rule and fills in defaults.
+func (r *Rule) parse() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule is missing a name")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("alert rule %q is missing a metric", r.Name)
+	}
+	if r.Aggregate == "" {
+		r.Aggregate = "avg"
+	}
+	switch r.Aggregate {
+	case "avg", "min", "max", "last":
+	default:
+		return fmt.Errorf("alert rule %q has unknown aggregate %q", r.Name, r.Aggregate)
+	}
+	if _, err := compare(r.Comparator, 0, 0); err != nil {
+		return fmt.Errorf("alert rule %q: %v", r.Name, err)
+	}
+	for _, tag := range r.Tags {
+		if key, _ := statistics.SplitTag(tag); key == "" {
+			return fmt.Errorf("alert rule %q has an empty tag matcher", r.Name)
+		}
+	}
+	var err error
+	if r.window, err = parseDuration(r.Window); err != nil {
+		return fmt.Errorf("alert rule %q has invalid window: %v", r.Name, err)
+	}
+	if r.forDuration, err = parseDuration(r.For); err != nil {
+		return fmt.Errorf("alert rule %q has invalid for: %v", r.Name, err)
+	}
+	if r.repeatInterval, err = parseDuration(r.RepeatInterval); err != nil {
+		return fmt.Errorf("alert rule %q has invalid repeat_interval: %v", r.Name, err)
+	}
+	return nil
+}
+
+// matches reports whether a metric is selected by the rule
+func (r *Rule) matches(m *statistics.Metric) bool {
+	if m.MetricName != r.Metric {
+		return false
+	}
+	for _, matcher := range r.Tags {
+		key, pattern := statistics.SplitTag(matcher)
+		found := false
+		for _, tag := range m.Tags {
+			k, v := statistics.SplitTag(tag)
+			if k != key {
+				continue
+			}
+			if ok, _ := path.Match(pattern, v); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// seriesTags returns the tags of a metric that tell its series apart for the rule: the collector name
+// and the tags the rule matches on. Other tags, such as the speedtest server, do not split a series.
+func (r *Rule) seriesTags(m *statistics.Metric) []string {
+	tags := make([]string, 0, len(r.Tags)+1)
+	for _, tag := range m.Tags {
+		key, _ := statistics.SplitTag(tag)
+		if key == "name" {
+			tags = append(tags, tag)
+			continue
+		}
+		for _, matcher := range r.Tags {
+			if k, _ := statistics.SplitTag(matcher); k == key {
+				tags = append(tags, tag)
+				break
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// retention is how long a series is kept without new samples, the samples of its window and the
+// time its condition must hold
+func (r *Rule) retention() time.Duration {
+	if r.forDuration > r.window {
+		return r.forDuration
+	}
+	return r.window
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q is negative", s)
+	}
+	return d, nil
+}
+
+func compare(comparator string, value float64, threshold float64) (bool, error) {
+	switch comparator {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	default:
+		return false, fmt.Errorf("unknown comparator %q", comparator)
+	}
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// series is the state of a rule for a single set of tags
+type series struct {
+	tags         []string
+	samples      []sample
+	pendingSince time.Time
+	firing       bool
+	firedAt      time.Time
+	notifiedAt   time.Time
+}
+
+// aggregate combines the samples within the window
+func (s *series) aggregate(how string) float64 {
+	switch how {
+	case "last":
+		return s.samples[len(s.samples)-1].value
+	case "min", "max":
+		v := s.samples[0].value
+		for _, smp := range s.samples[1:] {
+			if (how == "min" && smp.value < v) || (how == "max" && smp.value > v) {
+				v = smp.value
+			}
+		}
+		return v
+	default:
+		sum := 0.0
+		for _, smp := range s.samples {
+			sum += smp.value
+		}
+		return sum / float64(len(s.samples))
+	}
+}
+
+// Engine evaluates alerting rules against the statistics collectors report and
+// dispatches firing and resolved alerts as events to its reporters.
+// It implements reporters.Interface so it can be fed like any other reporter.
+type Engine struct {
+	name      string
+	rules     []*Rule
+	reporters map[string]reporters.Interface
+
+	mu     sync.Mutex
+	series map[string]map[string]*series
+	// latest is the time of the newest sample evaluated, series are evicted relative to it so
+	// replayed samples are evaluated like live ones
+	latest time.Time
+}
+
+// NewEngineFromConfig creates an Engine from the `alerts` config, skipping invalid rules.
+func NewEngineFromConfig(rules []map[string]interface{}, reps map[string]reporters.Interface) *Engine {
+	parsed := make([]Rule, 0, len(rules))
+	for _, options := range rules {
+		var rule Rule
+		if err := config.DecodeOptions(options, &rule); err != nil {
+			logger.Get().Warn("invalid alert rule", zap.Error(err))
+			continue
+		}
+		parsed = append(parsed, rule)
+	}
+	e, errs := NewEngine(parsed, reps)
+	for _, err := range errs {
+		logger.Get().Warn("ignoring invalid alert rule", zap.Error(err))
+	}
+	return e
+}
+
+// NewEngine creates an Engine, returning an error for every rule that was skipped as invalid.
+func NewEngine(rules []Rule, reps map[string]reporters.Interface) (*Engine, []error) {
+	var errs []error
+	e := &Engine{
+		name:      "alerting",
+		reporters: reps,
+		series:    make(map[string]map[string]*series),
+	}
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.parse(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e.rules = append(e.rules, &rule)
+		e.series[rule.Name] = make(map[string]*series)
+	}
+	return e, errs
+}
+
+// Name returns the name of the engine
+func (e *Engine) Name() string {
+	return e.name
+}
+
+// Timing feeds a timing metric
+func (e *Engine) Timing(metric string, duration time.Duration, tags ...string) {
+	e.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeTiming, metric, statistics.NewDurationValue(duration), tags...)))
+}
+
+// Count feeds a count metric
+func (e *Engine) Count(metric string, val int64, tags ...string) {
+	e.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeCount, metric, statistics.NewIntValue(val), tags...)))
+}
+
+// Histogram feeds a histogram metric
+func (e *Engine) Histogram(metric string, val float64, tags ...string) {
+	e.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeHistogram, metric, statistics.NewFloatValue(val), tags...)))
+}
+
+// Gauge feeds a gauge metric
+func (e *Engine) Gauge(metric string, val float64, tags ...string) {
+	e.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeGauge, metric, statistics.NewFloatValue(val), tags...)))
+}
+
+// Event is ignored, rules only match metrics
+func (e *Engine) Event(title string, message string, tags ...string) {}
+
+// ReportStatistics evaluates every rule matching the reported metrics at the time they were measured
+func (e *Engine) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	out := statistics.NewStatistics()
+	e.mu.Lock()
+	for _, stat := range stats.Stats() {
+		if stat.Metric == nil {
+			continue
+		}
+		at := stat.TimestampOr(now)
+		if at.After(e.latest) {
+			e.latest = at
+		}
+		for _, rule := range e.rules {
+			if rule.matches(stat.Metric) {
+				e.evaluate(rule, stat.Metric, at, out)
+			}
+		}
+	}
+	e.evict()
+	e.mu.Unlock()
+
+	if len(out.Stats()) > 0 {
+		for _, r := range e.reporters {
+			r.ReportStatistics(out)
+		}
+	}
+}
+
+// Flush is a no-op
+func (e *Engine) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (e *Engine) Close() error {
+	return nil
+}
+
+// Firing returns the names of the rules currently firing for any series
+func (e *Engine) Firing() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	firing := make([]string, 0)
+	for _, rule := range e.rules {
+		for _, s := range e.series[rule.Name] {
+			if s.firing {
+				firing = append(firing, rule.Name)
+				break
+			}
+		}
+	}
+	return firing
+}
+
+// evict removes the series that are not firing and have had no samples for longer than their rule
+// retains them, so series of targets that went away do not accumulate. Lock must be held.
+func (e *Engine) evict() {
+	for _, rule := range e.rules {
+		cutoff := e.latest.Add(-rule.retention())
+		for key, s := range e.series[rule.Name] {
+			if !s.firing && s.samples[len(s.samples)-1].at.Before(cutoff) {
+				delete(e.series[rule.Name], key)
+			}
+		}
+	}
+}
+
+// evaluate adds a sample measured at `at` to its series and fires or resolves the alert. Lock must be held.
+func (e *Engine) evaluate(rule *Rule, m *statistics.Metric, at time.Time, out *statistics.Statistics) {
+	value := m.Value.Float()
+	if m.MetricType == statistics.MetricTypeTiming {
+		value = float64(m.Value.Duration()) / float64(time.Millisecond)
+	}
+	tags := rule.seriesTags(m)
+	key := strings.Join(tags, ",")
+	s, ok := e.series[rule.Name][key]
+	if !ok {
+		s = &series{tags: tags}
+		e.series[rule.Name][key] = s
+	}
+
+	// samples may arrive late and out of order when they were queued
+	i := len(s.samples)
+	for i > 0 && s.samples[i-1].at.After(at) {
+		i--
+	}
+	s.samples = append(s.samples, sample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample{at: at, value: value}
+	latest := s.samples[len(s.samples)-1].at
+	cutoff := latest.Add(-rule.window)
+	for len(s.samples) > 1 && s.samples[0].at.Before(cutoff) {
+		s.samples = s.samples[1:]
+	}
+	aggregated := s.aggregate(rule.Aggregate)
+	breached, _ := compare(rule.Comparator, aggregated, rule.Threshold)
+
+	switch {
+	case breached && !s.firing:
+		if s.pendingSince.IsZero() || at.Before(s.pendingSince) {
+			s.pendingSince = at
+		}
+		if latest.Sub(s.pendingSince) >= rule.forDuration {
+			s.firing = true
+			s.firedAt = latest
+			s.notifiedAt = latest
+			out.Add(e.alert(rule, s, StateFiring, aggregated, latest))
+		}
+	case breached && s.firing:
+		if rule.repeatInterval > 0 && latest.Sub(s.notifiedAt) >= rule.repeatInterval {
+			s.notifiedAt = latest
+			out.Add(e.alert(rule, s, StateFiring, aggregated, latest))
+		}
+	case !breached:
+		s.pendingSince = time.Time{}
+		if s.firing {
+			s.firing = false
+			out.Add(e.alert(rule, s, StateResolved, aggregated, latest))
+		}
+	}
+}
+
+// alert returns the event of an alert changing state at `at`
+func (e *Engine) alert(rule *Rule, s *series, state string, value float64, at time.Time) *statistics.Statistic {
+	title := fmt.Sprintf("[%s] %s", strings.ToUpper(state), rule.Name)
+	message := fmt.Sprintf("%s %s of %s is %g (%s %g over %s)",
+		rule.Name, rule.Aggregate, rule.Metric, value, rule.Comparator, rule.Threshold, rule.window)
+	if state == StateResolved {
+		message += fmt.Sprintf(", resolved after %s", at.Sub(s.firedAt).Round(time.Second))
+	}
+	logger.Get().Info("alert "+state, zap.String("alert", rule.Name), zap.Strings("tags", s.tags), zap.Float64("value", value))
+	tags := append([]string{
+		fmt.Sprintf("alert:%s", rule.Name),
+		fmt.Sprintf("alert_state:%s", state),
+	}, s.tags...)
+	stat := statistics.NewStatistic(nil, statistics.NewEvent(title, message, tags...))
+	stat.Timestamp = at
+	return stat
+}
+
+func single(metric *statistics.Metric) *statistics.Statistics {
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(metric, nil))
+	return stats
+}
@@ -0,0 +1,235 @@
+package alerting
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// recorder is a stand-in reporter recording the alerts it is reported
+type recorder struct {
+	mu     sync.Mutex
+	alerts []*statistics.Statistic
+}
+
+func (r *recorder) Timing(string, time.Duration, ...string) {}
+func (r *recorder) Count(string, int64, ...string)          {}
+func (r *recorder) Histogram(string, float64, ...string)    {}
+func (r *recorder) Gauge(string, float64, ...string)        {}
+func (r *recorder) Event(string, string, ...string)         {}
+func (r *recorder) Flush() error                            { return nil }
+func (r *recorder) Close() error                            { return nil }
+func (r *recorder) Name() string                            { return "recorder" }
+
+func (r *recorder) ReportStatistics(stats *statistics.Statistics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, stats.Stats()...)
+}
+
+// take returns the alerts reported so far and forgets them
+func (r *recorder) take() []*statistics.Statistic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	alerts := r.alerts
+	r.alerts = nil
+	return alerts
+}
+
+func newEngine(t *testing.T, rule Rule) (*Engine, *recorder) {
+	r := &recorder{}
+	e, errs := NewEngine([]Rule{rule}, map[string]reporters.Interface{"recorder": r})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	return e, r
+}
+
+// lossRule fires when the packet loss of a target is above 5 percent
+func lossRule() Rule {
+	return Rule{
+		Name:       "loss",
+		Metric:     "isp_monitor.pinger.packet_loss",
+		Comparator: ">",
+		Threshold:  5,
+	}
+}
+
+var start = time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// minute returns the time n minutes after start
+func minute(n int) time.Time {
+	return start.Add(time.Duration(n) * time.Minute)
+}
+
+// report feeds the packet loss of a target measured at minute n
+func report(e *Engine, name string, n int, loss float64) {
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeHistogram, "isp_monitor.pinger.packet_loss",
+		statistics.NewFloatValue(loss), "name:"+name), nil))
+	stats.Stamp(minute(n), 0)
+	e.ReportStatistics(stats)
+}
+
+// expectAlert checks that a single alert in state was reported at minute n
+func expectAlert(t *testing.T, alerts []*statistics.Statistic, state string, n int) {
+	t.Helper()
+	if len(alerts) != 1 {
+		t.Fatalf("expected a %s alert, got %d", state, len(alerts))
+	}
+	alert := alerts[0]
+	if alert.Event == nil || !strings.HasPrefix(alert.Event.Title, "["+strings.ToUpper(state)+"]") {
+		t.Fatalf("expected a %s alert, got %+v", state, alert.Event)
+	}
+	if !alert.Timestamp.Equal(minute(n)) {
+		t.Errorf("expected the %s alert at %s, got %s", state, minute(n), alert.Timestamp)
+	}
+}
+
+func TestForDelay(t *testing.T) {
+	rule := lossRule()
+	rule.For = "2m"
+	e, r := newEngine(t, rule)
+
+	report(e, "gateway", 0, 10)
+	report(e, "gateway", 1, 10)
+	if alerts := r.take(); len(alerts) != 0 {
+		t.Fatalf("expected no alert before the condition held for 2m, got %+v", alerts)
+	}
+	// a sample within the threshold restarts the delay
+	report(e, "gateway", 2, 0)
+	report(e, "gateway", 3, 10)
+	report(e, "gateway", 4, 10)
+	if alerts := r.take(); len(alerts) != 0 {
+		t.Fatalf("expected no alert after the condition was interrupted, got %+v", alerts)
+	}
+	report(e, "gateway", 5, 10)
+	expectAlert(t, r.take(), StateFiring, 5)
+	if firing := e.Firing(); len(firing) != 1 || firing[0] != "loss" {
+		t.Errorf("expected loss to be firing, got %v", firing)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	e, r := newEngine(t, lossRule())
+	report(e, "gateway", 0, 10)
+	expectAlert(t, r.take(), StateFiring, 0)
+	report(e, "gateway", 1, 20)
+	if alerts := r.take(); len(alerts) != 0 {
+		t.Fatalf("expected a firing alert to be sent once, got %+v", alerts)
+	}
+
+	report(e, "gateway", 3, 0)
+	alerts := r.take()
+	expectAlert(t, alerts, StateResolved, 3)
+	if !strings.HasSuffix(alerts[0].Event.Message, "resolved after 3m0s") {
+		t.Errorf("expected the alert to be resolved after 3m, got %q", alerts[0].Event.Message)
+	}
+	if firing := e.Firing(); len(firing) != 0 {
+		t.Errorf("expected no alert to be firing, got %v", firing)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	rule := lossRule()
+	rule.RepeatInterval = "10m"
+	e, r := newEngine(t, rule)
+
+	report(e, "gateway", 0, 10)
+	expectAlert(t, r.take(), StateFiring, 0)
+	for n := 1; n < 10; n++ {
+		report(e, "gateway", n, 10)
+	}
+	if alerts := r.take(); len(alerts) != 0 {
+		t.Fatalf("expected no repeat within the interval, got %+v", alerts)
+	}
+	report(e, "gateway", 10, 10)
+	expectAlert(t, r.take(), StateFiring, 10)
+	report(e, "gateway", 15, 10)
+	if alerts := r.take(); len(alerts) != 0 {
+		t.Fatalf("expected the interval to restart from the repeat, got %+v", alerts)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	t.Run("pending since the earliest sample", func(t *testing.T) {
+		rule := lossRule()
+		rule.For = "2m"
+		e, r := newEngine(t, rule)
+		report(e, "gateway", 2, 10)
+		// a queued sample measured earlier arrives late
+		report(e, "gateway", 0, 10)
+		expectAlert(t, r.take(), StateFiring, 2)
+	})
+
+	t.Run("aggregated in time order", func(t *testing.T) {
+		rule := lossRule()
+		rule.Aggregate = "last"
+		rule.Window = "5m"
+		e, r := newEngine(t, rule)
+		report(e, "gateway", 2, 10)
+		expectAlert(t, r.take(), StateFiring, 2)
+		// the late sample is not the last one measured, the alert keeps firing
+		report(e, "gateway", 1, 0)
+		if alerts := r.take(); len(alerts) != 0 {
+			t.Fatalf("expected a late sample not to resolve the alert, got %+v", alerts)
+		}
+	})
+
+	t.Run("averaged over the window", func(t *testing.T) {
+		rule := lossRule()
+		rule.Window = "5m"
+		e, r := newEngine(t, rule)
+		report(e, "gateway", 10, 4)
+		// measured before the window, it is not part of the average
+		report(e, "gateway", 1, 100)
+		if alerts := r.take(); len(alerts) != 0 {
+			t.Fatalf("expected a sample outside the window to be ignored, got %+v", alerts)
+		}
+		report(e, "gateway", 8, 8)
+		expectAlert(t, r.take(), StateFiring, 10)
+	})
+}
+
+func TestSeries(t *testing.T) {
+	rule := lossRule()
+	rule.Tags = []string{"name:isp-*"}
+	e, r := newEngine(t, rule)
+	report(e, "isp-a", 0, 10)
+	report(e, "isp-b", 0, 0)
+	report(e, "gateway", 0, 10)
+	alerts := r.take()
+	expectAlert(t, alerts, StateFiring, 0)
+	if tags := alerts[0].Event.Tags; len(tags) != 3 || tags[2] != "name:isp-a" {
+		t.Errorf("expected the alert to be tagged with its series, got %v", tags)
+	}
+	if len(e.series["loss"]) != 2 {
+		t.Errorf("expected a series per matching target, got %d", len(e.series["loss"]))
+	}
+}
+
+func TestEviction(t *testing.T) {
+	rule := lossRule()
+	rule.Window = "5m"
+	e, r := newEngine(t, rule)
+	report(e, "isp-a", 0, 0)
+	report(e, "isp-b", 0, 10)
+	expectAlert(t, r.take(), StateFiring, 0)
+
+	// series are evicted relative to the newest sample, not the wall clock
+	report(e, "gateway", 4, 0)
+	if len(e.series["loss"]) != 3 {
+		t.Fatalf("expected series within the window to be kept, got %d", len(e.series["loss"]))
+	}
+	report(e, "gateway", 10, 0)
+	if _, ok := e.series["loss"]["name:isp-a"]; ok {
+		t.Error("expected the series without samples to be evicted")
+	}
+	if _, ok := e.series["loss"]["name:isp-b"]; !ok {
+		t.Error("expected the firing series to be kept")
+	}
+}
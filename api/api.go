@@ -0,0 +1,296 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/collectors"
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/history"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+// Options are the options for the status API
+type Options struct {
+	Address string `json:"address"`
+}
+
+// CollectorStatus is the last known state of a collector
+type CollectorStatus struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Interval  string     `json:"interval"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// Result is the outcome of a single collection, timings are in milliseconds
+type Result struct {
+	Collector  string           `json:"collector"`
+	Timestamp  time.Time        `json:"timestamp"`
+	Error      string           `json:"error,omitempty"`
+	Statistics []history.Record `json:"statistics"`
+}
+
+// collector is a registered collector and the outcome of its last collection
+type collector struct {
+	collector     collectors.Interface
+	collectorType string
+
+	lastRun   time.Time
+	lastError string
+	latest    *statistics.Statistics
+}
+
+// Server is an HTTP API to query the state of the running collectors and trigger collections
+type Server struct {
+	reporters map[string]reporters.Interface
+	started   time.Time
+
+	mu         sync.RWMutex
+	collectors map[string]*collector
+
+	server *http.Server
+}
+
+// NewFromConfig creates a Server from the `api` config and starts serving it.
+func NewFromConfig(options map[string]interface{}, reps map[string]reporters.Interface) *Server {
+	var opts Options
+	if err := config.DecodeOptions(options, &opts); err != nil {
+		logger.Get().Warn("invalid api options", zap.Error(err))
+	}
+	if opts.Address == "" {
+		opts.Address = "localhost:9401"
+	}
+	s := New(reps)
+	if err := s.Serve(opts.Address); err != nil {
+		logger.Get().Warn("failed to serve api", zap.String("address", opts.Address), zap.Error(err))
+		return nil
+	}
+	return s
+}
+
+// New creates a Server, collections triggered through it are reported to reps.
+// It does not serve until Serve is called.
+func New(reps map[string]reporters.Interface) *Server {
+	return &Server{
+		reporters:  reps,
+		started:    time.Now(),
+		collectors: make(map[string]*collector),
+	}
+}
+
+// Register adds a collector of the given type to the API
+func (s *Server) Register(c collectors.Interface, collectorType string) {
+	s.mu.Lock()
+	s.collectors[c.Name()] = &collector{collector: c, collectorType: collectorType}
+	s.mu.Unlock()
+}
+
+// Unregister removes the collector of the given name from the API
+func (s *Server) Unregister(name string) {
+	s.mu.Lock()
+	delete(s.collectors, name)
+	s.mu.Unlock()
+}
+
+// Observe records the outcome of a collection, it is a collectors.Observer.
+func (s *Server) Observe(name string, stats *statistics.Statistics, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.collectors[name]
+	if !ok {
+		return
+	}
+	c.lastRun = time.Now()
+	c.latest = stats
+	c.lastError = ""
+	if err != nil {
+		c.lastError = err.Error()
+	}
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/api/collectors", s.listCollectors)
+	mux.HandleFunc("/api/collectors/", s.runCollector)
+	mux.HandleFunc("/api/latest", s.latest)
+	return mux
+}
+
+// Serve starts serving the API on address in the background.
+func (s *Server) Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: s.Handler()}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Get().Warn("api server stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Close stops serving the API
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// healthz reports the daemon is up
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	count := len(s.collectors)
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "ok",
+		"collectors": count,
+		"uptime":     time.Since(s.started).Round(time.Second).String(),
+	})
+}
+
+// listCollectors serves the status of every collector, sorted by name
+func (s *Server) listCollectors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	s.mu.RLock()
+	statuses := make([]CollectorStatus, 0, len(s.collectors))
+	for name, c := range s.collectors {
+		status := CollectorStatus{
+			Name:      name,
+			Type:      c.collectorType,
+			Interval:  c.collector.Interval().String(),
+			LastError: c.lastError,
+		}
+		if !c.lastRun.IsZero() {
+			lastRun := c.lastRun
+			status.LastRun = &lastRun
+		}
+		statuses = append(statuses, status)
+	}
+	s.mu.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// latest serves the most recent statistics of every collector, or of the `collector` query parameter
+func (s *Server) latest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	only := r.URL.Query().Get("collector")
+	s.mu.RLock()
+	if only != "" {
+		if _, ok := s.collectors[only]; !ok {
+			s.mu.RUnlock()
+			writeError(w, http.StatusNotFound, "unknown collector "+only)
+			return
+		}
+	}
+	results := make(map[string]Result, len(s.collectors))
+	for name, c := range s.collectors {
+		if (only != "" && name != only) || c.latest == nil {
+			continue
+		}
+		results[name] = newResult(name, c.lastRun, c.latest, c.lastError)
+	}
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, results)
+}
+
+// runCollector handles `POST /api/collectors/{name}/run`, collecting immediately and
+// reporting the statistics like a scheduled collection would.
+func (s *Server) runCollector(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/collectors/"), "/")
+	if len(parts) != 2 || parts[1] != "run" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+	name := parts[0]
+
+	s.mu.RLock()
+	c, ok := s.collectors[name]
+	s.mu.RUnlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown collector "+name)
+		return
+	}
+	// the collection in flight, scheduled or requested, is reported on its own
+	if !collectors.TryStartRun(c.collector) {
+		writeError(w, http.StatusConflict, "collector "+name+" is already collecting")
+		return
+	}
+	defer collectors.EndRun(c.collector)
+
+	logger.Get().Info("running collector on request", zap.String("name", name))
+	stats, err := c.collector.Collect(r.Context())
+	if r.Context().Err() != nil {
+		// the client went away, drop the partial measurement
+		return
+	}
+	s.Observe(name, stats, err)
+	for _, reporter := range s.reporters {
+		reporter.ReportStatistics(stats)
+	}
+
+	status := http.StatusOK
+	errMessage := ""
+	if err != nil {
+		status = http.StatusBadGateway
+		errMessage = err.Error()
+	}
+	writeJSON(w, status, newResult(name, time.Now(), stats, errMessage))
+}
+
+func newResult(name string, ts time.Time, stats *statistics.Statistics, errMessage string) Result {
+	records := make([]history.Record, 0, len(stats.Stats()))
+	for _, stat := range stats.Stats() {
+		records = append(records, history.FromStatistic(stat, ts))
+	}
+	return Result{
+		Collector:  name,
+		Timestamp:  ts,
+		Error:      errMessage,
+		Statistics: records,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Get().Debug("failed to write api response", zap.Error(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -1,12 +1,15 @@
 package collectors
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/log"
 	"github.com/platinummonkey/isp-monitor/reporters"
 	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
 )
 
 const metricPrefix = "isp_monitor."
@@ -14,12 +17,52 @@ const collectFailureSuffix = "collect_failure"
 
 // Interface defines a collector interface.
 type Interface interface {
-	Run(reporters map[string]reporters.Interface)
-	Collect() (*statistics.Statistics, error)
+	// Run collects on the collector's interval and reports to the given reporters.
+	// It blocks until ctx is cancelled and any in-flight collection has returned.
+	Run(ctx context.Context, reporters map[string]reporters.Interface)
+	// Collect performs a single collection, aborting early if ctx is cancelled.
+	Collect(ctx context.Context) (*statistics.Statistics, error)
+	// Interval is how often Run collects.
+	Interval() time.Duration
 	Name() string
 }
 
-var registeredCollectors map[string]func(config.Section, bool) Interface
+// Observer is told about every collection Run performs, before its statistics are reported.
+// stats includes the collect failure metric when err is set.
+type Observer func(name string, stats *statistics.Statistics, err error)
+
+type observerKey struct{}
+
+// WithObserver returns a context that makes collectors Run with it call observer after each collection.
+func WithObserver(ctx context.Context, observer Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, observer)
+}
+
+// collectFailure returns the statistic reported when a collection fails. It is stamped when it is
+// created as it is added after the collection stamped its statistics.
+func collectFailure(metric string, tags ...string) *statistics.Statistic {
+	stat := statistics.NewStatistic(
+		statistics.NewMetric(
+			statistics.MetricTypeCount,
+			metric,
+			statistics.NewIntValue(1),
+			tags...,
+		),
+		nil,
+	)
+	stat.Timestamp = time.Now()
+	return stat
+}
+
+// observe calls the Observer carried by ctx, if any.
+func observe(ctx context.Context, name string, stats *statistics.Statistics, err error) {
+	if observer, ok := ctx.Value(observerKey{}).(Observer); ok && observer != nil {
+		observer(name, stats, err)
+	}
+}
+
+var registeredCollectors = make(map[string]func(config.Section, bool) Interface)
+var registeredOptions = make(map[string]func() interface{})
 var mu sync.RWMutex
 
 // RegisterCollectorType will register a collector type
@@ -30,6 +73,28 @@ func RegisterCollectorType(collectorType string, registerFunc func(config.Sectio
 	mu.Unlock()
 }
 
+// RegisterCollectorOptions registers the options of a collector type so configs can be validated,
+// options returns a pointer to a new options struct.
+func RegisterCollectorOptions(collectorType string, options func() interface{}) {
+	mu.Lock()
+	registeredOptions[collectorType] = options
+	mu.Unlock()
+}
+
+// CollectorOptions returns a pointer to a new options struct for the collector type, nil when it
+// registered none. ok is false when the type is unknown.
+func CollectorOptions(collectorType string) (interface{}, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if _, ok := registeredCollectors[collectorType]; !ok {
+		return nil, false
+	}
+	if options, ok := registeredOptions[collectorType]; ok {
+		return options(), true
+	}
+	return nil, true
+}
+
 // CreateCollectorFromConfig will create a collector from the given config
 func CreateCollectorFromConfig(cfg config.Section, debug bool) Interface {
 	mu.RLock()
@@ -40,10 +105,51 @@ func CreateCollectorFromConfig(cfg config.Section, debug bool) Interface {
 	return nil
 }
 
-func durationFromString(s string, defaultDuration time.Duration) time.Duration {
-	d, err := time.ParseDuration(s)
-	if err == nil && d > 0 {
-		return d
+// running holds the collectors with a collection in flight, scheduled or not
+var running = struct {
+	sync.Mutex
+	collectors map[Interface]bool
+}{collectors: make(map[Interface]bool)}
+
+// TryStartRun marks a collection of c as in flight, it reports false when one already is.
+// Every successful call must be followed by EndRun once the collection is over.
+func TryStartRun(c Interface) bool {
+	running.Lock()
+	defer running.Unlock()
+	if running.collectors[c] {
+		return false
+	}
+	running.collectors[c] = true
+	return true
+}
+
+// EndRun marks the collection of c started with TryStartRun as over
+func EndRun(c Interface) {
+	running.Lock()
+	delete(running.collectors, c)
+	running.Unlock()
+}
+
+// runEvery calls collect immediately and then once per interval of c until ctx is cancelled.
+// A collection is skipped when another collection of c, such as one requested through the api, is in flight.
+func runEvery(ctx context.Context, c Interface, collect func(context.Context)) {
+	ticker := time.NewTicker(c.Interval())
+	defer ticker.Stop()
+	run := func() {
+		if !TryStartRun(c) {
+			log.Get().Debug("skipping collection, another one is in flight", zap.String("name", c.Name()))
+			return
+		}
+		defer EndRun(c)
+		collect(ctx)
+	}
+	run()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run()
+		}
 	}
-	return defaultDuration
 }
@@ -0,0 +1,256 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterCollectorType("dns", NewDNSFromConfig)
+	RegisterCollectorOptions("dns", func() interface{} { return &DNSOptions{} })
+}
+
+// DNS measures lookup latency and correctness of DNS resolvers
+type DNS struct {
+	name            string
+	resolvers       []string
+	queries         []DNSQuery
+	protocol        string
+	timeout         time.Duration
+	collectInterval time.Duration
+}
+
+// DNSQuery is a single name to look up on every resolver
+type DNSQuery struct {
+	Name string `json:"name" config:"required"`
+	Type string `json:"type"`
+	// Expected answers, when set every answer returned must be one of these.
+	Expected []string `json:"expected"`
+}
+
+// DNSOptions are options specific to the DNS collector
+type DNSOptions struct {
+	Resolvers []string   `json:"resolvers" config:"required"`
+	Queries   []DNSQuery `json:"queries" config:"required"`
+	Protocol  string     `json:"protocol"`
+	Timeout   string     `json:"timeout" config:"duration"`
+}
+
+// NewDNSFromConfig will create a DNS collector from the config Section
+func NewDNSFromConfig(cfg config.Section, debug bool) Interface {
+	var opts DNSOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		log.Get().Warn("invalid dns options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if len(opts.Resolvers) == 0 || len(opts.Queries) == 0 {
+		return nil
+	}
+	if opts.Protocol == "" {
+		opts.Protocol = "udp"
+	}
+
+	timeout := config.DurationFromString(opts.Timeout, time.Second*2)
+	interval := config.DurationFromString(cfg.Interval, time.Second*30)
+
+	return NewDNS(cfg.Name, opts.Resolvers, opts.Queries, opts.Protocol, timeout, interval)
+}
+
+// NewDNS will create a new DNS collector, resolvers without a port use port 53
+func NewDNS(
+	name string,
+	resolvers []string,
+	queries []DNSQuery,
+	protocol string,
+	timeout time.Duration,
+	collectInterval time.Duration,
+) *DNS {
+	if name == "" {
+		name = "dns"
+	}
+	addrs := make([]string, 0, len(resolvers))
+	for _, r := range resolvers {
+		if _, _, err := net.SplitHostPort(r); err != nil {
+			r = net.JoinHostPort(r, "53")
+		}
+		addrs = append(addrs, r)
+	}
+	normalized := make([]DNSQuery, 0, len(queries))
+	for _, q := range queries {
+		q.Name = dns.Fqdn(q.Name)
+		q.Type = strings.ToUpper(q.Type)
+		if q.Type == "" {
+			q.Type = "A"
+		}
+		normalized = append(normalized, q)
+	}
+	return &DNS{
+		name:            name,
+		resolvers:       addrs,
+		queries:         normalized,
+		protocol:        protocol,
+		timeout:         timeout,
+		collectInterval: collectInterval,
+	}
+}
+
+// Name returns the name of this DNS collector
+func (d *DNS) Name() string {
+	return d.name
+}
+
+// Interval returns how often this DNS collector collects
+func (d *DNS) Interval() time.Duration {
+	return d.collectInterval
+}
+
+// Collect will query every resolver for every configured name
+func (d *DNS) Collect(ctx context.Context) (*statistics.Statistics, error) {
+	stats := statistics.NewStatistics()
+	start := time.Now()
+	defer func() {
+		stats.Stamp(time.Now(), time.Since(start))
+	}()
+	client := &dns.Client{Net: d.protocol, Timeout: d.timeout}
+	log.Get().Debug("collecting dns results", zap.String("name", d.name))
+	for _, resolver := range d.resolvers {
+		for _, q := range d.queries {
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			d.query(ctx, client, resolver, q, stats)
+		}
+	}
+	log.Get().Debug("reporting dns results", zap.String("name", d.name))
+	return stats, nil
+}
+
+func (d *DNS) query(ctx context.Context, client *dns.Client, resolver string, q DNSQuery, stats *statistics.Statistics) {
+	tags := []string{
+		fmt.Sprintf("name:%s", d.name),
+		fmt.Sprintf("resolver:%s", resolver),
+		fmt.Sprintf("query:%s", strings.TrimSuffix(q.Name, ".")),
+		fmt.Sprintf("record_type:%s", q.Type),
+	}
+	qtype, ok := dns.StringToType[q.Type]
+	if !ok {
+		log.Get().Warn("unknown dns record type", zap.String("name", d.name), zap.String("type", q.Type))
+		stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeCount, metricPrefix+"dns.errors", statistics.NewIntValue(1), tags...), nil))
+		return
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(q.Name, qtype)
+	resp, rtt, err := client.ExchangeContext(ctx, msg, resolver)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		metric := "dns.errors"
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			metric = "dns.timeouts"
+		}
+		log.Get().Debug("dns query failed", zap.String("name", d.name), zap.String("resolver", resolver), zap.String("query", q.Name), zap.Error(err))
+		stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeCount, metricPrefix+metric, statistics.NewIntValue(1), tags...), nil))
+		return
+	}
+
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeTiming,
+				metricPrefix+"dns.lookup_time",
+				statistics.NewDurationValue(rtt),
+				tags...,
+			),
+			nil,
+		),
+	)
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeCount,
+				metricPrefix+"dns.responses",
+				statistics.NewIntValue(1),
+				append(tags, fmt.Sprintf("rcode:%s", dns.RcodeToString[resp.Rcode]))...,
+			),
+			nil,
+		),
+	)
+	if len(q.Expected) > 0 {
+		match := 0.0
+		if answersMatch(resp, qtype, q.Expected) {
+			match = 1
+		}
+		stats.Add(
+			statistics.NewStatistic(
+				statistics.NewMetric(
+					statistics.MetricTypeGauge,
+					metricPrefix+"dns.answer_match",
+					statistics.NewFloatValue(match),
+					tags...,
+				),
+				nil,
+			),
+		)
+	}
+}
+
+// answersMatch reports whether the response has answers of qtype and all of them are expected.
+func answersMatch(resp *dns.Msg, qtype uint16, expected []string) bool {
+	allowed := make(map[string]bool, len(expected))
+	for _, e := range expected {
+		allowed[normalizeAnswer(e)] = true
+	}
+	found := 0
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != qtype {
+			// e.g. the CNAME chain leading to an A record
+			continue
+		}
+		found++
+		if !allowed[normalizeAnswer(strings.TrimPrefix(rr.String(), rr.Header().String()))] {
+			return false
+		}
+	}
+	return found > 0
+}
+
+func normalizeAnswer(s string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+}
+
+// Run will run the DNS collector until ctx is cancelled
+func (d *DNS) Run(ctx context.Context, reporters map[string]reporters.Interface) {
+	tags := []string{
+		fmt.Sprintf("name:%s", d.name),
+	}
+
+	collect := func(ctx context.Context) {
+		stats, err := d.Collect(ctx)
+		if ctx.Err() != nil {
+			// shutting down, drop the partial measurement
+			return
+		}
+		if err != nil {
+			log.Get().Warn("failed to execute dns queries", zap.String("name", d.name), zap.Error(err))
+			// error statistic
+			stats.Add(collectFailure(metricPrefix+"dns."+collectFailureSuffix, tags...))
+		}
+		observe(ctx, d.Name(), stats, err)
+		for _, reporter := range reporters {
+			reporter.ReportStatistics(stats)
+		}
+	}
+
+	runEvery(ctx, d, collect)
+}
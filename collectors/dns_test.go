@@ -0,0 +1,151 @@
+package collectors
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// startDNSServer starts an in-process resolver answering:
+//   - good.test. and bad.test. with an A record, 192.0.2.1 and 192.0.2.99
+//   - missing.test. with NXDOMAIN
+//   - slow.test. never
+//
+// It returns the address of the resolver and a func shutting it down.
+func startDNSServer(t *testing.T) (string, func()) {
+	mux := dns.NewServeMux()
+	answer := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, err := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+			if err != nil {
+				t.Error(err)
+			}
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		}
+	}
+	mux.Handle("good.test.", answer("192.0.2.1"))
+	mux.Handle("bad.test.", answer("192.0.2.99"))
+	mux.HandleFunc("missing.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})
+	mux.HandleFunc("slow.test.", func(w dns.ResponseWriter, r *dns.Msg) {})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+// findMetric returns the first metric named name with every tag in tags
+func findMetric(stats *statistics.Statistics, name string, tags ...string) *statistics.Metric {
+	for _, stat := range stats.Stats() {
+		if stat.Metric == nil || stat.Metric.MetricName != name {
+			continue
+		}
+		if hasTags(stat.Metric.Tags, tags) {
+			return stat.Metric
+		}
+	}
+	return nil
+}
+
+func hasTags(tags []string, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDNSCollect(t *testing.T) {
+	resolver, shutdown := startDNSServer(t)
+	defer shutdown()
+	d := NewDNS("resolvers", []string{resolver}, []DNSQuery{
+		{Name: "good.test", Expected: []string{"192.0.2.1", "192.0.2.2"}},
+		{Name: "bad.test", Expected: []string{"192.0.2.1"}},
+		{Name: "missing.test", Type: "a"},
+		{Name: "slow.test"},
+	}, "udp", 200*time.Millisecond, time.Minute)
+
+	stats, err := d.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	resolverTag := "resolver:" + resolver
+
+	for _, tc := range []struct {
+		query string
+		rcode string
+	}{
+		{"good.test", "NOERROR"},
+		{"bad.test", "NOERROR"},
+		{"missing.test", "NXDOMAIN"},
+	} {
+		if m := findMetric(stats, "isp_monitor.dns.responses", resolverTag, "query:"+tc.query, "rcode:"+tc.rcode); m == nil {
+			t.Errorf("expected a %s response for %s", tc.rcode, tc.query)
+		}
+		if m := findMetric(stats, "isp_monitor.dns.lookup_time", "query:"+tc.query, "record_type:A"); m == nil {
+			t.Errorf("expected a lookup time for %s", tc.query)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		match float64
+	}{
+		{"good.test", 1},
+		{"bad.test", 0},
+	} {
+		m := findMetric(stats, "isp_monitor.dns.answer_match", "query:"+tc.query)
+		if m == nil {
+			t.Errorf("expected an answer match for %s", tc.query)
+			continue
+		}
+		if v := m.Value.Float(); v != tc.match {
+			t.Errorf("expected answer match %v for %s, got %v", tc.match, tc.query, v)
+		}
+	}
+	if m := findMetric(stats, "isp_monitor.dns.answer_match", "query:missing.test"); m != nil {
+		t.Error("expected no answer match without expected answers")
+	}
+
+	if m := findMetric(stats, "isp_monitor.dns.timeouts", "query:slow.test"); m == nil {
+		t.Error("expected a timeout for slow.test")
+	}
+	if m := findMetric(stats, "isp_monitor.dns.responses", "query:slow.test"); m != nil {
+		t.Error("expected no response for slow.test")
+	}
+}
+
+func TestDNSCollectCancelled(t *testing.T) {
+	resolver, shutdown := startDNSServer(t)
+	defer shutdown()
+	d := NewDNS("resolvers", []string{resolver}, []DNSQuery{{Name: "good.test"}}, "udp", time.Second, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Collect(ctx); err != context.Canceled {
+		t.Fatalf("expected the collection to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+package collectors
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterCollectorType("http", NewHTTPFromConfig)
+	RegisterCollectorOptions("http", func() interface{} { return &HTTPOptions{} })
+}
+
+// maxBodyMatchSize bounds how much of a response body is read when matching it.
+const maxBodyMatchSize = 1 << 20
+
+// HTTP probes URLs and reports the timing of each phase of the request
+type HTTP struct {
+	name               string
+	urls               []string
+	method             string
+	expectedStatus     int
+	bodyMatch          *regexp.Regexp
+	insecureSkipVerify bool
+	timeout            time.Duration
+	collectInterval    time.Duration
+}
+
+// HTTPOptions are options specific to the HTTP collector
+type HTTPOptions struct {
+	URLs               []string `json:"urls" config:"required"`
+	Method             string   `json:"method"`
+	ExpectedStatus     int      `json:"expected_status"`
+	BodyMatch          string   `json:"body_match"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	Timeout            string   `json:"timeout" config:"duration"`
+}
+
+// NewHTTPFromConfig will create an HTTP collector from the config Section
+func NewHTTPFromConfig(cfg config.Section, debug bool) Interface {
+	var opts HTTPOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		log.Get().Warn("invalid http options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if len(opts.URLs) == 0 {
+		return nil
+	}
+	var bodyMatch *regexp.Regexp
+	if opts.BodyMatch != "" {
+		var err error
+		bodyMatch, err = regexp.Compile(opts.BodyMatch)
+		if err != nil {
+			log.Get().Warn("invalid http body_match", zap.String("name", cfg.Name), zap.Error(err))
+			return nil
+		}
+	}
+
+	timeout := config.DurationFromString(opts.Timeout, time.Second*10)
+	interval := config.DurationFromString(cfg.Interval, time.Second*30)
+
+	return NewHTTP(cfg.Name, opts.URLs, opts.Method, opts.ExpectedStatus, bodyMatch, opts.InsecureSkipVerify, timeout, interval)
+}
+
+// NewHTTP will create a new HTTP collector.
+// An expectedStatus of 0 accepts any 2xx response and a nil bodyMatch skips body matching.
+func NewHTTP(
+	name string,
+	urls []string,
+	method string,
+	expectedStatus int,
+	bodyMatch *regexp.Regexp,
+	insecureSkipVerify bool,
+	timeout time.Duration,
+	collectInterval time.Duration,
+) *HTTP {
+	if name == "" {
+		name = "http"
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	return &HTTP{
+		name:               name,
+		urls:               urls,
+		method:             method,
+		expectedStatus:     expectedStatus,
+		bodyMatch:          bodyMatch,
+		insecureSkipVerify: insecureSkipVerify,
+		timeout:            timeout,
+		collectInterval:    collectInterval,
+	}
+}
+
+// Name returns the name of this HTTP collector
+func (h *HTTP) Name() string {
+	return h.name
+}
+
+// Interval returns how often this HTTP collector collects
+func (h *HTTP) Interval() time.Duration {
+	return h.collectInterval
+}
+
+// Collect will probe every configured URL
+func (h *HTTP) Collect(ctx context.Context) (*statistics.Statistics, error) {
+	stats := statistics.NewStatistics()
+	start := time.Now()
+	defer func() {
+		stats.Stamp(time.Now(), time.Since(start))
+	}()
+	log.Get().Debug("collecting http results", zap.String("name", h.name))
+	for _, u := range h.urls {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		h.probe(ctx, u, stats)
+	}
+	log.Get().Debug("reporting http results", zap.String("name", h.name))
+	return stats, nil
+}
+
+func (h *HTTP) probe(ctx context.Context, rawURL string, stats *statistics.Statistics) {
+	tags := []string{
+		fmt.Sprintf("name:%s", h.name),
+		fmt.Sprintf("url:%s", rawURL),
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		tags = append(tags, fmt.Sprintf("host:%s", u.Hostname()))
+	}
+	timing := func(metric string, d time.Duration) {
+		stats.Add(
+			statistics.NewStatistic(
+				statistics.NewMetric(
+					statistics.MetricTypeTiming,
+					metricPrefix+"http."+metric,
+					statistics.NewDurationValue(d),
+					tags...,
+				),
+				nil,
+			),
+		)
+	}
+	gauge := func(metric string, v float64) {
+		stats.Add(
+			statistics.NewStatistic(
+				statistics.NewMetric(
+					statistics.MetricTypeGauge,
+					metricPrefix+"http."+metric,
+					statistics.NewFloatValue(v),
+					tags...,
+				),
+				nil,
+			),
+		)
+	}
+	failed := func(err error) {
+		log.Get().Debug("http probe failed", zap.String("name", h.name), zap.String("url", rawURL), zap.Error(err))
+		stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeCount, metricPrefix+"http.errors", statistics.NewIntValue(1), tags...), nil))
+		gauge("success", 0)
+	}
+
+	p := newPhases()
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	req, err := http.NewRequest(h.method, rawURL, nil)
+	if err != nil {
+		failed(err)
+		return
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, p.trace()))
+
+	// a fresh connection every time so every phase is measured
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: h.insecureSkipVerify},
+		},
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		failed(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodyMatchSize))
+	if err != nil {
+		failed(err)
+		return
+	}
+	total := time.Since(start)
+
+	p.mu.Lock()
+	if !p.dnsStart.IsZero() && !p.dnsDone.IsZero() {
+		timing("dns_time", p.dnsDone.Sub(p.dnsStart))
+	}
+	if connect, ok := p.connectTime(); ok {
+		timing("connect_time", connect)
+	}
+	if !p.tlsStart.IsZero() && !p.tlsDone.IsZero() {
+		timing("tls_time", p.tlsDone.Sub(p.tlsStart))
+	}
+	if !p.firstByte.IsZero() {
+		timing("ttfb", p.firstByte.Sub(start))
+	}
+	p.mu.Unlock()
+	timing("total_time", total)
+	gauge("status_code", float64(resp.StatusCode))
+
+	success := resp.StatusCode/100 == 2
+	if h.expectedStatus != 0 {
+		success = resp.StatusCode == h.expectedStatus
+	}
+	if h.bodyMatch != nil {
+		matched := h.bodyMatch.Match(body)
+		match := 0.0
+		if matched {
+			match = 1
+		}
+		gauge("body_match", match)
+		success = success && matched
+	}
+	if success {
+		gauge("success", 1)
+	} else {
+		gauge("success", 0)
+	}
+}
+
+// phases records when each phase of a request happened. Connections to several addresses of a host
+// may be dialed at once, so the callbacks can run concurrently, and the connection used is measured.
+type phases struct {
+	mu                                              sync.Mutex
+	dnsStart, dnsDone, tlsStart, tlsDone, firstByte time.Time
+	connectStarts, connectDones                     map[string]time.Time
+	// connected is the address of the connection used for the request
+	connected string
+}
+
+func newPhases() *phases {
+	return &phases{
+		connectStarts: make(map[string]time.Time),
+		connectDones:  make(map[string]time.Time),
+	}
+}
+
+// set sets t to the current time
+func (p *phases) set(t *time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*t = time.Now()
+}
+
+// trace returns the callbacks recording the phases
+func (p *phases) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { p.set(&p.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { p.set(&p.dnsDone) },
+		ConnectStart: func(network string, addr string) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.connectStarts[addr] = time.Now()
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.connectDones[addr] = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.connected = info.Conn.RemoteAddr().String()
+		},
+		TLSHandshakeStart:    func() { p.set(&p.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.set(&p.tlsDone) },
+		GotFirstResponseByte: func() { p.set(&p.firstByte) },
+	}
+}
+
+// connectTime returns how long the connection used took to establish, it is called with mu held
+func (p *phases) connectTime() (time.Duration, bool) {
+	start, started := p.connectStarts[p.connected]
+	done, connected := p.connectDones[p.connected]
+	if !started || !connected {
+		return 0, false
+	}
+	return done.Sub(start), true
+}
+
+// Run will run the HTTP collector until ctx is cancelled
+func (h *HTTP) Run(ctx context.Context, reporters map[string]reporters.Interface) {
+	tags := []string{
+		fmt.Sprintf("name:%s", h.name),
+	}
+
+	collect := func(ctx context.Context) {
+		stats, err := h.Collect(ctx)
+		if ctx.Err() != nil {
+			// shutting down, drop the partial measurement
+			return
+		}
+		if err != nil {
+			log.Get().Warn("failed to execute http probes", zap.String("name", h.name), zap.Error(err))
+			// error statistic
+			stats.Add(collectFailure(metricPrefix+"http."+collectFailureSuffix, tags...))
+		}
+		observe(ctx, h.Name(), stats, err)
+		for _, reporter := range reporters {
+			reporter.ReportStatistics(stats)
+		}
+	}
+
+	runEvery(ctx, h, collect)
+}
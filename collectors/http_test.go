@@ -0,0 +1,109 @@
+package collectors
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newHTTPServer(tls bool) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	if tls {
+		return httptest.NewTLSServer(handler)
+	}
+	return httptest.NewServer(handler)
+}
+
+func TestHTTPCollect(t *testing.T) {
+	s := newHTTPServer(false)
+	defer s.Close()
+	// localhost is resolved, and may be dialed over both IPv4 and IPv6
+	u := strings.Replace(s.URL, "127.0.0.1", "localhost", 1)
+	h := NewHTTP("web", []string{u}, "", 0, regexp.MustCompile("hel+o"), false, time.Second, time.Minute)
+
+	stats, err := h.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	urlTag := "url:" + u
+	for _, metric := range []string{"dns_time", "connect_time", "ttfb", "total_time"} {
+		m := findMetric(stats, "isp_monitor.http."+metric, "name:web", urlTag, "host:localhost")
+		if m == nil {
+			t.Errorf("expected a %s timing", metric)
+			continue
+		}
+		if d := m.Value.Duration(); d <= 0 || d > time.Second {
+			t.Errorf("unexpected %s of %s", metric, d)
+		}
+	}
+	if m := findMetric(stats, "isp_monitor.http.tls_time"); m != nil {
+		t.Error("expected no tls timing over plain http")
+	}
+	for metric, expected := range map[string]float64{"status_code": 200, "body_match": 1, "success": 1} {
+		m := findMetric(stats, "isp_monitor.http."+metric, urlTag)
+		if m == nil || m.Value.Float() != expected {
+			t.Errorf("expected %s to be %v, got %+v", metric, expected, m)
+		}
+	}
+}
+
+func TestHTTPCollectTLS(t *testing.T) {
+	s := newHTTPServer(true)
+	defer s.Close()
+	h := NewHTTP("web", []string{s.URL}, "", 0, nil, true, time.Second, time.Minute)
+
+	stats, err := h.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if m := findMetric(stats, "isp_monitor.http.tls_time"); m == nil || m.Value.Duration() <= 0 {
+		t.Errorf("expected a tls timing, got %+v", m)
+	}
+	if m := findMetric(stats, "isp_monitor.http.body_match"); m != nil {
+		t.Error("expected no body match without body_match")
+	}
+}
+
+func TestHTTPCollectUnexpectedResponse(t *testing.T) {
+	s := newHTTPServer(false)
+	defer s.Close()
+	h := NewHTTP("web", []string{s.URL}, "", http.StatusNoContent, regexp.MustCompile("goodbye"), false, time.Second, time.Minute)
+
+	stats, err := h.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	for metric, expected := range map[string]float64{"status_code": 200, "body_match": 0, "success": 0} {
+		m := findMetric(stats, "isp_monitor.http."+metric)
+		if m == nil || m.Value.Float() != expected {
+			t.Errorf("expected %s to be %v, got %+v", metric, expected, m)
+		}
+	}
+}
+
+func TestHTTPCollectUnreachable(t *testing.T) {
+	s := newHTTPServer(false)
+	u := s.URL
+	s.Close()
+	h := NewHTTP("web", []string{u}, "", 0, nil, false, time.Second, time.Minute)
+
+	stats, err := h.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if m := findMetric(stats, "isp_monitor.http.errors", "url:"+u); m == nil || m.Value.Int() != 1 {
+		t.Errorf("expected an error to be counted, got %+v", m)
+	}
+	if m := findMetric(stats, "isp_monitor.http.success"); m == nil || m.Value.Float() != 0 {
+		t.Errorf("expected the probe to fail, got %+v", m)
+	}
+	if m := findMetric(stats, "isp_monitor.http.total_time"); m != nil {
+		t.Error("expected no timings for a failed probe")
+	}
+}
@@ -1,6 +1,7 @@
 package collectors
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -15,6 +16,7 @@ import (
 
 func init() {
 	RegisterCollectorType("ping", NewPingerFromConfig)
+	RegisterCollectorOptions("ping", func() interface{} { return &PingerOptions{} })
 }
 
 // Pinger is a simple `ping` test
@@ -32,10 +34,10 @@ type Pinger struct {
 
 // PingerOptions are options specific to the pinger
 type PingerOptions struct {
-	Address    string      `json:"address"`
+	Address    string      `json:"address" config:"required"`
 	Count      json.Number `json:"count"`
-	Timeout    string      `json:"timeout"`
-	Interval   string      `json:"interval"`
+	Timeout    string      `json:"timeout" config:"duration"`
+	Interval   string      `json:"interval" config:"duration"`
 	PacketSize json.Number `json:"packetSize"`
 }
 
@@ -60,8 +62,8 @@ func (o PingerOptions) PacketSizeInt() int {
 // NewPingerFromConfig will create a Pinger from the config Section
 func NewPingerFromConfig(cfg config.Section, debug bool) Interface {
 	var opts PingerOptions
-	if data, err := json.Marshal(cfg.Options); err == nil {
-		json.Unmarshal(data, &opts)
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		log.Get().Warn("invalid ping options", zap.String("name", cfg.Name), zap.Error(err))
 	}
 	if opts.Address != "" {
 		if opts.CountInt() <= 0 {
@@ -71,9 +73,9 @@ func NewPingerFromConfig(cfg config.Section, debug bool) Interface {
 			opts.PacketSize = "0"
 		}
 
-		timeout := durationFromString(opts.Timeout, time.Second*5)
-		interval := durationFromString(cfg.Interval, time.Second*30)
-		pingInterval := durationFromString(opts.Interval, time.Second*30)
+		timeout := config.DurationFromString(opts.Timeout, time.Second*5)
+		interval := config.DurationFromString(cfg.Interval, time.Second*30)
+		pingInterval := config.DurationFromString(opts.Interval, time.Second*30)
 
 		return NewPinger(cfg.Name, opts.Address, opts.CountInt(), timeout, interval, pingInterval, debug, opts.PacketSizeInt())
 	}
@@ -108,9 +110,18 @@ func (p *Pinger) Name() string {
 	return p.name
 }
 
+// Interval returns how often this Pinger collects
+func (p *Pinger) Interval() time.Duration {
+	return p.collectInterval
+}
+
 // Collect will collect the ping statistics
-func (p *Pinger) Collect() (*statistics.Statistics, error) {
+func (p *Pinger) Collect(ctx context.Context) (*statistics.Statistics, error) {
 	stats := statistics.NewStatistics()
+	start := time.Now()
+	defer func() {
+		stats.Stamp(time.Now(), time.Since(start))
+	}()
 	pinger, err := ping.NewPinger(p.address)
 	if err != nil {
 		return stats, err
@@ -126,8 +137,33 @@ func (p *Pinger) Collect() (*statistics.Statistics, error) {
 		doneChan <- statistics
 	}
 	log.Get().Debug("collecting ping results", zap.String("name", p.name), zap.String("address", p.address))
-	go pinger.Run()
-	pingStats := <-doneChan
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		pinger.Run()
+	}()
+	var pingStats *ping.Statistics
+	select {
+	case pingStats = <-doneChan:
+	case <-finished:
+		// the pinger exits without finishing when it cannot listen for replies
+		select {
+		case pingStats = <-doneChan:
+		default:
+			return stats, fmt.Errorf("failed to ping %s", p.address)
+		}
+	case <-ctx.Done():
+		// abort the pings and wait for the pinger to exit so nothing is sent after shutting down
+		select {
+		case <-finished:
+		case <-doneChan:
+			// already finished by its own timeout or count
+		default:
+			pinger.Stop()
+		}
+		<-finished
+		return stats, ctx.Err()
+	}
 	log.Get().Debug("reporting ping results", zap.String("name", p.name), zap.String("address", p.address))
 
 	tags := []string{
@@ -220,42 +256,28 @@ func (p *Pinger) Collect() (*statistics.Statistics, error) {
 }
 
 // Run will run the Pinger routine in the background
-func (p *Pinger) Run(reporters map[string]reporters.Interface) {
+func (p *Pinger) Run(ctx context.Context, reporters map[string]reporters.Interface) {
 	tags := []string{
 		fmt.Sprintf("address:%s", p.address),
 		fmt.Sprintf("name:%s", p.name),
 	}
 
-	collect := func() {
-		stats, err := p.Collect()
+	collect := func(ctx context.Context) {
+		stats, err := p.Collect(ctx)
+		if ctx.Err() != nil {
+			// shutting down, drop the partial measurement
+			return
+		}
 		if err != nil {
 			log.Get().Warn("failed to execute ping", zap.String("name", p.name), zap.String("address", p.address), zap.Error(err))
 			// error statistic
-			stats.Add(
-				statistics.NewStatistic(
-					statistics.NewMetric(
-						statistics.MetricTypeCount,
-						metricPrefix+"pinger."+collectFailureSuffix,
-						statistics.NewIntValue(1),
-						tags...,
-					),
-					nil,
-				),
-			)
+			stats.Add(collectFailure(metricPrefix+"pinger."+collectFailureSuffix, tags...))
 		}
+		observe(ctx, p.Name(), stats, err)
 		for _, reporter := range reporters {
 			reporter.ReportStatistics(stats)
 		}
 	}
 
-	go func() {
-		ticker := time.NewTicker(p.collectInterval)
-		collect()
-		for {
-			select {
-			case <-ticker.C:
-				collect()
-			}
-		}
-	}()
+	runEvery(ctx, p, collect)
 }
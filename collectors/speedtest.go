@@ -1,8 +1,9 @@
 package collectors
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/platinummonkey/isp-monitor/config"
@@ -15,40 +16,96 @@ import (
 
 func init() {
 	RegisterCollectorType("speedtest", NewSpeedTestFromConfig)
+	RegisterCollectorOptions("speedtest", func() interface{} { return &SpeedTestOptions{} })
+}
+
+// complianceWindows are the rolling windows plan compliance is reported over
+var complianceWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"day", time.Hour * 24},
+	{"week", time.Hour * 24 * 7},
+	{"month", time.Hour * 24 * 30},
 }
 
 // SpeedTest is the speedtest collector
 type SpeedTest struct {
+	name     string
 	client   speedtest.Client
 	interval time.Duration
+	plan     SpeedTestPlan
+	servers  SpeedTestServers
+
+	mu      sync.Mutex
+	results []speedTestResult
+	// next is the index of the candidate server the next rotating test uses
+	next int
+}
+
+// speedTestResult is a past result kept for rolling compliance, speeds in Mbps
+type speedTestResult struct {
+	at       time.Time
+	download float64
+	upload   float64
+}
+
+// SpeedTestPlan is the advertised plan in Mbps, zero values are unknown
+type SpeedTestPlan struct {
+	Download float64 `json:"download"`
+	Upload   float64 `json:"upload"`
+	// GuaranteedDownload and GuaranteedUpload are the minimum speeds the ISP guarantees.
+	GuaranteedDownload float64 `json:"guaranteed_download"`
+	GuaranteedUpload   float64 `json:"guaranteed_upload"`
+}
+
+// SpeedTestServers selects the speedtest.net servers tests run against
+type SpeedTestServers struct {
+	// Pinned limits tests to these server IDs, otherwise the closest servers are candidates.
+	Pinned []int `json:"servers"`
+	// Exclude are server IDs never tested against.
+	Exclude []int `json:"exclude"`
+	// Rotate runs each test against the next candidate in turn instead of the one with the lowest latency.
+	Rotate bool `json:"rotate"`
 }
 
 // SpeedTestOptions are options specific to SpeedTest
 type SpeedTestOptions struct {
-	Secure  bool   `json:"secure"`
-	Timeout string `json:"timeout"`
+	SpeedTestServers
+	Secure  bool          `json:"secure"`
+	Timeout string        `json:"timeout" config:"duration"`
+	Plan    SpeedTestPlan `json:"plan"`
 }
 
+// closestSpeedTestServers is how many of the closest servers are candidates when none are pinned
+const closestSpeedTestServers = 5
+
 // NewSpeedTestFromConfig will create a new SpeedTest from config
 func NewSpeedTestFromConfig(cfg config.Section, debug bool) Interface {
 	var opts SpeedTestOptions
-	if data, err := json.Marshal(cfg.Options); err == nil {
-		json.Unmarshal(data, &opts)
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		log.Get().Warn("invalid speedtest options", zap.Error(err))
 	}
 
-	timeout := durationFromString(opts.Timeout, time.Second*5)
-	interval := durationFromString(cfg.Interval, time.Second*30)
+	timeout := config.DurationFromString(opts.Timeout, time.Second*5)
+	interval := config.DurationFromString(cfg.Interval, time.Second*30)
 
-	return NewSpeedTest(opts.Secure, timeout, interval, debug)
+	return NewSpeedTest(cfg.Name, opts.Secure, timeout, interval, opts.Plan, opts.SpeedTestServers, debug)
 }
 
-// NewSpeedTest will create a new SpeedTest
+// NewSpeedTest will create a new SpeedTest, results are compared against plan when it is known
 func NewSpeedTest(
+	name string,
 	secure bool,
 	timeout time.Duration,
 	interval time.Duration,
+	plan SpeedTestPlan,
+	servers SpeedTestServers,
 	debug bool,
 ) *SpeedTest {
+	if name == "" {
+		name = "speedtest"
+	}
 	opts := &speedtest.Opts{
 		SpeedInBytes: false,
 		Quiet:        !debug,
@@ -62,32 +119,63 @@ func NewSpeedTest(
 	}
 	client := speedtest.NewClient(opts)
 	return &SpeedTest{
+		name:     name,
 		client:   client,
 		interval: interval,
+		plan:     plan,
+		servers:  servers,
 	}
 }
 
 // Name returns the name of this test.
 func (c *SpeedTest) Name() string {
-	return "speedtest"
+	return c.name
+}
+
+// Interval returns how often this test runs
+func (c *SpeedTest) Interval() time.Duration {
+	return c.interval
 }
 
 // Collect will run the test and report statistics.
-func (c *SpeedTest) Collect() (*statistics.Statistics, error) {
+// The speedtest client cannot be interrupted, so a cancelled ctx abandons the
+// in-flight test and returns immediately, the test keeps running in the background until it completes.
+func (c *SpeedTest) Collect(ctx context.Context) (*statistics.Statistics, error) {
+	type result struct {
+		stats *statistics.Statistics
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stats, err := c.collect()
+		done <- result{stats: stats, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.stats, r.err
+	case <-ctx.Done():
+		log.Get().Warn("abandoning in-flight speedtest, it keeps running in the background until it completes",
+			zap.String("name", c.name))
+		return statistics.NewStatistics(), ctx.Err()
+	}
+}
+
+func (c *SpeedTest) collect() (*statistics.Statistics, error) {
 	log.Get().Debug("collecting speedtest results")
 	stats := statistics.NewStatistics()
+	start := time.Now()
+	defer func() {
+		stats.Stamp(time.Now(), time.Since(start))
+	}()
 	config, err := c.client.Config()
 	if err != nil {
 		return stats, err
 	}
 	log.Get().Debug(fmt.Sprintf("speedtest - Testing from %s (%s)...\n", config.Client.ISP, config.Client.IP))
-	servers, err := c.client.ClosestServers()
+	server, err := c.selectServer()
 	if err != nil {
-		return stats, fmt.Errorf("Failed to load server list: %v\n", err)
+		return stats, err
 	}
-	server := servers.MeasureLatencies(
-		speedtest.DefaultLatencyMeasureTimes,
-		speedtest.DefaultErrorLatency).First()
 	log.Get().Debug(
 		fmt.Sprintf("speedtest - Hosted by %s (%s) [%.2f km]: %d ms",
 			server.Sponsor,
@@ -99,6 +187,7 @@ func (c *SpeedTest) Collect() (*statistics.Statistics, error) {
 	log.Get().Debug("reporting speedtest results")
 
 	tags := []string{
+		fmt.Sprintf("name:%s", c.name),
 		fmt.Sprintf("server_id:%d", server.ID),
 		fmt.Sprintf("server_sponsor:%s", server.Sponsor),
 	}
@@ -128,8 +217,18 @@ func (c *SpeedTest) Collect() (*statistics.Statistics, error) {
 		),
 	)
 
-	// report download speed
+	// report download speed in Mbps
 	downloadSpeed := float64(server.DownloadSpeed()) / (1 << 17)
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeGauge,
+				metricPrefix+"speedtest.download_mbps",
+				statistics.NewFloatValue(downloadSpeed), tags...),
+			nil,
+		),
+	)
+	// deprecated: the download speed as a timing, kept for existing graphs and monitors
 	stats.Add(
 		statistics.NewStatistic(
 			statistics.NewMetric(
@@ -140,8 +239,18 @@ func (c *SpeedTest) Collect() (*statistics.Statistics, error) {
 		),
 	)
 
-	// report upload speed
+	// report upload speed in Mbps
 	uploadSpeed := float64(server.UploadSpeed()) / (1 << 17)
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeGauge,
+				metricPrefix+"speedtest.upload_mbps",
+				statistics.NewFloatValue(uploadSpeed), tags...),
+			nil,
+		),
+	)
+	// deprecated: the upload speed as a timing, kept for existing graphs and monitors
 	stats.Add(
 		statistics.NewStatistic(
 			statistics.NewMetric(
@@ -152,40 +261,177 @@ func (c *SpeedTest) Collect() (*statistics.Statistics, error) {
 		),
 	)
 
+	c.comparePlan(stats, time.Now(), downloadSpeed, uploadSpeed, tags)
+
 	return stats, nil
 }
 
-// Run will run the test in the background.
-func (c *SpeedTest) Run(reporters map[string]reporters.Interface) {
-	collect := func() {
-		stats, err := c.Collect()
-		if err != nil {
-			log.Get().Warn("failed to execute speedtest", zap.Error(err))
-			// error statistic
+// selectServer picks the server to test against from the pinned, or closest non-excluded, servers.
+// The candidate with the lowest latency is used unless rotating.
+func (c *SpeedTest) selectServer() (*speedtest.Server, error) {
+	all, err := c.client.AllServers()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load server list: %v\n", err)
+	}
+	excluded := make(map[speedtest.ServerID]bool, len(c.servers.Exclude))
+	for _, id := range c.servers.Exclude {
+		excluded[speedtest.ServerID(id)] = true
+	}
+
+	candidates := &speedtest.Servers{}
+	if len(c.servers.Pinned) > 0 {
+		for _, id := range c.servers.Pinned {
+			if excluded[speedtest.ServerID(id)] {
+				continue
+			}
+			if server := all.Find(speedtest.ServerID(id)); server != nil {
+				candidates.List = append(candidates.List, server)
+			} else {
+				log.Get().Warn("pinned speedtest server not found", zap.String("name", c.name), zap.Int("server_id", id))
+			}
+		}
+	} else {
+		// the list is sorted by distance
+		for _, server := range all.List {
+			if len(candidates.List) == closestSpeedTestServers {
+				break
+			}
+			if !excluded[server.ID] {
+				candidates.List = append(candidates.List, server)
+			}
+		}
+	}
+	if len(candidates.List) == 0 {
+		return nil, fmt.Errorf("no speedtest servers available, pinned %v excluding %v", c.servers.Pinned, c.servers.Exclude)
+	}
+
+	if !c.servers.Rotate {
+		return candidates.MeasureLatencies(
+			speedtest.DefaultLatencyMeasureTimes,
+			speedtest.DefaultErrorLatency).First(), nil
+	}
+	c.mu.Lock()
+	server := candidates.List[c.next%len(candidates.List)]
+	c.next = (c.next + 1) % len(candidates.List)
+	c.mu.Unlock()
+	server.MeasureLatency(speedtest.DefaultLatencyMeasureTimes, speedtest.DefaultErrorLatency)
+	return server, nil
+}
+
+// comparePlan reports the speeds as a percentage of the plan, an event when they are below the
+// guaranteed minimum and the rolling share of tests meeting the guarantee.
+func (c *SpeedTest) comparePlan(stats *statistics.Statistics, now time.Time, download float64, upload float64, tags []string) {
+	for _, direction := range []struct {
+		name       string
+		speed      float64
+		plan       float64
+		guaranteed float64
+	}{
+		{"download", download, c.plan.Download, c.plan.GuaranteedDownload},
+		{"upload", upload, c.plan.Upload, c.plan.GuaranteedUpload},
+	} {
+		if direction.plan > 0 {
 			stats.Add(
 				statistics.NewStatistic(
 					statistics.NewMetric(
-						statistics.MetricTypeCount,
-						metricPrefix+"speedtest."+collectFailureSuffix,
-						statistics.NewIntValue(1),
+						statistics.MetricTypeGauge,
+						metricPrefix+"speedtest."+direction.name+"_pct_of_plan",
+						statistics.NewFloatValue(direction.speed/direction.plan*100),
+						tags...,
 					),
 					nil,
 				),
 			)
 		}
-		for _, reporter := range reporters {
-			reporter.ReportStatistics(stats)
+		if direction.guaranteed > 0 && direction.speed < direction.guaranteed {
+			stats.Add(
+				statistics.NewStatistic(
+					nil,
+					statistics.NewEvent(
+						fmt.Sprintf("speedtest %s below guaranteed speed", direction.name),
+						fmt.Sprintf("%s speed was %.1f Mbps, below the guaranteed %.1f Mbps", direction.name, direction.speed, direction.guaranteed),
+						append([]string{fmt.Sprintf("direction:%s", direction.name)}, tags...)...,
+					),
+				),
+			)
 		}
 	}
 
-	go func() {
-		ticker := time.NewTicker(c.interval)
-		collect()
-		for {
-			select {
-			case <-ticker.C:
-				collect()
+	if c.plan.GuaranteedDownload <= 0 && c.plan.GuaranteedUpload <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.results = append(c.results, speedTestResult{at: now, download: download, upload: upload})
+	oldest := now.Add(-complianceWindows[len(complianceWindows)-1].length)
+	for len(c.results) > 0 && c.results[0].at.Before(oldest) {
+		c.results = c.results[1:]
+	}
+	results := append([]speedTestResult{}, c.results...)
+	c.mu.Unlock()
+
+	for _, window := range complianceWindows {
+		since := now.Add(-window.length)
+		total, downloadOK, uploadOK := 0, 0, 0
+		for _, r := range results {
+			if r.at.Before(since) {
+				continue
+			}
+			total++
+			if r.download >= c.plan.GuaranteedDownload {
+				downloadOK++
+			}
+			if r.upload >= c.plan.GuaranteedUpload {
+				uploadOK++
 			}
 		}
-	}()
+		windowTags := append([]string{fmt.Sprintf("window:%s", window.name)}, tags...)
+		if c.plan.GuaranteedDownload > 0 {
+			stats.Add(
+				statistics.NewStatistic(
+					statistics.NewMetric(
+						statistics.MetricTypeGauge,
+						metricPrefix+"speedtest.download_compliance",
+						statistics.NewFloatValue(float64(downloadOK)/float64(total)*100),
+						windowTags...,
+					),
+					nil,
+				),
+			)
+		}
+		if c.plan.GuaranteedUpload > 0 {
+			stats.Add(
+				statistics.NewStatistic(
+					statistics.NewMetric(
+						statistics.MetricTypeGauge,
+						metricPrefix+"speedtest.upload_compliance",
+						statistics.NewFloatValue(float64(uploadOK)/float64(total)*100),
+						windowTags...,
+					),
+					nil,
+				),
+			)
+		}
+	}
+}
+
+// Run will run the test in the background.
+func (c *SpeedTest) Run(ctx context.Context, reporters map[string]reporters.Interface) {
+	collect := func(ctx context.Context) {
+		stats, err := c.Collect(ctx)
+		if ctx.Err() != nil {
+			// shutting down, drop the partial measurement
+			return
+		}
+		if err != nil {
+			log.Get().Warn("failed to execute speedtest", zap.String("name", c.name), zap.Error(err))
+			// error statistic
+			stats.Add(collectFailure(metricPrefix+"speedtest."+collectFailureSuffix, fmt.Sprintf("name:%s", c.name)))
+		}
+		observe(ctx, c.Name(), stats, err)
+		for _, reporter := range reporters {
+			reporter.ReportStatistics(stats)
+		}
+	}
+
+	runEvery(ctx, c, collect)
 }
@@ -0,0 +1,255 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterCollectorType("tcp", NewTCPFromConfig)
+	RegisterCollectorOptions("tcp", func() interface{} { return &TCPOptions{} })
+}
+
+// TCP measures TCP handshake time, for networks where ICMP is unreliable
+type TCP struct {
+	name            string
+	address         string
+	count           int
+	timeout         time.Duration
+	collectInterval time.Duration
+	connectInterval time.Duration
+}
+
+// TCPOptions are options specific to the TCP collector
+type TCPOptions struct {
+	Address  string      `json:"address" config:"required"`
+	Count    json.Number `json:"count"`
+	Timeout  string      `json:"timeout" config:"duration"`
+	Interval string      `json:"interval" config:"duration"`
+}
+
+// CountInt will return the count as an `int`
+func (o TCPOptions) CountInt() int {
+	v, err := o.Count.Int64()
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// NewTCPFromConfig will create a TCP collector from the config Section
+func NewTCPFromConfig(cfg config.Section, debug bool) Interface {
+	var opts TCPOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		log.Get().Warn("invalid tcp options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		// a host:port address is required
+		return nil
+	}
+	if opts.CountInt() <= 0 {
+		opts.Count = "5"
+	}
+
+	timeout := config.DurationFromString(opts.Timeout, time.Second*5)
+	interval := config.DurationFromString(cfg.Interval, time.Second*30)
+	connectInterval := config.DurationFromString(opts.Interval, time.Second*30)
+
+	return NewTCP(cfg.Name, opts.Address, opts.CountInt(), timeout, interval, connectInterval)
+}
+
+// NewTCP will create a new TCP collector, timeout applies to each connection attempt
+func NewTCP(
+	name string,
+	address string,
+	count int,
+	timeout time.Duration,
+	collectInterval time.Duration,
+	connectInterval time.Duration,
+) *TCP {
+	if name == "" {
+		name = "tcp"
+	}
+	return &TCP{
+		name:            name,
+		address:         address,
+		count:           count,
+		timeout:         timeout,
+		collectInterval: collectInterval,
+		connectInterval: connectInterval,
+	}
+}
+
+// Name returns the name of this TCP collector
+func (t *TCP) Name() string {
+	return t.name
+}
+
+// Interval returns how often this TCP collector collects
+func (t *TCP) Interval() time.Duration {
+	return t.collectInterval
+}
+
+// Collect will connect count times and report the handshake statistics
+func (t *TCP) Collect(ctx context.Context) (*statistics.Statistics, error) {
+	stats := statistics.NewStatistics()
+	collectStart := time.Now()
+	defer func() {
+		stats.Stamp(time.Now(), time.Since(collectStart))
+	}()
+	dialer := &net.Dialer{Timeout: t.timeout}
+	rtts := make([]time.Duration, 0, t.count)
+	attempts := 0
+
+	log.Get().Debug("collecting tcp results", zap.String("name", t.name), zap.String("address", t.address))
+	for i := 0; i < t.count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			case <-time.After(t.connectInterval):
+			}
+		}
+		attempts++
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", t.address)
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			log.Get().Debug("tcp connect failed", zap.String("name", t.name), zap.String("address", t.address), zap.Error(err))
+			continue
+		}
+		rtts = append(rtts, time.Since(start))
+		conn.Close()
+	}
+	log.Get().Debug("reporting tcp results", zap.String("name", t.name), zap.String("address", t.address))
+
+	tags := []string{
+		fmt.Sprintf("address:%s", t.address),
+		fmt.Sprintf("name:%s", t.name),
+	}
+
+	// report RTTs
+	if len(rtts) > 0 {
+		min, max, avg, stddev := rttStatistics(rtts)
+		for _, rtt := range []struct {
+			metric string
+			value  time.Duration
+		}{
+			{"tcp.avg_rtt", avg},
+			{"tcp.max_rtt", max},
+			{"tcp.min_rtt", min},
+			{"tcp.stddev_rtt", stddev},
+		} {
+			stats.Add(
+				statistics.NewStatistic(
+					statistics.NewMetric(
+						statistics.MetricTypeTiming,
+						metricPrefix+rtt.metric,
+						statistics.NewDurationValue(rtt.value),
+						tags...,
+					),
+					nil,
+				),
+			)
+		}
+	}
+
+	// connection info, named like the pinger's packet info with a handshake as a packet
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeCount,
+				metricPrefix+"tcp.packets_sent",
+				statistics.NewIntValue(int64(attempts)),
+				tags...,
+			),
+			nil,
+		),
+	)
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeCount,
+				metricPrefix+"tcp.packets_recv",
+				statistics.NewIntValue(int64(len(rtts))),
+				tags...,
+			),
+			nil,
+		),
+	)
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeHistogram,
+				metricPrefix+"tcp.packet_loss",
+				statistics.NewFloatValue(float64(attempts-len(rtts))/float64(attempts)*100),
+				tags...,
+			),
+			nil,
+		),
+	)
+
+	return stats, nil
+}
+
+// rttStatistics returns the min, max, mean and population standard deviation of rtts
+func rttStatistics(rtts []time.Duration) (time.Duration, time.Duration, time.Duration, time.Duration) {
+	min, max := rtts[0], rtts[0]
+	var sum time.Duration
+	for _, rtt := range rtts {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += rtt
+	}
+	avg := sum / time.Duration(len(rtts))
+	var variance float64
+	for _, rtt := range rtts {
+		diff := float64(rtt - avg)
+		variance += diff * diff
+	}
+	stddev := time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	return min, max, avg, stddev
+}
+
+// Run will run the TCP collector until ctx is cancelled
+func (t *TCP) Run(ctx context.Context, reporters map[string]reporters.Interface) {
+	tags := []string{
+		fmt.Sprintf("address:%s", t.address),
+		fmt.Sprintf("name:%s", t.name),
+	}
+
+	collect := func(ctx context.Context) {
+		stats, err := t.Collect(ctx)
+		if ctx.Err() != nil {
+			// shutting down, drop the partial measurement
+			return
+		}
+		if err != nil {
+			log.Get().Warn("failed to execute tcp connects", zap.String("name", t.name), zap.String("address", t.address), zap.Error(err))
+			// error statistic
+			stats.Add(collectFailure(metricPrefix+"tcp."+collectFailureSuffix, tags...))
+		}
+		observe(ctx, t.Name(), stats, err)
+		for _, reporter := range reporters {
+			reporter.ReportStatistics(stats)
+		}
+	}
+
+	runEvery(ctx, t, collect)
+}
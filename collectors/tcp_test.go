@@ -0,0 +1,92 @@
+package collectors
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+)
+
+// startTCPListener accepts and closes connections on a loopback port, it returns the address and a func closing it
+func startTCPListener(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestTCPCollect(t *testing.T) {
+	address, shutdown := startTCPListener(t)
+	defer shutdown()
+	c := NewTCP("https", address, 3, time.Second, time.Minute, time.Millisecond)
+
+	stats, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	tags := []string{"name:https", "address:" + address}
+	for _, metric := range []string{"avg_rtt", "max_rtt", "min_rtt", "stddev_rtt"} {
+		if m := findMetric(stats, "isp_monitor.tcp."+metric, tags...); m == nil {
+			t.Errorf("expected a %s timing", metric)
+		}
+	}
+	if m := findMetric(stats, "isp_monitor.tcp.avg_rtt"); m != nil && (m.Value.Duration() <= 0 || m.Value.Duration() > time.Second) {
+		t.Errorf("unexpected avg rtt of %s", m.Value.Duration())
+	}
+	for metric, expected := range map[string]int64{"packets_sent": 3, "packets_recv": 3} {
+		if m := findMetric(stats, "isp_monitor.tcp."+metric, tags...); m == nil || m.Value.Int() != expected {
+			t.Errorf("expected %s to be %d, got %+v", metric, expected, m)
+		}
+	}
+	if m := findMetric(stats, "isp_monitor.tcp.packet_loss", tags...); m == nil || m.Value.Float() != 0 {
+		t.Errorf("expected no packet loss, got %+v", m)
+	}
+}
+
+func TestTCPCollectRefused(t *testing.T) {
+	address, shutdown := startTCPListener(t)
+	shutdown()
+	c := NewTCP("https", address, 2, time.Second, time.Minute, time.Millisecond)
+
+	stats, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if m := findMetric(stats, "isp_monitor.tcp.avg_rtt"); m != nil {
+		t.Error("expected no rtt without a connection")
+	}
+	if m := findMetric(stats, "isp_monitor.tcp.packets_recv"); m == nil || m.Value.Int() != 0 {
+		t.Errorf("expected no connection to succeed, got %+v", m)
+	}
+	// loss is a percentage like the pinger's
+	if m := findMetric(stats, "isp_monitor.tcp.packet_loss"); m == nil || m.Value.Float() != 100 {
+		t.Errorf("expected a packet loss of 100, got %+v", m)
+	}
+}
+
+func TestTCPFromConfigDefaults(t *testing.T) {
+	c, ok := NewTCPFromConfig(config.Section{Name: "https", Options: map[string]interface{}{"address": "192.0.2.1:443"}}, false).(*TCP)
+	if !ok {
+		t.Fatal("expected a tcp collector")
+	}
+	p := NewPingerFromConfig(config.Section{Name: "gateway", Options: map[string]interface{}{"address": "192.0.2.1"}}, false).(*Pinger)
+	if c.count != p.count || c.timeout != p.timeout || c.connectInterval != p.pingInterval || c.collectInterval != p.collectInterval {
+		t.Errorf("expected the pinger defaults, got count %d, timeout %s, interval %s and collect interval %s",
+			c.count, c.timeout, c.connectInterval, c.collectInterval)
+	}
+	if c := NewTCPFromConfig(config.Section{Options: map[string]interface{}{"address": "192.0.2.1"}}, false); c != nil {
+		t.Error("expected an address without a port to be refused")
+	}
+}
@@ -0,0 +1,376 @@
+package collectors
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func init() {
+	RegisterCollectorType("traceroute", NewTracerouteFromConfig)
+	RegisterCollectorOptions("traceroute", func() interface{} { return &TracerouteOptions{} })
+}
+
+// protocolICMP is the IANA protocol number for ICMP over IPv4
+const protocolICMP = 1
+
+// noReply marks a hop that did not answer any probe
+const noReply = "*"
+
+// probeSeq is the sequence number of the last probe sent by any Traceroute
+var probeSeq uint32
+
+// Traceroute discovers the path to a target and reports per-hop loss and RTT, MTR style.
+// It sends ICMP echo requests with increasing TTLs and needs raw socket privileges.
+type Traceroute struct {
+	name            string
+	target          string
+	maxHops         int
+	count           int
+	timeout         time.Duration
+	collectInterval time.Duration
+
+	mu       sync.Mutex
+	lastPath []string
+}
+
+// TracerouteOptions are options specific to the Traceroute collector
+type TracerouteOptions struct {
+	Address string      `json:"address" config:"required"`
+	MaxHops json.Number `json:"maxHops"`
+	Count   json.Number `json:"count"`
+	Timeout string      `json:"timeout" config:"duration"`
+}
+
+// MaxHopsInt will return the max hops as an `int`
+func (o TracerouteOptions) MaxHopsInt() int {
+	v, err := o.MaxHops.Int64()
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// CountInt will return the count as an `int`
+func (o TracerouteOptions) CountInt() int {
+	v, err := o.Count.Int64()
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// NewTracerouteFromConfig will create a Traceroute from the config Section
+func NewTracerouteFromConfig(cfg config.Section, debug bool) Interface {
+	var opts TracerouteOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		log.Get().Warn("invalid traceroute options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if opts.Address == "" {
+		return nil
+	}
+	if opts.MaxHopsInt() <= 0 {
+		opts.MaxHops = "30"
+	}
+	if opts.CountInt() <= 0 {
+		opts.Count = "3"
+	}
+
+	timeout := config.DurationFromString(opts.Timeout, time.Second)
+	interval := config.DurationFromString(cfg.Interval, time.Minute*5)
+
+	return NewTraceroute(cfg.Name, opts.Address, opts.MaxHopsInt(), opts.CountInt(), timeout, interval)
+}
+
+// NewTraceroute will create a new Traceroute, count probes are sent to every hop each waiting up to timeout
+func NewTraceroute(
+	name string,
+	target string,
+	maxHops int,
+	count int,
+	timeout time.Duration,
+	collectInterval time.Duration,
+) *Traceroute {
+	if name == "" {
+		name = "traceroute"
+	}
+	return &Traceroute{
+		name:            name,
+		target:          target,
+		maxHops:         maxHops,
+		count:           count,
+		timeout:         timeout,
+		collectInterval: collectInterval,
+	}
+}
+
+// Name returns the name of this Traceroute
+func (t *Traceroute) Name() string {
+	return t.name
+}
+
+// Interval returns how often this Traceroute collects
+func (t *Traceroute) Interval() time.Duration {
+	return t.collectInterval
+}
+
+// hop is the result of probing a single TTL
+type hop struct {
+	address string
+	sent    int
+	rtts    []time.Duration
+}
+
+// Collect will trace the path to the target
+func (t *Traceroute) Collect(ctx context.Context) (*statistics.Statistics, error) {
+	stats := statistics.NewStatistics()
+	start := time.Now()
+	defer func() {
+		stats.Stamp(time.Now(), time.Since(start))
+	}()
+	dst, err := net.ResolveIPAddr("ip4", t.target)
+	if err != nil {
+		return stats, err
+	}
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+
+	log.Get().Debug("collecting traceroute results", zap.String("name", t.name), zap.String("target", t.target))
+	hops := make([]hop, 0, t.maxHops)
+	reached := false
+	for ttl := 1; ttl <= t.maxHops && !reached; ttl++ {
+		h := hop{address: noReply}
+		for i := 0; i < t.count; i++ {
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			from, rtt, done, err := t.probe(conn, dst, ttl)
+			h.sent++
+			if err != nil {
+				return stats, err
+			}
+			if from == "" {
+				continue
+			}
+			h.address = from
+			h.rtts = append(h.rtts, rtt)
+			reached = reached || done
+		}
+		hops = append(hops, h)
+	}
+	log.Get().Debug("reporting traceroute results", zap.String("name", t.name), zap.String("target", t.target))
+
+	tags := []string{
+		fmt.Sprintf("target:%s", t.target),
+		fmt.Sprintf("name:%s", t.name),
+	}
+	path := make([]string, 0, len(hops))
+	for i, h := range hops {
+		path = append(path, h.address)
+		hopTags := append([]string{
+			fmt.Sprintf("hop:%d", i+1),
+			fmt.Sprintf("hop_address:%s", h.address),
+		}, tags...)
+		stats.Add(
+			statistics.NewStatistic(
+				statistics.NewMetric(
+					statistics.MetricTypeHistogram,
+					metricPrefix+"traceroute.hop_loss",
+					statistics.NewFloatValue(float64(h.sent-len(h.rtts))/float64(h.sent)*100),
+					hopTags...,
+				),
+				nil,
+			),
+		)
+		if len(h.rtts) > 0 {
+			_, _, avg, _ := rttStatistics(h.rtts)
+			stats.Add(
+				statistics.NewStatistic(
+					statistics.NewMetric(
+						statistics.MetricTypeTiming,
+						metricPrefix+"traceroute.hop_rtt",
+						statistics.NewDurationValue(avg),
+						hopTags...,
+					),
+					nil,
+				),
+			)
+		}
+	}
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeGauge,
+				metricPrefix+"traceroute.hop_count",
+				statistics.NewFloatValue(float64(len(hops))),
+				tags...,
+			),
+			nil,
+		),
+	)
+	reachedValue := 0.0
+	if reached {
+		reachedValue = 1
+	}
+	stats.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeGauge,
+				metricPrefix+"traceroute.reached",
+				statistics.NewFloatValue(reachedValue),
+				tags...,
+			),
+			nil,
+		),
+	)
+
+	t.mu.Lock()
+	previous := t.lastPath
+	t.lastPath = path
+	t.mu.Unlock()
+	if previous != nil && pathChanged(previous, path) {
+		stats.Add(
+			statistics.NewStatistic(
+				nil,
+				statistics.NewEvent(
+					fmt.Sprintf("traceroute path to %s changed", t.target),
+					fmt.Sprintf("%s => %s", strings.Join(previous, " -> "), strings.Join(path, " -> ")),
+					tags...,
+				),
+			),
+		)
+	}
+
+	return stats, nil
+}
+
+// probe sends a single echo request with the given TTL and waits for the matching reply.
+// It returns the responding address, which is empty on timeout, and whether it was the destination.
+func (t *Traceroute) probe(conn *icmp.PacketConn, dst *net.IPAddr, ttl int) (string, time.Duration, bool, error) {
+	// every Traceroute in the process shares the id, the sequence tells their probes apart
+	seq := uint16(atomic.AddUint32(&probeSeq, 1))
+	id := os.Getpid() & 0xffff
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: int(seq), Data: []byte("isp-monitor")},
+	}
+	data, err := msg.Marshal(nil)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if err := conn.IPv4PacketConn().SetTTL(ttl); err != nil {
+		return "", 0, false, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(data, dst); err != nil {
+		return "", 0, false, err
+	}
+
+	deadline := start.Add(t.timeout)
+	buf := make([]byte, 1500)
+	for {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return "", 0, false, err
+		}
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return "", 0, false, nil
+			}
+			return "", 0, false, err
+		}
+		rtt := time.Since(start)
+		reply, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil {
+			continue
+		}
+		switch body := reply.Body.(type) {
+		case *icmp.Echo:
+			if reply.Type == ipv4.ICMPTypeEchoReply && body.ID == id && body.Seq == int(seq) {
+				return from.String(), rtt, true, nil
+			}
+		case *icmp.TimeExceeded:
+			if matchesProbe(body.Data, id, seq) {
+				return from.String(), rtt, false, nil
+			}
+		case *icmp.DstUnreach:
+			if matchesProbe(body.Data, id, seq) {
+				return from.String(), rtt, true, nil
+			}
+		}
+	}
+}
+
+// matchesProbe checks whether the original datagram quoted in an ICMP error is our echo request.
+func matchesProbe(data []byte, id int, seq uint16) bool {
+	if len(data) < 1 {
+		return false
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	if len(data) < headerLen+8 {
+		return false
+	}
+	echo := data[headerLen:]
+	return echo[0] == byte(ipv4.ICMPTypeEcho) &&
+		int(binary.BigEndian.Uint16(echo[4:6])) == id &&
+		binary.BigEndian.Uint16(echo[6:8]) == seq
+}
+
+// pathChanged compares two paths, unresponsive hops match any address.
+func pathChanged(previous []string, current []string) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for i := range previous {
+		if previous[i] != current[i] && previous[i] != noReply && current[i] != noReply {
+			return true
+		}
+	}
+	return false
+}
+
+// Run will run the Traceroute until ctx is cancelled
+func (t *Traceroute) Run(ctx context.Context, reporters map[string]reporters.Interface) {
+	tags := []string{
+		fmt.Sprintf("target:%s", t.target),
+		fmt.Sprintf("name:%s", t.name),
+	}
+
+	collect := func(ctx context.Context) {
+		stats, err := t.Collect(ctx)
+		if ctx.Err() != nil {
+			// shutting down, drop the partial measurement
+			return
+		}
+		if err != nil {
+			log.Get().Warn("failed to execute traceroute", zap.String("name", t.name), zap.String("target", t.target), zap.Error(err))
+			// error statistic
+			stats.Add(collectFailure(metricPrefix+"traceroute."+collectFailureSuffix, tags...))
+		}
+		observe(ctx, t.Name(), stats, err)
+		for _, reporter := range reporters {
+			reporter.ReportStatistics(stats)
+		}
+	}
+
+	runEvery(ctx, t, collect)
+}
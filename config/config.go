@@ -1,5 +1,13 @@
 package config
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
 // Section defines the config section.
 type Section struct {
 	Name     string                 `yaml:"name"`
@@ -8,8 +16,80 @@ type Section struct {
 	Options  map[string]interface{} `yaml:"options"`
 }
 
+// DecodeOptions decodes the section options into v, a pointer to an options struct with `json` tags.
+func (s Section) DecodeOptions(v interface{}) error {
+	return DecodeOptions(s.Options, v)
+}
+
+// DecodeOptions decodes options into v, a pointer to an options struct with `json` tags.
+func DecodeOptions(options map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(normalize(options))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// DurationFromString parses a duration option, it returns defaultDuration when s is empty, invalid or not positive.
+func DurationFromString(s string, defaultDuration time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err == nil && d > 0 {
+		return d
+	}
+	return defaultDuration
+}
+
+// Parse decodes a YAML config. It uses the same YAML library as Validate, so both read values,
+// such as `yes` or `on`, the same way.
+func Parse(data []byte) (Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// normalize converts the map[interface{}]interface{} values yaml decodes nested
+// mappings into so they can be encoded as JSON.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = normalize(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, val := range t {
+			l[i] = normalize(val)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
 // Config defines the configuration
 type Config struct {
-	Collectors []Section `yaml:"collectors,inline"`
-	Reporters  []Section `yaml:"reporters,inline"`
+	Collectors []Section `yaml:"collectors"`
+	Reporters  []Section `yaml:"reporters"`
+	// Outage enables outage tracking when present, even if empty.
+	Outage map[string]interface{} `yaml:"outage"`
+	// Topology maps network layers to the names of the collectors probing them.
+	Topology map[string][]string `yaml:"topology"`
+	// Alerts are alerting rules evaluated against the collected statistics.
+	Alerts []map[string]interface{} `yaml:"alerts"`
+	// API enables the HTTP status API when present, even if empty.
+	API map[string]interface{} `yaml:"api"`
+	// Dashboard enables the web dashboard when present, even if empty.
+	Dashboard map[string]interface{} `yaml:"dashboard"`
+	// Dispatcher configures the queues between the collectors and the reporters.
+	Dispatcher map[string]interface{} `yaml:"dispatcher"`
 }
@@ -0,0 +1,459 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Option fields are annotated with a `config` struct tag for validation:
+//   - `config:"duration"` must be a positive duration, such as 30s or 5m
+//   - `config:"required"` must be set
+//
+// Both may be combined as `config:"required,duration"`.
+const validateTag = "config"
+
+// Validator is implemented by options structs that check more than their fields,
+// Validate is called once the options decoded without errors.
+type Validator interface {
+	Validate() error
+}
+
+// Schema describes the options accepted by every part of the config
+type Schema struct {
+	// CollectorOptions and ReporterOptions return a pointer to a new options struct for a type, or nil
+	// when the type does not describe its options. ok is false for unknown types.
+	CollectorOptions func(sectionType string) (options interface{}, ok bool)
+	ReporterOptions  func(sectionType string) (options interface{}, ok bool)
+	// Sections maps the top level sections that hold options, such as `outage`, to a pointer to their options struct.
+	Sections map[string]interface{}
+	// Alert is a pointer to the options struct every alert rule decodes into.
+	Alert interface{}
+}
+
+// ValidationError is a problem found in the config, at a line and column of the file
+type ValidationError struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+// Error formats the problem as `line:column: path: message`, the column is left out when unknown
+func (e ValidationError) Error() string {
+	position := fmt.Sprintf("%d", e.Line)
+	if e.Column > 0 {
+		position = fmt.Sprintf("%d:%d", e.Line, e.Column)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", position, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", position, e.Path, e.Message)
+}
+
+// yamlLine finds the line number in yaml parser errors
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// Validate strictly checks a YAML config against the schema, returning every problem found ordered by line.
+func Validate(data []byte, schema Schema) []ValidationError {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		e := ValidationError{Message: err.Error()}
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Message = m[2]
+		}
+		return []ValidationError{e}
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	v := &validator{schema: schema}
+	v.config(doc.Content[0])
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Column < v.errs[j].Column
+	})
+	return v.errs
+}
+
+type validator struct {
+	schema Schema
+	errs   []ValidationError
+}
+
+func (v *validator) errorf(node *yaml.Node, path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// pairs returns the key and value nodes of a mapping
+func pairs(node *yaml.Node) [][2]*yaml.Node {
+	out := make([][2]*yaml.Node, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		out = append(out, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+	}
+	return out
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+func (v *validator) config(root *yaml.Node) {
+	if isNull(root) {
+		return
+	}
+	if root.Kind != yaml.MappingNode {
+		v.errorf(root, "", "expected a mapping of config sections")
+		return
+	}
+	known := yamlFields(reflect.TypeOf(Config{}))
+	var collectorNames map[string]bool
+	var topology *yaml.Node
+	for _, kv := range pairs(root) {
+		key, value := kv[0], kv[1]
+		if _, ok := known[key.Value]; !ok {
+			v.errorf(key, "", "unknown section %q", key.Value)
+			continue
+		}
+		switch key.Value {
+		case "collectors":
+			collectorNames = v.sections(value, key.Value, true, v.schema.CollectorOptions)
+		case "reporters":
+			v.sections(value, key.Value, false, v.schema.ReporterOptions)
+		case "alerts":
+			v.alerts(value)
+		case "topology":
+			topology = value
+		default:
+			if options, ok := v.schema.Sections[key.Value]; ok {
+				v.options(value, key.Value, options)
+			}
+		}
+	}
+	if topology != nil {
+		v.topology(topology, collectorNames)
+	}
+}
+
+// sections validates a list of collector or reporter sections, returning their names
+func (v *validator) sections(node *yaml.Node, path string, collectors bool, lookup func(string) (interface{}, bool)) map[string]bool {
+	names := make(map[string]bool)
+	if isNull(node) {
+		return names
+	}
+	if node.Kind != yaml.SequenceNode {
+		v.errorf(node, path, "expected a list of sections")
+		return names
+	}
+	known := yamlFields(reflect.TypeOf(Section{}))
+	for i, item := range node.Content {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if item.Kind != yaml.MappingNode {
+			v.errorf(item, itemPath, "expected a section with a name and type")
+			continue
+		}
+		values := make(map[string]*yaml.Node)
+		var unknown []*yaml.Node
+		for _, kv := range pairs(item) {
+			if _, ok := known[kv[0].Value]; !ok {
+				unknown = append(unknown, kv[0])
+				continue
+			}
+			values[kv[0].Value] = kv[1]
+		}
+
+		if name, ok := values["name"]; ok && name.Value != "" {
+			itemPath = fmt.Sprintf("%s[%d] (%s)", path, i, name.Value)
+			if names[name.Value] {
+				v.errorf(name, itemPath, "duplicate name %q, only the last section with a name is used", name.Value)
+			}
+			names[name.Value] = true
+		}
+		for _, key := range unknown {
+			v.errorf(key, itemPath, "unknown field %q, expected one of name, type, interval or options", key.Value)
+		}
+
+		if interval, ok := values["interval"]; ok {
+			if !collectors {
+				v.errorf(interval, itemPath, "interval is only used by collectors")
+			} else {
+				v.duration(interval, itemPath+".interval")
+			}
+		}
+
+		typeNode, ok := values["type"]
+		if !ok || typeNode.Value == "" {
+			v.errorf(item, itemPath, "missing required field \"type\"")
+			continue
+		}
+		options, ok := lookup(typeNode.Value)
+		if !ok {
+			v.errorf(typeNode, itemPath, "unknown type %q", typeNode.Value)
+			continue
+		}
+		if options != nil {
+			optionsNode, ok := values["options"]
+			if !ok {
+				// check for missing required options against an empty mapping
+				optionsNode = &yaml.Node{Kind: yaml.MappingNode, Line: item.Line, Column: item.Column}
+			}
+			v.options(optionsNode, itemPath+".options", options)
+		}
+	}
+	return names
+}
+
+func (v *validator) alerts(node *yaml.Node) {
+	if isNull(node) {
+		return
+	}
+	if node.Kind != yaml.SequenceNode {
+		v.errorf(node, "alerts", "expected a list of alert rules")
+		return
+	}
+	for i, item := range node.Content {
+		if v.schema.Alert != nil {
+			v.options(item, fmt.Sprintf("alerts[%d]", i), v.schema.Alert)
+		}
+	}
+}
+
+func (v *validator) topology(node *yaml.Node, collectors map[string]bool) {
+	if isNull(node) {
+		return
+	}
+	if node.Kind != yaml.MappingNode {
+		v.errorf(node, "topology", "expected a mapping of layers to collector names")
+		return
+	}
+	for _, kv := range pairs(node) {
+		path := "topology." + kv[0].Value
+		if kv[1].Kind != yaml.SequenceNode {
+			v.errorf(kv[1], path, "expected a list of collector names")
+			continue
+		}
+		for _, name := range kv[1].Content {
+			if !collectors[name.Value] {
+				v.errorf(name, path, "unknown collector %q", name.Value)
+			}
+		}
+	}
+}
+
+// options validates node against the options struct pointed to by options, decoding it the way
+// DecodeOptions does at runtime.
+func (v *validator) options(node *yaml.Node, path string, options interface{}) {
+	before := len(v.errs)
+	v.value(node, path, reflect.TypeOf(options))
+	if len(v.errs) > before {
+		return
+	}
+
+	var raw interface{}
+	if err := node.Decode(&raw); err != nil {
+		v.errorf(node, path, "%v", err)
+		return
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		v.errorf(node, path, "%v", err)
+		return
+	}
+	target := reflect.New(reflect.TypeOf(options).Elem()).Interface()
+	if err := json.Unmarshal(data, target); err != nil {
+		errNode, errPath, message := node, path, err.Error()
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			errNode = find(node, typeErr.Field)
+			message = fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)
+			if typeErr.Field != "" {
+				errPath = path + "." + typeErr.Field
+			}
+		}
+		v.errorf(errNode, errPath, "%s", message)
+		return
+	}
+	if validator, ok := target.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			v.errorf(node, path, "%v", err)
+		}
+	}
+}
+
+// value checks the keys, required fields and durations of node against t
+func (v *validator) value(node *yaml.Node, path string, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if isNull(node) {
+		node = &yaml.Node{Kind: yaml.MappingNode, Line: node.Line, Column: node.Column}
+		if t.Kind() != reflect.Struct {
+			return
+		}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, path, "expected a mapping")
+			return
+		}
+		fields := jsonFields(t)
+		seen := make(map[string]bool)
+		for _, kv := range pairs(node) {
+			f, ok := fields[strings.ToLower(kv[0].Value)]
+			if !ok {
+				v.errorf(kv[0], path, "unknown option %q", kv[0].Value)
+				continue
+			}
+			seen[f.name] = true
+			fieldPath := path + "." + kv[0].Value
+			if f.required && isEmpty(kv[1]) {
+				v.errorf(kv[1], fieldPath, "required option is empty")
+			}
+			if f.duration {
+				v.duration(kv[1], fieldPath)
+				continue
+			}
+			v.value(kv[1], fieldPath, f.typ)
+		}
+		names := make([]string, 0, len(fields))
+		for _, f := range fields {
+			if f.required && !seen[f.name] {
+				names = append(names, f.name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v.errorf(node, path, "missing required option %q", name)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, path, "expected a mapping")
+			return
+		}
+		for _, kv := range pairs(node) {
+			v.value(kv[1], path+"."+kv[0].Value, t.Elem())
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.errorf(node, path, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			v.value(item, fmt.Sprintf("%s[%d]", path, i), t.Elem())
+		}
+	}
+}
+
+func (v *validator) duration(node *yaml.Node, path string) {
+	if isNull(node) || node.Value == "" {
+		return
+	}
+	d, err := time.ParseDuration(node.Value)
+	if err != nil || d <= 0 || node.Kind != yaml.ScalarNode {
+		v.errorf(node, path, "invalid duration %q, expected a positive duration such as 30s or 5m", node.Value)
+	}
+}
+
+func isEmpty(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return isNull(node) || node.Value == ""
+	case yaml.SequenceNode, yaml.MappingNode:
+		return len(node.Content) == 0
+	}
+	return false
+}
+
+// find returns the node at a dotted json field path, or the closest parent found
+func find(node *yaml.Node, field string) *yaml.Node {
+	if field == "" {
+		return node
+	}
+	for _, part := range strings.Split(field, ".") {
+		if node.Kind != yaml.MappingNode {
+			return node
+		}
+		found := false
+		for _, kv := range pairs(node) {
+			if strings.EqualFold(kv[0].Value, part) {
+				node, found = kv[1], true
+				break
+			}
+		}
+		if !found {
+			return node
+		}
+	}
+	return node
+}
+
+type field struct {
+	name     string
+	typ      reflect.Type
+	required bool
+	duration bool
+}
+
+// jsonFields returns the fields of a struct by lower cased json name, including those of embedded
+// structs, matching keys case insensitively like encoding/json.
+func jsonFields(t reflect.Type) map[string]field {
+	fields := make(map[string]field)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			for name, embedded := range jsonFields(f.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = embedded
+				}
+			}
+			continue
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		info := field{name: name, typ: f.Type}
+		for _, flag := range strings.Split(f.Tag.Get(validateTag), ",") {
+			switch flag {
+			case "required":
+				info.required = true
+			case "duration":
+				info.duration = true
+			}
+		}
+		fields[strings.ToLower(name)] = info
+	}
+	return fields
+}
+
+// yamlFields returns the yaml names of the fields of a struct
+func yamlFields(t reflect.Type) map[string]struct{} {
+	fields := make(map[string]struct{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(t.Field(i).Name)
+		}
+		fields[name] = struct{}{}
+	}
+	return fields
+}
@@ -0,0 +1,262 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type pingOptions struct {
+	Address  string `json:"address" config:"required"`
+	Count    int    `json:"count"`
+	Interval string `json:"interval" config:"duration"`
+}
+
+type queueOptions struct {
+	QueueSize int `json:"queue_size"`
+}
+
+type dispatcherOptions struct {
+	queueOptions
+	DrainTimeout string                  `json:"drain_timeout" config:"duration"`
+	Reporters    map[string]queueOptions `json:"reporters"`
+}
+
+type ruleOptions struct {
+	Name      string  `json:"name" config:"required"`
+	Threshold float64 `json:"threshold"`
+	For       string  `json:"for" config:"duration"`
+}
+
+// Validate rejects rules without a threshold
+func (r *ruleOptions) Validate() error {
+	if r.Threshold == 0 {
+		return errors.New("a threshold is required")
+	}
+	return nil
+}
+
+func testSchema() Schema {
+	lookup := func(types map[string]func() interface{}) func(string) (interface{}, bool) {
+		return func(sectionType string) (interface{}, bool) {
+			options, ok := types[sectionType]
+			if !ok {
+				return nil, false
+			}
+			if options == nil {
+				return nil, true
+			}
+			return options(), true
+		}
+	}
+	return Schema{
+		CollectorOptions: lookup(map[string]func() interface{}{
+			"ping": func() interface{} { return &pingOptions{} },
+		}),
+		ReporterOptions: lookup(map[string]func() interface{}{
+			"log": nil,
+		}),
+		Sections: map[string]interface{}{
+			"dispatcher": &dispatcherOptions{},
+		},
+		Alert: &ruleOptions{},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name: "valid",
+			config: `
+collectors:
+  - name: gateway
+    type: ping
+    interval: 30s
+    options:
+      address: 192.0.2.1
+      Count: 5
+reporters:
+  - type: log
+dispatcher:
+  queue_size: 10
+  drain_timeout: 5s
+  reporters:
+    log:
+      queue_size: 5
+topology:
+  gateway: [gateway]
+alerts:
+  - name: loss
+    threshold: 5
+    for: 1m
+`,
+		},
+		{
+			name:   "empty",
+			config: ``,
+		},
+		{
+			name:     "syntax error",
+			config:   "collectors:\n  - name: gateway\n  - name: \"dns\n    type: ping\n",
+			expected: []string{"3: found unexpected end of stream"},
+		},
+		{
+			name:     "not a mapping",
+			config:   "- collectors\n",
+			expected: []string{"1:1: expected a mapping of config sections"},
+		},
+		{
+			name: "unknown section, type and field",
+			config: `
+collector: []
+collectors:
+  - name: gateway
+    type: pong
+  - name: dns
+    type: ping
+    address: 192.0.2.1
+    options:
+      address: 192.0.2.1
+reporters:
+  - name: log
+`,
+			expected: []string{
+				`2:1: unknown section "collector"`,
+				`5:11: collectors[0] (gateway): unknown type "pong"`,
+				`8:5: collectors[1] (dns): unknown field "address", expected one of name, type, interval or options`,
+				`12:5: reporters[0] (log): missing required field "type"`,
+			},
+		},
+		{
+			name: "unknown and missing options",
+			config: `
+collectors:
+  - name: gateway
+    type: ping
+    options:
+      adress: 192.0.2.1
+  - name: dns
+    type: ping
+`,
+			expected: []string{
+				`6:7: collectors[0] (gateway).options: unknown option "adress"`,
+				`6:7: collectors[0] (gateway).options: missing required option "address"`,
+				`7:5: collectors[1] (dns).options: missing required option "address"`,
+			},
+		},
+		{
+			name: "empty required option",
+			config: `
+collectors:
+  - type: ping
+    options:
+      address: ""
+`,
+			expected: []string{`5:16: collectors[0].options.address: required option is empty`},
+		},
+		{
+			name: "durations",
+			config: `
+collectors:
+  - type: ping
+    interval: 30
+    options:
+      address: 192.0.2.1
+      interval: -1s
+reporters:
+  - type: log
+    interval: 1m
+dispatcher:
+  drain_timeout: soon
+`,
+			expected: []string{
+				`4:15: collectors[0].interval: invalid duration "30", expected a positive duration such as 30s or 5m`,
+				`7:17: collectors[0].options.interval: invalid duration "-1s", expected a positive duration such as 30s or 5m`,
+				`10:15: reporters[0]: interval is only used by collectors`,
+				`12:18: dispatcher.drain_timeout: invalid duration "soon", expected a positive duration such as 30s or 5m`,
+			},
+		},
+		{
+			name: "wrongly typed values",
+			config: `
+collectors:
+  - type: ping
+    options:
+      address: 192.0.2.1
+      count: five
+dispatcher:
+  reporters:
+    log: 5
+`,
+			expected: []string{
+				`6:14: collectors[0].options.count: expected int, got string`,
+				`9:10: dispatcher.reporters.log: expected a mapping`,
+			},
+		},
+		{
+			name: "duplicate names",
+			config: `
+collectors:
+  - name: gateway
+    type: ping
+    options: {address: 192.0.2.1}
+  - name: gateway
+    type: ping
+    options: {address: 192.0.2.2}
+`,
+			expected: []string{`6:11: collectors[1] (gateway): duplicate name "gateway", only the last section with a name is used`},
+		},
+		{
+			name: "unknown topology collector",
+			config: `
+collectors:
+  - name: gateway
+    type: ping
+    options: {address: 192.0.2.1}
+topology:
+  gateway: [gateway, modem]
+`,
+			expected: []string{`7:22: topology.gateway: unknown collector "modem"`},
+		},
+		{
+			name: "alert rules",
+			config: `
+alerts:
+  - name: loss
+    threshold: 5
+    severity: high
+  - name: rtt
+`,
+			expected: []string{
+				`5:5: alerts[0]: unknown option "severity"`,
+				`6:5: alerts[1]: a threshold is required`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := Validate([]byte(tc.config), testSchema())
+			got := make([]string, 0, len(errs))
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.expected, "\n") {
+				t.Errorf("expected problems:\n%s\ngot:\n%s", strings.Join(tc.expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseMatchesValidate(t *testing.T) {
+	// yaml 1.1 booleans are strings, as the validator reads them
+	cfg, err := Parse([]byte("collectors:\n  - name: gateway\n    type: ping\n    options:\n      enabled: yes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := cfg.Collectors[0].Options["enabled"]; v != "yes" {
+		t.Errorf("expected yes to be a string, got %#v", v)
+	}
+}
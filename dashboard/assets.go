@@ -0,0 +1,240 @@
+package dashboard
+
+// indexHTML is the self-contained dashboard page, it polls data.json and draws SVG charts.
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ISP Monitor</title>
+<style>
+  body { font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; margin: 0; background: #f4f5f7; color: #222; }
+  header { padding: 24px; color: #fff; background: #888; }
+  header h1 { margin: 0; font-size: 28px; }
+  header p { margin: 4px 0 0; opacity: 0.85; }
+  header.up { background: #2e8540; }
+  header.degraded { background: #d98c00; }
+  header.down { background: #c0392b; }
+  main { max-width: 1100px; margin: 0 auto; padding: 16px; }
+  section { background: #fff; border-radius: 8px; padding: 16px; margin-bottom: 16px; box-shadow: 0 1px 3px rgba(0,0,0,0.1); }
+  h2 { margin: 0 0 12px; font-size: 18px; }
+  .cards { display: flex; flex-wrap: wrap; gap: 8px; }
+  .card { padding: 8px 12px; border-radius: 6px; color: #fff; background: #888; }
+  .card.up { background: #2e8540; }
+  .card.degraded { background: #d98c00; }
+  .card.down { background: #c0392b; }
+  .legend { font-size: 13px; margin-top: 4px; }
+  .legend span { display: inline-block; margin-right: 12px; }
+  .legend i { display: inline-block; width: 12px; height: 3px; margin-right: 4px; vertical-align: middle; }
+  svg { width: 100%; height: auto; display: block; }
+  svg text { font-size: 11px; fill: #666; }
+  .empty { color: #888; font-style: italic; }
+  table { width: 100%; border-collapse: collapse; font-size: 14px; }
+  td { padding: 4px 8px; border-top: 1px solid #eee; vertical-align: top; }
+  td.time { white-space: nowrap; color: #666; }
+</style>
+</head>
+<body>
+<header id="summary"><h1>Loading...</h1><p></p></header>
+<main>
+  <section><h2>Current status</h2><div id="status" class="cards"></div></section>
+  <section><h2>Latency (ms)</h2><div id="latency"></div></section>
+  <section><h2>Packet loss (%)</h2><div id="loss"></div></section>
+  <section><h2>Speed tests (Mbps)</h2><div id="speed"></div></section>
+  <section><h2>Outages</h2><div id="timeline"></div></section>
+  <section><h2>Recent events</h2><div id="events"></div></section>
+</main>
+<script>
+(function () {
+  var palette = ["#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#17becf"];
+  var stateColors = { up: "#2e8540", degraded: "#d98c00", down: "#c0392b" };
+  var svgNS = "http://www.w3.org/2000/svg";
+
+  function el(name, attrs, parent) {
+    var e = document.createElementNS(svgNS, name);
+    for (var k in attrs) { e.setAttribute(k, attrs[k]); }
+    if (parent) { parent.appendChild(e); }
+    return e;
+  }
+
+  function text(parent, x, y, value, anchor) {
+    var t = el("text", { x: x, y: y, "text-anchor": anchor || "start" }, parent);
+    t.textContent = value;
+    return t;
+  }
+
+  function clock(ms) {
+    var d = new Date(ms);
+    return ("0" + d.getHours()).slice(-2) + ":" + ("0" + d.getMinutes()).slice(-2);
+  }
+
+  function empty(container, message) {
+    container.innerHTML = "";
+    var p = document.createElement("p");
+    p.className = "empty";
+    p.textContent = message;
+    container.appendChild(p);
+  }
+
+  // lineChart draws lines of [ms, value] points between from and to, with optional dashed reference lines
+  function lineChart(container, lines, from, to, refs) {
+    refs = refs || [];
+    var hasPoints = lines.some(function (l) { return l.points.length > 0; });
+    if (!hasPoints) { empty(container, "No data yet"); return; }
+    var w = 1000, h = 240, left = 50, right = 10, top = 10, bottom = 24;
+    var max = 0;
+    lines.forEach(function (l) { l.points.forEach(function (p) { max = Math.max(max, p[1]); }); });
+    refs.forEach(function (r) { max = Math.max(max, r.value); });
+    max = max > 0 ? max * 1.1 : 1;
+    var x = function (t) { return left + (t - from) / (to - from) * (w - left - right); };
+    var y = function (v) { return top + (1 - v / max) * (h - top - bottom); };
+
+    container.innerHTML = "";
+    var svg = el("svg", { viewBox: "0 0 " + w + " " + h }, container);
+    for (var i = 0; i <= 4; i++) {
+      var v = max / 4 * i;
+      el("line", { x1: left, x2: w - right, y1: y(v), y2: y(v), stroke: "#eee" }, svg);
+      text(svg, left - 6, y(v) + 4, v >= 10 ? Math.round(v) : v.toFixed(1), "end");
+    }
+    for (var j = 0; j <= 6; j++) {
+      var t = from + (to - from) / 6 * j;
+      text(svg, x(t), h - 6, clock(t), "middle");
+    }
+    refs.forEach(function (r) {
+      el("line", { x1: left, x2: w - right, y1: y(r.value), y2: y(r.value), stroke: r.color, "stroke-dasharray": "6 4" }, svg);
+      text(svg, w - right, y(r.value) - 4, r.label, "end");
+    });
+    lines.forEach(function (l) {
+      if (l.points.length === 0) { return; }
+      var d = l.points.map(function (p, k) { return (k === 0 ? "M" : "L") + x(p[0]).toFixed(1) + "," + y(p[1]).toFixed(1); }).join(" ");
+      el("path", { d: d, fill: "none", stroke: l.color, "stroke-width": 2 }, svg);
+      if (l.points.length === 1) {
+        el("circle", { cx: x(l.points[0][0]), cy: y(l.points[0][1]), r: 3, fill: l.color }, svg);
+      }
+    });
+
+    var legend = document.createElement("div");
+    legend.className = "legend";
+    lines.concat(refs).forEach(function (l) {
+      var span = document.createElement("span");
+      var swatch = document.createElement("i");
+      swatch.style.background = l.color;
+      span.appendChild(swatch);
+      span.appendChild(document.createTextNode(l.label));
+      legend.appendChild(span);
+    });
+    container.appendChild(legend);
+  }
+
+  function seriesLines(series, prefix) {
+    return series.map(function (s, i) {
+      return { label: (prefix || "") + (s.target || "speedtest"), color: palette[i % palette.length], points: s.points };
+    });
+  }
+
+  function renderSummary(status) {
+    var header = document.getElementById("summary");
+    var worst = "up";
+    status.forEach(function (s) {
+      if (s.state === "down" || (s.state === "degraded" && worst === "up")) { worst = s.state; }
+    });
+    var titles = { up: "Internet is working normally", degraded: "Internet is slow or unreliable", down: "Internet is down" };
+    header.className = status.length ? worst : "";
+    header.querySelector("h1").textContent = status.length ? titles[worst] : "Waiting for data";
+    header.querySelector("p").textContent = "Updated " + new Date().toLocaleTimeString();
+  }
+
+  function renderStatus(status) {
+    var container = document.getElementById("status");
+    if (!status.length) { empty(container, "Enable outage tracking to see target status"); return; }
+    container.innerHTML = "";
+    status.forEach(function (s) {
+      var card = document.createElement("div");
+      card.className = "card " + s.state;
+      card.textContent = s.name + ": " + s.state;
+      container.appendChild(card);
+    });
+  }
+
+  function renderTimeline(incidents, from, to) {
+    var container = document.getElementById("timeline");
+    if (!incidents.length) { empty(container, "No outages in this period"); return; }
+    var targets = [];
+    incidents.forEach(function (i) { if (targets.indexOf(i.target) < 0) { targets.push(i.target); } });
+    targets.sort();
+    var w = 1000, left = 200, right = 10, row = 26, h = targets.length * row + 24;
+    var x = function (t) { return left + Math.max(0, Math.min(1, (t - from) / (to - from))) * (w - left - right); };
+    container.innerHTML = "";
+    var svg = el("svg", { viewBox: "0 0 " + w + " " + h }, container);
+    targets.forEach(function (target, r) {
+      text(svg, left - 8, r * row + 17, target, "end");
+      el("rect", { x: left, y: r * row + 4, width: w - left - right, height: row - 8, fill: stateColors.up, opacity: 0.25 }, svg);
+    });
+    incidents.forEach(function (i) {
+      var start = Date.parse(i.start);
+      var end = i.end ? Date.parse(i.end) : to;
+      var r = targets.indexOf(i.target);
+      var rect = el("rect", { x: x(start), y: r * row + 4, width: Math.max(2, x(end) - x(start)), height: row - 8, fill: stateColors[i.state] || "#888" }, svg);
+      var title = el("title", {}, rect);
+      title.textContent = i.target + " " + i.state + " from " + new Date(start).toLocaleString() + (i.end ? " to " + new Date(end).toLocaleString() : " (ongoing)");
+    });
+    for (var j = 0; j <= 6; j++) {
+      var t = from + (to - from) / 6 * j;
+      text(svg, x(t), h - 4, clock(t), "middle");
+    }
+  }
+
+  function renderEvents(events) {
+    var container = document.getElementById("events");
+    if (!events.length) { empty(container, "No events in this period"); return; }
+    var table = document.createElement("table");
+    events.slice(-20).reverse().forEach(function (e) {
+      var tr = document.createElement("tr");
+      var when = document.createElement("td");
+      when.className = "time";
+      when.textContent = new Date(e.time).toLocaleString();
+      var what = document.createElement("td");
+      var strong = document.createElement("strong");
+      strong.textContent = e.title;
+      what.appendChild(strong);
+      what.appendChild(document.createTextNode(" " + e.message));
+      tr.appendChild(when);
+      tr.appendChild(what);
+      table.appendChild(tr);
+    });
+    container.innerHTML = "";
+    container.appendChild(table);
+  }
+
+  function render(data) {
+    var from = Date.parse(data.from), to = Date.parse(data.generated);
+    renderSummary(data.status);
+    renderStatus(data.status);
+    lineChart(document.getElementById("latency"), seriesLines(data.latency), from, to);
+    lineChart(document.getElementById("loss"), seriesLines(data.loss), from, to);
+    var speed = seriesLines(data.download, "download ").concat(seriesLines(data.upload, "upload "));
+    speed.forEach(function (l, i) { l.color = palette[i % palette.length]; });
+    var refs = [];
+    if (data.plan.download) { refs.push({ value: data.plan.download, label: "plan download", color: "#555" }); }
+    if (data.plan.upload) { refs.push({ value: data.plan.upload, label: "plan upload", color: "#aaa" }); }
+    lineChart(document.getElementById("speed"), speed, from, to, refs);
+    renderTimeline(data.incidents, from, to);
+    renderEvents(data.events);
+  }
+
+  function refresh() {
+    var req = new XMLHttpRequest();
+    req.open("GET", "data.json");
+    req.onload = function () {
+      if (req.status === 200) { render(JSON.parse(req.responseText)); }
+    };
+    req.send();
+  }
+
+  refresh();
+  setInterval(refresh, 60000);
+})();
+</script>
+</body>
+</html>
+`
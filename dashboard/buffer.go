@@ -0,0 +1,233 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// Point is a single sample, encoded as `[unix milliseconds, value]`
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// MarshalJSON encodes the point as a compact pair
+func (p Point) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]float64{float64(p.Time.UnixNano() / int64(time.Millisecond)), p.Value})
+}
+
+// Series are the samples of a metric for a single target
+type Series struct {
+	Metric string  `json:"metric"`
+	Target string  `json:"target"`
+	Points []Point `json:"points"`
+}
+
+// Event is a reported event
+type Event struct {
+	Time    time.Time `json:"time"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Tags    []string  `json:"tags,omitempty"`
+}
+
+// Buffer is an in-process time-series buffer of the statistics reported to it.
+// Samples are kept per metric and `name:` tag for the retention period, timings in milliseconds.
+// It implements reporters.Interface so collectors can feed it directly.
+type Buffer struct {
+	name      string
+	retention time.Duration
+	maxPoints int
+	maxEvents int
+
+	mu     sync.Mutex
+	series map[string]*Series
+	events []Event
+}
+
+// NewBuffer creates a Buffer keeping at most maxPoints samples per series and maxEvents events
+func NewBuffer(name string, retention time.Duration, maxPoints int, maxEvents int) *Buffer {
+	if name == "" {
+		name = "buffer"
+	}
+	return &Buffer{
+		name:      name,
+		retention: retention,
+		maxPoints: maxPoints,
+		maxEvents: maxEvents,
+		series:    make(map[string]*Series),
+	}
+}
+
+// Name returns the name of the buffer
+func (b *Buffer) Name() string {
+	return b.name
+}
+
+// Timing buffers a timing metric in milliseconds
+func (b *Buffer) Timing(metric string, duration time.Duration, tags ...string) {
+	b.add(metric, float64(duration)/float64(time.Millisecond), tags, time.Now())
+}
+
+// Count buffers a count metric
+func (b *Buffer) Count(metric string, val int64, tags ...string) {
+	b.add(metric, float64(val), tags, time.Now())
+}
+
+// Histogram buffers a histogram metric
+func (b *Buffer) Histogram(metric string, val float64, tags ...string) {
+	b.add(metric, val, tags, time.Now())
+}
+
+// Gauge buffers a gauge metric
+func (b *Buffer) Gauge(metric string, val float64, tags ...string) {
+	b.add(metric, val, tags, time.Now())
+}
+
+// Event buffers an event
+func (b *Buffer) Event(title string, message string, tags ...string) {
+	b.addEvent(title, message, tags, time.Now())
+}
+
+func (b *Buffer) addEvent(title string, message string, tags []string, ts time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// events may arrive late and out of order when they were queued
+	i := len(b.events)
+	for i > 0 && b.events[i-1].Time.After(ts) {
+		i--
+	}
+	b.events = append(b.events, Event{})
+	copy(b.events[i+1:], b.events[i:])
+	b.events[i] = Event{Time: ts, Title: title, Message: message, Tags: tags}
+	cutoff := time.Now().Add(-b.retention)
+	drop := 0
+	for drop < len(b.events) && (b.events[drop].Time.Before(cutoff) || len(b.events)-drop > b.maxEvents) {
+		drop++
+	}
+	if drop > 0 {
+		b.events = append([]Event{}, b.events[drop:]...)
+	}
+}
+
+// ReportStatistics implements statistics reporting, buffering each statistic at the time it was measured
+func (b *Buffer) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	for _, stat := range stats.Stats() {
+		ts := stat.TimestampOr(now)
+		switch stat.Type() {
+		case statistics.EventType:
+			b.addEvent(stat.Event.Title, stat.Event.Message, stat.Event.Tags, ts)
+		case statistics.MetricTypeCount, statistics.MetricTypeGauge, statistics.MetricTypeHistogram:
+			b.add(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags, ts)
+		case statistics.MetricTypeTiming:
+			b.add(stat.Metric.MetricName, float64(stat.Metric.Value.Duration())/float64(time.Millisecond), stat.Metric.Tags, ts)
+		default:
+			// ignore
+		}
+	}
+}
+
+// Flush is a no-op
+func (b *Buffer) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (b *Buffer) Close() error {
+	return nil
+}
+
+// Series returns a copy of every series of the metric within the retention period, sorted by target
+func (b *Buffer) Series(metric string) []Series {
+	cutoff := time.Now().Add(-b.retention)
+	b.mu.Lock()
+	out := make([]Series, 0)
+	for _, s := range b.series {
+		if s.Metric != metric {
+			continue
+		}
+		points := make([]Point, 0, len(s.Points))
+		for _, p := range s.Points {
+			if !p.Time.Before(cutoff) {
+				points = append(points, p)
+			}
+		}
+		out = append(out, Series{Metric: s.Metric, Target: s.Target, Points: points})
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+// Events returns a copy of the events within the retention period, oldest first
+func (b *Buffer) Events() []Event {
+	cutoff := time.Now().Add(-b.retention)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Event, 0, len(b.events))
+	for _, e := range b.events {
+		if !e.Time.Before(cutoff) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (b *Buffer) add(metric string, val float64, tags []string, ts time.Time) {
+	target := ""
+	for _, tag := range tags {
+		if k, v := statistics.SplitTag(tag); k == "name" {
+			target = v
+			break
+		}
+	}
+	key := metric + "\x00" + target
+	cutoff := time.Now().Add(-b.retention)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(cutoff)
+	if ts.Before(cutoff) {
+		return
+	}
+	s, ok := b.series[key]
+	if !ok {
+		s = &Series{Metric: metric, Target: target}
+		b.series[key] = s
+	}
+	// samples may arrive late and out of order when they were queued
+	i := len(s.Points)
+	for i > 0 && s.Points[i-1].Time.After(ts) {
+		i--
+	}
+	s.Points = append(s.Points, Point{})
+	copy(s.Points[i+1:], s.Points[i:])
+	s.Points[i] = Point{Time: ts, Value: val}
+	if drop := len(s.Points) - b.maxPoints; drop > 0 {
+		s.Points = append([]Point{}, s.Points[drop:]...)
+	}
+}
+
+// prune drops the samples older than cutoff and the series left without samples, such as those of
+// targets that were removed. Lock must be held.
+func (b *Buffer) prune(cutoff time.Time) {
+	for key, s := range b.series {
+		drop := 0
+		for drop < len(s.Points) && s.Points[drop].Time.Before(cutoff) {
+			drop++
+		}
+		switch {
+		case drop == len(s.Points):
+			delete(b.series, key)
+		case drop > 0:
+			s.Points = append([]Point{}, s.Points[drop:]...)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package dashboard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// loss returns the packet loss of a target measured at
+func loss(name string, percent float64, at time.Time) *statistics.Statistics {
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, "isp_monitor.pinger.packet_loss",
+		statistics.NewFloatValue(percent), "name:"+name), nil))
+	stats.Stamp(at, 0)
+	return stats
+}
+
+func TestBufferOrdersLateSamples(t *testing.T) {
+	b := NewBuffer("test", time.Hour, 3, 10)
+	now := time.Now()
+	for _, minutes := range []int{-2, -4, -1, -3} {
+		b.ReportStatistics(loss("gateway", float64(-minutes), now.Add(time.Duration(minutes)*time.Minute)))
+	}
+
+	series := b.Series("isp_monitor.pinger.packet_loss")
+	if len(series) != 1 {
+		t.Fatalf("expected a series, got %d", len(series))
+	}
+	// the oldest sample is dropped past max points, whatever the order it arrived in
+	points := series[0].Points
+	if len(points) != 3 || points[0].Value != 3 || points[1].Value != 2 || points[2].Value != 1 {
+		t.Errorf("expected the 3 newest samples in time order, got %+v", points)
+	}
+}
+
+func TestBufferDropsExpiredSeries(t *testing.T) {
+	b := NewBuffer("test", time.Hour, 10, 10)
+	now := time.Now()
+	b.ReportStatistics(loss("removed", 0, now.Add(-59*time.Minute)))
+	b.ReportStatistics(loss("gateway", 0, now.Add(-2*time.Hour)))
+	if n := len(b.Series("isp_monitor.pinger.packet_loss")); n != 1 {
+		t.Fatalf("expected a sample past the retention not to be buffered, got %d series", n)
+	}
+
+	// once its samples expire, the series of a removed target goes away
+	b.mu.Lock()
+	b.series["isp_monitor.pinger.packet_loss\x00removed"].Points[0].Time = now.Add(-2 * time.Hour)
+	b.mu.Unlock()
+	b.ReportStatistics(loss("gateway", 0, now))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.series["isp_monitor.pinger.packet_loss\x00removed"]; ok || len(b.series) != 1 {
+		t.Errorf("expected only the gateway series to be kept, got %d series", len(b.series))
+	}
+}
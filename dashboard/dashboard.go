@@ -0,0 +1,184 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/outage"
+	"go.uber.org/zap"
+)
+
+// Metrics charted by the dashboard
+const (
+	pingLatencyMetric = "isp_monitor.pinger.avg_rtt"
+	tcpLatencyMetric  = "isp_monitor.tcp.avg_rtt"
+	lossMetric        = "isp_monitor.pinger.packet_loss"
+	downloadMetric    = "isp_monitor.speedtest.download_mbps"
+	uploadMetric      = "isp_monitor.speedtest.upload_mbps"
+)
+
+// Options are the options for the dashboard
+type Options struct {
+	Address   string `json:"address"`
+	Retention string `json:"retention" config:"duration"`
+	// MaxPoints bounds how many samples are kept per series.
+	MaxPoints int `json:"max_points"`
+}
+
+// OutageSource provides the state of every target and their incidents, it is implemented by outage.Tracker
+type OutageSource interface {
+	States() map[string]outage.State
+	Incidents(from time.Time, to time.Time) []outage.Incident
+}
+
+// TargetStatus is the current state of a target
+type TargetStatus struct {
+	Name  string       `json:"name"`
+	State outage.State `json:"state"`
+}
+
+// Plan is the advertised speed in Mbps
+type Plan struct {
+	Download float64 `json:"download,omitempty"`
+	Upload   float64 `json:"upload,omitempty"`
+}
+
+// Data is everything the dashboard page shows
+type Data struct {
+	Generated time.Time         `json:"generated"`
+	From      time.Time         `json:"from"`
+	Status    []TargetStatus    `json:"status"`
+	Latency   []Series          `json:"latency"`
+	Loss      []Series          `json:"loss"`
+	Download  []Series          `json:"download"`
+	Upload    []Series          `json:"upload"`
+	Plan      Plan              `json:"plan"`
+	Incidents []outage.Incident `json:"incidents"`
+	Events    []Event           `json:"events"`
+}
+
+// Dashboard serves a self-contained page showing recent connection quality.
+// It buffers the statistics it is fed and embeds the Buffer to implement reporters.Interface.
+type Dashboard struct {
+	*Buffer
+	outages OutageSource
+	plan    Plan
+	server  *http.Server
+}
+
+// NewFromConfig creates a Dashboard from the `dashboard` config and starts serving it.
+// plan is the advertised speed drawn alongside speedtest results, the speedtest collector's plan.
+func NewFromConfig(options map[string]interface{}, plan Plan, outages OutageSource) *Dashboard {
+	var opts Options
+	if err := config.DecodeOptions(options, &opts); err != nil {
+		logger.Get().Warn("invalid dashboard options", zap.Error(err))
+	}
+	if opts.Address == "" {
+		opts.Address = ":9402"
+	}
+	if opts.MaxPoints <= 0 {
+		opts.MaxPoints = 10000
+	}
+	retention := time.Hour * 24
+	if d, err := time.ParseDuration(opts.Retention); err == nil && d > 0 {
+		retention = d
+	}
+
+	d := New(retention, opts.MaxPoints, plan, outages)
+	if err := d.Serve(opts.Address); err != nil {
+		logger.Get().Warn("failed to serve dashboard", zap.String("address", opts.Address), zap.Error(err))
+		return nil
+	}
+	return d
+}
+
+// New creates a Dashboard showing the last retention of statistics, it does not serve until Serve is called.
+// Target states and incidents are left empty when outages is nil.
+func New(retention time.Duration, maxPoints int, plan Plan, outages OutageSource) *Dashboard {
+	return &Dashboard{
+		Buffer:  NewBuffer("dashboard", retention, maxPoints, 500),
+		outages: outages,
+		plan:    plan,
+	}
+}
+
+// Data returns everything the dashboard page shows
+func (d *Dashboard) Data() Data {
+	now := time.Now()
+	from := now.Add(-d.retention)
+	data := Data{
+		Generated: now,
+		From:      from,
+		Status:    make([]TargetStatus, 0),
+		Latency:   append(d.Series(pingLatencyMetric), d.Series(tcpLatencyMetric)...),
+		Loss:      d.Series(lossMetric),
+		Download:  d.Series(downloadMetric),
+		Upload:    d.Series(uploadMetric),
+		Plan:      d.plan,
+		Incidents: make([]outage.Incident, 0),
+		Events:    d.Events(),
+	}
+	if d.outages != nil {
+		for name, state := range d.outages.States() {
+			data.Status = append(data.Status, TargetStatus{Name: name, State: state})
+		}
+		sort.Slice(data.Status, func(i, j int) bool {
+			return data.Status[i].Name < data.Status[j].Name
+		})
+		data.Incidents = d.outages.Incidents(from, now)
+	}
+	return data
+}
+
+// Handler returns the HTTP handler serving the page and its data
+func (d *Dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, indexHTML)
+	})
+	mux.HandleFunc("/data.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(d.Data()); err != nil {
+			logger.Get().Debug("failed to write dashboard data", zap.Error(err))
+		}
+	})
+	return mux
+}
+
+// Serve starts serving the dashboard on address in the background.
+func (d *Dashboard) Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	d.server = &http.Server{Handler: d.Handler()}
+	go func() {
+		if err := d.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Get().Warn("dashboard server stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Close stops serving the dashboard
+func (d *Dashboard) Close() error {
+	if d.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return d.server.Shutdown(ctx)
+}
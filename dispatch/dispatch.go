@@ -0,0 +1,491 @@
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+const metricPrefix = "isp_monitor.dispatcher."
+
+// Self-metrics reported for every queue, tagged with the reporter name
+const (
+	QueueDepthMetric = metricPrefix + "queue_depth"
+	DroppedMetric    = metricPrefix + "dropped"
+)
+
+// Overflow policies, deciding what happens when a queue is full
+const (
+	// DropNewest discards the statistics being queued.
+	DropNewest = "drop_newest"
+	// DropOldest discards the oldest queued statistics to make room.
+	DropOldest = "drop_oldest"
+	// Block waits for room in the queue, delaying the collector.
+	Block = "block"
+)
+
+// ErrFlushTimeout is returned when a reporter does not flush within the drain timeout
+var ErrFlushTimeout = errors.New("timed out waiting for reporter to flush")
+
+// ErrCloseTimeout is returned when a queue does not drain within the drain timeout, the reporter is
+// closed once the call it is in returns
+var ErrCloseTimeout = errors.New("timed out waiting for reporter queue to drain")
+
+// QueueOptions configure the queue of a reporter
+type QueueOptions struct {
+	QueueSize int    `json:"queue_size"`
+	Overflow  string `json:"overflow"`
+}
+
+// Options are the options for the dispatcher
+type Options struct {
+	QueueOptions
+	// StatsInterval is how often queue depth and drops are reported.
+	StatsInterval string `json:"stats_interval" config:"duration"`
+	// DrainTimeout bounds how long flushing and closing wait for a queue to drain.
+	DrainTimeout string `json:"drain_timeout" config:"duration"`
+	// Reporters overrides queue options per reporter name.
+	Reporters map[string]QueueOptions `json:"reporters"`
+}
+
+// DefaultQueueOptions are used for any queue option that is not configured
+var DefaultQueueOptions = QueueOptions{
+	QueueSize: 1000,
+	Overflow:  DropNewest,
+}
+
+// withDefaults fills unset options from defaults.
+func (o QueueOptions) withDefaults(defaults QueueOptions) QueueOptions {
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaults.QueueSize
+	}
+	switch o.Overflow {
+	case DropNewest, DropOldest, Block:
+	case "":
+		o.Overflow = defaults.Overflow
+	default:
+		logger.Get().Warn("unknown dispatcher overflow policy", zap.String("overflow", o.Overflow))
+		o.Overflow = defaults.Overflow
+	}
+	return o
+}
+
+// Dispatcher sits between the collectors and the reporters, giving every reporter a bounded queue
+// drained by its own worker so a slow reporter cannot delay collection.
+type Dispatcher struct {
+	defaults     QueueOptions
+	perReporter  map[string]QueueOptions
+	drainTimeout time.Duration
+
+	mu     sync.RWMutex
+	queues map[string]*Queue
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// NewFromConfig creates a Dispatcher for reps from the `dispatcher` config, which may be nil
+func NewFromConfig(options map[string]interface{}, reps map[string]reporters.Interface) *Dispatcher {
+	var opts Options
+	if err := config.DecodeOptions(options, &opts); err != nil {
+		logger.Get().Warn("invalid dispatcher options", zap.Error(err))
+	}
+	defaults := opts.QueueOptions.withDefaults(DefaultQueueOptions)
+	perReporter := make(map[string]QueueOptions, len(opts.Reporters))
+	for name, o := range opts.Reporters {
+		perReporter[name] = o.withDefaults(defaults)
+	}
+	return New(
+		reps,
+		defaults,
+		perReporter,
+		config.DurationFromString(opts.StatsInterval, time.Minute),
+		config.DurationFromString(opts.DrainTimeout, time.Second*5),
+	)
+}
+
+// New creates a Dispatcher queueing for every reporter in reps, using the perReporter options
+// when present and defaults otherwise. Queue self-metrics are reported every statsInterval.
+func New(
+	reps map[string]reporters.Interface,
+	defaults QueueOptions,
+	perReporter map[string]QueueOptions,
+	statsInterval time.Duration,
+	drainTimeout time.Duration,
+) *Dispatcher {
+	d := &Dispatcher{
+		defaults:     defaults,
+		perReporter:  perReporter,
+		drainTimeout: drainTimeout,
+		queues:       make(map[string]*Queue, len(reps)),
+		stop:         make(chan struct{}),
+	}
+	for name, r := range reps {
+		d.queues[name] = d.newQueue(name, r)
+	}
+	if statsInterval > 0 {
+		d.wg.Add(1)
+		go d.reportStats(statsInterval)
+	}
+	return d
+}
+
+func (d *Dispatcher) newQueue(name string, r reporters.Interface) *Queue {
+	opts, ok := d.perReporter[name]
+	if !ok {
+		opts = d.defaults
+	}
+	return NewQueue(r, opts.QueueSize, opts.Overflow, d.drainTimeout)
+}
+
+// Add queues r under name and returns its queue. A queue already added under name is replaced
+// and returned as well so it can be closed, it is nil otherwise.
+func (d *Dispatcher) Add(name string, r reporters.Interface) (queue *Queue, replaced *Queue) {
+	queue = d.newQueue(name, r)
+	d.mu.Lock()
+	replaced = d.queues[name]
+	d.queues[name] = queue
+	d.mu.Unlock()
+	return queue, replaced
+}
+
+// Remove stops dispatching to the queue added under name and returns it so it can be closed,
+// nil when there is none.
+func (d *Dispatcher) Remove(name string) *Queue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.queues[name]
+	if !ok {
+		return nil
+	}
+	delete(d.queues, name)
+	return q
+}
+
+// Reporters returns the queued reporters, keyed like the reporters the Dispatcher was created with
+func (d *Dispatcher) Reporters() map[string]reporters.Interface {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	reps := make(map[string]reporters.Interface, len(d.queues))
+	for name, q := range d.queues {
+		reps[name] = q
+	}
+	return reps
+}
+
+// Stats returns the current depth of every queue and the statistics dropped since the last call
+func (d *Dispatcher) Stats() *statistics.Statistics {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	names := make([]string, 0, len(d.queues))
+	for name := range d.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := statistics.NewStatistics()
+	for _, name := range names {
+		q := d.queues[name]
+		tags := []string{fmt.Sprintf("reporter:%s", name)}
+		stats.Add(statistics.NewStatistic(
+			statistics.NewMetric(statistics.MetricTypeGauge, QueueDepthMetric, statistics.NewFloatValue(float64(q.Depth())), tags...),
+			nil,
+		))
+		stats.Add(statistics.NewStatistic(
+			statistics.NewMetric(statistics.MetricTypeCount, DroppedMetric, statistics.NewIntValue(int64(q.takeDropped())), tags...),
+			nil,
+		))
+	}
+	stats.Stamp(time.Now(), 0)
+	return stats
+}
+
+func (d *Dispatcher) reportStats(interval time.Duration) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			stats := d.Stats()
+			for _, q := range d.Reporters() {
+				q.ReportStatistics(stats)
+			}
+		}
+	}
+}
+
+// Close stops reporting self-metrics, the queued reporters are closed separately through Reporters
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		close(d.stop)
+	})
+	d.wg.Wait()
+}
+
+// call is a queued call to a reporter
+type call struct {
+	fn func(reporters.Interface)
+	// statistics is how many statistics the call reports, they are counted as dropped when the call is
+	statistics int
+}
+
+// Queue is a reporters.Interface queueing every call for a single worker to pass on to the wrapped reporter
+type Queue struct {
+	// dropped is first to be 64-bit aligned for atomic access on 32-bit platforms
+	dropped uint64
+
+	reporter     reporters.Interface
+	overflow     string
+	drainTimeout time.Duration
+	ops          chan call
+
+	quit    chan struct{}
+	abandon chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	// closeErr is the error closing the reporter, set by the worker before done is closed
+	closeErr    error
+	abandonOnce sync.Once
+
+	mu sync.Mutex
+	// closed is set once nothing takes calls off the queue anymore, calls queued after are dropped
+	closed bool
+}
+
+// NewQueue creates a Queue of size calls for r and starts its worker
+func NewQueue(r reporters.Interface, size int, overflow string, drainTimeout time.Duration) *Queue {
+	q := &Queue{
+		reporter:     r,
+		overflow:     overflow,
+		drainTimeout: drainTimeout,
+		ops:          make(chan call, size),
+		quit:         make(chan struct{}),
+		abandon:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go q.work()
+	return q
+}
+
+// work passes queued calls on to the reporter until the queue is closed, then drains the queue and
+// closes the reporter so it is never closed while a call is in flight
+func (q *Queue) work() {
+	defer close(q.done)
+	defer func() {
+		q.closeErr = q.reporter.Close()
+	}()
+	defer q.close()
+	for {
+		select {
+		case c := <-q.ops:
+			c.fn(q.reporter)
+		case <-q.quit:
+			// drain what was queued before closing, unless closing gave up waiting
+			for {
+				select {
+				case <-q.abandon:
+					return
+				default:
+				}
+				select {
+				case c := <-q.ops:
+					c.fn(q.reporter)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops taking calls off the queue, dropping what is left
+func (q *Queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.sweep()
+}
+
+// sweep drops every queued call, it is called with mu held
+func (q *Queue) sweep() {
+	for {
+		select {
+		case c := <-q.ops:
+			q.drop(c)
+		default:
+			return
+		}
+	}
+}
+
+// queued is called after a call was queued. When the queue was closed in the meantime nothing takes
+// it off the queue anymore, so it is dropped.
+func (q *Queue) queued() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		q.sweep()
+	}
+}
+
+// drop counts the statistics of a dropped call
+func (q *Queue) drop(c call) {
+	atomic.AddUint64(&q.dropped, uint64(c.statistics))
+}
+
+// enqueue queues c, applying the overflow policy when the queue is full
+func (q *Queue) enqueue(c call) {
+	select {
+	case <-q.quit:
+		q.drop(c)
+		return
+	default:
+	}
+	select {
+	case q.ops <- c:
+		q.queued()
+		return
+	default:
+	}
+
+	switch q.overflow {
+	case Block:
+		select {
+		case q.ops <- c:
+			q.queued()
+		case <-q.quit:
+			q.drop(c)
+		}
+	case DropOldest:
+		select {
+		case oldest := <-q.ops:
+			q.drop(oldest)
+		default:
+		}
+		select {
+		case q.ops <- c:
+			q.queued()
+		default:
+			q.drop(c)
+		}
+	default:
+		q.drop(c)
+	}
+}
+
+// Depth returns how many calls are queued, a batch of statistics is a single call
+func (q *Queue) Depth() int {
+	return len(q.ops)
+}
+
+// takeDropped returns how many statistics were dropped since it was last called
+func (q *Queue) takeDropped() uint64 {
+	return atomic.SwapUint64(&q.dropped, 0)
+}
+
+// Timing queues a timing metric
+func (q *Queue) Timing(metric string, duration time.Duration, tags ...string) {
+	q.enqueue(call{fn: func(r reporters.Interface) { r.Timing(metric, duration, tags...) }, statistics: 1})
+}
+
+// Count queues a count metric
+func (q *Queue) Count(metric string, val int64, tags ...string) {
+	q.enqueue(call{fn: func(r reporters.Interface) { r.Count(metric, val, tags...) }, statistics: 1})
+}
+
+// Histogram queues a histogram metric
+func (q *Queue) Histogram(metric string, val float64, tags ...string) {
+	q.enqueue(call{fn: func(r reporters.Interface) { r.Histogram(metric, val, tags...) }, statistics: 1})
+}
+
+// Gauge queues a gauge metric
+func (q *Queue) Gauge(metric string, val float64, tags ...string) {
+	q.enqueue(call{fn: func(r reporters.Interface) { r.Gauge(metric, val, tags...) }, statistics: 1})
+}
+
+// Event queues an event
+func (q *Queue) Event(title string, message string, tags ...string) {
+	q.enqueue(call{fn: func(r reporters.Interface) { r.Event(title, message, tags...) }, statistics: 1})
+}
+
+// ReportStatistics queues a batch of statistics
+func (q *Queue) ReportStatistics(stats *statistics.Statistics) {
+	q.enqueue(call{fn: func(r reporters.Interface) { r.ReportStatistics(stats) }, statistics: len(stats.Stats())})
+}
+
+// Flush waits for the statistics queued so far to be reported, then flushes the reporter
+func (q *Queue) Flush() error {
+	result := make(chan error, 1)
+	c := call{fn: func(r reporters.Interface) {
+		result <- r.Flush()
+	}}
+	select {
+	case <-q.quit:
+		// the worker drains the queue and closes the reporter, flushing it
+		return nil
+	default:
+	}
+	timeout := time.NewTimer(q.drainTimeout)
+	defer timeout.Stop()
+	select {
+	case q.ops <- c:
+		q.queued()
+	case <-q.quit:
+		return nil
+	case <-timeout.C:
+		return ErrFlushTimeout
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-q.done:
+		// the flush was dropped or run before the reporter was closed
+		select {
+		case err := <-result:
+			return err
+		default:
+			return nil
+		}
+	case <-timeout.C:
+		return ErrFlushTimeout
+	}
+}
+
+// Close drains the queue and closes the reporter, waiting at most the drain timeout. When the queue
+// does not drain in time what is left is dropped and the reporter is closed once its current call returns.
+func (q *Queue) Close() error {
+	q.once.Do(func() {
+		close(q.quit)
+	})
+	timeout := time.NewTimer(q.drainTimeout)
+	defer timeout.Stop()
+	select {
+	case <-q.done:
+		return q.closeErr
+	case <-timeout.C:
+	}
+	logger.Get().Warn("reporter queue did not drain before closing, dropping what is left",
+		zap.String("name", q.reporter.Name()), zap.Int("queued", q.Depth()))
+	q.abandonOnce.Do(func() {
+		close(q.abandon)
+	})
+	q.close()
+	return ErrCloseTimeout
+}
+
+// Name returns the name of the queued reporter
+func (q *Queue) Name() string {
+	return q.reporter.Name()
+}
@@ -0,0 +1,201 @@
+package dispatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// reporter is a stand-in reporter recording what it is called with. While gate is set, reporting
+// statistics blocks until it is closed, signalling started first.
+type reporter struct {
+	gate    chan struct{}
+	started chan struct{}
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newReporter(gated bool) *reporter {
+	r := &reporter{started: make(chan struct{}, 100)}
+	if gated {
+		r.gate = make(chan struct{})
+	}
+	return r
+}
+
+func (r *reporter) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+// Calls returns the calls made so far, reported statistics are recorded by their metric name
+func (r *reporter) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+func (r *reporter) Timing(string, time.Duration, ...string) {}
+func (r *reporter) Count(string, int64, ...string)          {}
+func (r *reporter) Histogram(string, float64, ...string)    {}
+func (r *reporter) Gauge(string, float64, ...string)        {}
+func (r *reporter) Event(string, string, ...string)         {}
+func (r *reporter) Flush() error                            { return nil }
+func (r *reporter) Name() string                            { return "test" }
+
+func (r *reporter) ReportStatistics(stats *statistics.Statistics) {
+	r.started <- struct{}{}
+	if r.gate != nil {
+		<-r.gate
+	}
+	r.record(stats.Stats()[0].Metric.MetricName)
+}
+
+func (r *reporter) Close() error {
+	r.record("close")
+	return nil
+}
+
+// batch returns n statistics named metric
+func batch(metric string, n int) *statistics.Statistics {
+	stats := statistics.NewStatistics()
+	for i := 0; i < n; i++ {
+		stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, metric, statistics.NewFloatValue(1)), nil))
+	}
+	return stats
+}
+
+// fill queues a batch the worker is then stuck reporting and a batch filling the queue of one
+func fill(t *testing.T, q *Queue, r *reporter) {
+	q.ReportStatistics(batch("a", 2))
+	select {
+	case <-r.started:
+	case <-time.After(time.Second):
+		t.Fatal("the worker did not start reporting")
+	}
+	q.ReportStatistics(batch("b", 3))
+}
+
+func equal(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDropNewest(t *testing.T) {
+	r := newReporter(true)
+	q := NewQueue(r, 1, DropNewest, time.Second)
+	fill(t, q, r)
+	q.ReportStatistics(batch("c", 4))
+	if dropped := q.takeDropped(); dropped != 4 {
+		t.Errorf("expected the 4 statistics being queued to be dropped, got %d", dropped)
+	}
+	close(r.gate)
+	if err := q.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if calls := r.Calls(); !equal(calls, "a", "b", "close") {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	r := newReporter(true)
+	q := NewQueue(r, 1, DropOldest, time.Second)
+	fill(t, q, r)
+	q.ReportStatistics(batch("c", 4))
+	if dropped := q.takeDropped(); dropped != 3 {
+		t.Errorf("expected the 3 oldest queued statistics to be dropped, got %d", dropped)
+	}
+	close(r.gate)
+	if err := q.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if calls := r.Calls(); !equal(calls, "a", "c", "close") {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	r := newReporter(true)
+	q := NewQueue(r, 1, Block, time.Second)
+	fill(t, q, r)
+	queued := make(chan struct{})
+	go func() {
+		q.ReportStatistics(batch("c", 4))
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("expected queueing to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(r.gate)
+	<-queued
+	if err := q.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if dropped := q.takeDropped(); dropped != 0 {
+		t.Errorf("expected nothing to be dropped, got %d", dropped)
+	}
+	if calls := r.Calls(); !equal(calls, "a", "b", "c", "close") {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
+
+func TestCloseWithHungReporter(t *testing.T) {
+	r := newReporter(true)
+	q := NewQueue(r, 1, DropNewest, 50*time.Millisecond)
+	fill(t, q, r)
+	if err := q.Close(); err != ErrCloseTimeout {
+		t.Fatalf("expected close to time out, got %v", err)
+	}
+	if dropped := q.takeDropped(); dropped != 3 {
+		t.Errorf("expected the 3 queued statistics to be dropped, got %d", dropped)
+	}
+	q.ReportStatistics(batch("d", 5))
+	if dropped := q.takeDropped(); dropped != 5 {
+		t.Errorf("expected the 5 statistics queued after closing to be dropped, got %d", dropped)
+	}
+	if calls := r.Calls(); len(calls) != 0 {
+		t.Fatalf("expected the reporter not to be closed while it is reporting, got %v", calls)
+	}
+
+	// the reporter is closed once the hung call returns
+	close(r.gate)
+	select {
+	case <-q.done:
+	case <-time.After(time.Second):
+		t.Fatal("the reporter was not closed")
+	}
+	if calls := r.Calls(); !equal(calls, "a", "close") {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
+
+func TestCloseDrains(t *testing.T) {
+	r := newReporter(false)
+	q := NewQueue(r, 10, DropNewest, time.Second)
+	q.ReportStatistics(batch("a", 1))
+	q.ReportStatistics(batch("b", 1))
+	if err := q.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	q.ReportStatistics(batch("c", 2))
+	if dropped := q.takeDropped(); dropped != 2 {
+		t.Errorf("expected statistics queued after closing to be dropped, got %d", dropped)
+	}
+	if calls := r.Calls(); !equal(calls, "a", "b", "close") {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
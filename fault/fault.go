@@ -0,0 +1,288 @@
+package fault
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/outage"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+const metricPrefix = "isp_monitor.fault."
+
+// Layer is a network layer between this device and the internet
+type Layer string
+
+// Supported layers, ordered from closest to furthest away
+const (
+	LayerLAN      Layer = "lan"
+	LayerGateway  Layer = "gateway"
+	LayerISP      Layer = "isp"
+	LayerInternet Layer = "internet"
+)
+
+// Layers lists every layer from closest to furthest away
+var Layers = []Layer{LayerLAN, LayerGateway, LayerISP, LayerInternet}
+
+// index returns the 1 based position of the layer, 0 if unknown
+func (l Layer) index() int {
+	for i, layer := range Layers {
+		if layer == l {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// window is an ongoing failure attributed to a layer
+type window struct {
+	layer Layer
+	start time.Time
+}
+
+// targetState is the state of a target and when it entered it
+type targetState struct {
+	state outage.State
+	since time.Time
+}
+
+// Attributor attributes failures to the lowest layer whose targets are all down.
+// It is fed the outage.StateMetric gauges reported by an outage.Tracker and
+// implements reporters.Interface so it can be one of the tracker's reporters.
+type Attributor struct {
+	name      string
+	layers    map[string]Layer
+	reporters map[string]reporters.Interface
+
+	mu      sync.Mutex
+	states  map[string]targetState
+	current *window
+}
+
+// NewAttributorFromConfig creates an Attributor from the `topology` config, ignoring unknown layers.
+func NewAttributorFromConfig(topology map[string][]string, reps map[string]reporters.Interface) *Attributor {
+	layers := make(map[Layer][]string, len(topology))
+	for name, collectors := range topology {
+		layer := Layer(name)
+		if layer.index() == 0 {
+			logger.Get().Warn("ignoring unknown topology layer", zap.String("layer", name))
+			continue
+		}
+		layers[layer] = collectors
+	}
+	return NewAttributor(layers, reps)
+}
+
+// NewAttributor creates an Attributor from the collector names probing each layer.
+func NewAttributor(layers map[Layer][]string, reps map[string]reporters.Interface) *Attributor {
+	byCollector := make(map[string]Layer)
+	for layer, collectors := range layers {
+		for _, name := range collectors {
+			byCollector[name] = layer
+		}
+	}
+	return &Attributor{
+		name:      "fault",
+		layers:    byCollector,
+		reporters: reps,
+		states:    make(map[string]targetState),
+	}
+}
+
+// Name returns the name of the attributor
+func (a *Attributor) Name() string {
+	return a.name
+}
+
+// Timing is ignored, only target states are used
+func (a *Attributor) Timing(metric string, duration time.Duration, tags ...string) {}
+
+// Count is ignored, only target states are used
+func (a *Attributor) Count(metric string, val int64, tags ...string) {}
+
+// Histogram is ignored, only target states are used
+func (a *Attributor) Histogram(metric string, val float64, tags ...string) {}
+
+// Gauge feeds a target state
+func (a *Attributor) Gauge(metric string, val float64, tags ...string) {
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, metric, statistics.NewFloatValue(val), tags...), nil))
+	a.ReportStatistics(stats)
+}
+
+// Event is ignored, only target states are used
+func (a *Attributor) Event(title string, message string, tags ...string) {}
+
+// ReportStatistics updates target states and re-evaluates the attribution.
+// The transition events of the outage tracker date when a target entered its state.
+func (a *Attributor) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	updated := false
+	a.mu.Lock()
+	for _, stat := range stats.Stats() {
+		if stat.Event == nil {
+			continue
+		}
+		tags := tagMap(stat.Event.Tags)
+		name, state := tags["name"], outage.State(tags["state"])
+		if _, ok := a.layers[name]; !ok || state == "" || tags["previous_state"] == "" {
+			continue
+		}
+		a.states[name] = targetState{state: state, since: stat.TimestampOr(now)}
+		updated = true
+	}
+	for _, stat := range stats.Stats() {
+		if stat.Metric == nil || stat.Metric.MetricName != outage.StateMetric {
+			continue
+		}
+		name := tagMap(stat.Metric.Tags)["name"]
+		if _, ok := a.layers[name]; !ok {
+			continue
+		}
+		state := outage.StateFromSeverity(stat.Metric.Value.Float())
+		if current, ok := a.states[name]; !ok || current.state != state {
+			a.states[name] = targetState{state: state, since: stat.TimestampOr(now)}
+		}
+		updated = true
+	}
+	if !updated {
+		a.mu.Unlock()
+		return
+	}
+	out := a.evaluate(now)
+	a.mu.Unlock()
+
+	for _, r := range a.reporters {
+		r.ReportStatistics(out)
+	}
+}
+
+// Flush is a no-op
+func (a *Attributor) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (a *Attributor) Close() error {
+	return nil
+}
+
+// Current returns the layer currently at fault and since when, or an empty layer if none
+func (a *Attributor) Current() (Layer, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current == nil {
+		return "", time.Time{}
+	}
+	return a.current.layer, a.current.start
+}
+
+// failing returns the lowest layer whose known targets are all down, and when the first of them went down.
+// Lock must be held.
+func (a *Attributor) failing() (Layer, time.Time) {
+	for _, layer := range Layers {
+		known, down := 0, 0
+		var since time.Time
+		for name, l := range a.layers {
+			if l != layer {
+				continue
+			}
+			state, ok := a.states[name]
+			if !ok {
+				continue
+			}
+			known++
+			if state.state == outage.StateDown {
+				down++
+				if since.IsZero() || state.since.Before(since) {
+					since = state.since
+				}
+			}
+		}
+		if known > 0 && known == down {
+			return layer, since
+		}
+	}
+	return "", time.Time{}
+}
+
+// evaluate updates the current failure window, returning the statistics to report. Lock must be held.
+func (a *Attributor) evaluate(now time.Time) *statistics.Statistics {
+	out := statistics.NewStatistics()
+	layer, since := a.failing()
+
+	if a.current != nil && a.current.layer != layer {
+		duration := now.Sub(a.current.start)
+		out.Add(
+			statistics.NewStatistic(
+				statistics.NewMetric(
+					statistics.MetricTypeTiming,
+					metricPrefix+"duration",
+					statistics.NewDurationValue(duration),
+					fmt.Sprintf("layer:%s", a.current.layer),
+				),
+				nil,
+			),
+		)
+		out.Add(
+			statistics.NewStatistic(
+				nil,
+				statistics.NewEvent(
+					fmt.Sprintf("%s fault cleared", a.current.layer),
+					fmt.Sprintf("fault at the %s layer lasted %s (%s to %s)",
+						a.current.layer, duration.Round(time.Second),
+						a.current.start.Format(time.RFC3339), now.Format(time.RFC3339)),
+					fmt.Sprintf("layer:%s", a.current.layer),
+					fmt.Sprintf("duration:%s", duration.Round(time.Second)),
+				),
+			),
+		)
+		logger.Get().Info("fault cleared", zap.String("layer", string(a.current.layer)), zap.Duration("duration", duration))
+		a.current = nil
+	}
+	if layer != "" && a.current == nil {
+		a.current = &window{layer: layer, start: since}
+		event := statistics.NewStatistic(
+			nil,
+			statistics.NewEvent(
+				fmt.Sprintf("fault attributed to %s", layer),
+				fmt.Sprintf("every %s target is down since %s while no closer layer is entirely down", layer, since.Format(time.RFC3339)),
+				fmt.Sprintf("layer:%s", layer),
+			),
+		)
+		event.Timestamp = since
+		out.Add(event)
+		logger.Get().Info("fault attributed", zap.String("layer", string(layer)))
+	}
+
+	tags := []string{"layer:none"}
+	if layer != "" {
+		tags = []string{fmt.Sprintf("layer:%s", layer)}
+	}
+	out.Add(
+		statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeGauge,
+				metricPrefix+"layer",
+				statistics.NewFloatValue(float64(layer.index())),
+				tags...,
+			),
+			nil,
+		),
+	)
+	return out
+}
+
+// tagMap returns the values of key:value tags by key
+func tagMap(tags []string) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		k, v := statistics.SplitTag(tag)
+		m[k] = v
+	}
+	return m
+}
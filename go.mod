@@ -4,11 +4,15 @@ go 1.12
 
 require (
 	github.com/DataDog/datadog-go v2.2.0+incompatible
-	github.com/go-yaml/yaml v2.1.0+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/miekg/dns v1.1.22
+	github.com/prometheus/client_golang v1.1.0
 	github.com/sparrc/go-ping v0.0.0-20190613174326-4e5b6552494c
 	github.com/surol/speedtest-cli v0.0.0-20190115161937-3c3e16a0b82e
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0
-	golang.org/x/net v0.0.0-20190827160401-ba9fcec4b297 // indirect
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,239 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the current on-disk schema version.
+const SchemaVersion = 1
+
+var (
+	metaBucket    = []byte("meta")
+	recordsBucket = []byte("records")
+	versionKey    = []byte("schema_version")
+)
+
+// migrations upgrade the database from the keyed version to the next one.
+var migrations = map[int]func(tx *bolt.Tx) error{}
+
+// Record is a single stored statistic.
+type Record struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Window is how long the measurement took in milliseconds, ending at Timestamp.
+	Window    float64         `json:"window_ms,omitempty"`
+	Collector string          `json:"collector,omitempty"`
+	Type      statistics.Type `json:"type"`
+	Name      string          `json:"name"`
+	Value     float64         `json:"value"`
+	Message   string          `json:"message,omitempty"`
+	Tags      []string        `json:"tags,omitempty"`
+}
+
+// FromStatistic converts a statistic into a Record, timestamped at ts when the statistic has no timestamp.
+// Timings are stored in milliseconds and the collector is taken from the `name:` tag.
+func FromStatistic(stat *statistics.Statistic, ts time.Time) Record {
+	r := Record{
+		Timestamp: stat.TimestampOr(ts),
+		Window:    float64(stat.Window) / float64(time.Millisecond),
+		Type:      stat.Type(),
+	}
+	switch r.Type {
+	case statistics.EventType:
+		r.Name = stat.Event.Title
+		r.Message = stat.Event.Message
+		r.Tags = stat.Event.Tags
+	case statistics.MetricTypeTiming:
+		r.Name = stat.Metric.MetricName
+		r.Value = float64(stat.Metric.Value.Duration()) / float64(time.Millisecond)
+		r.Tags = stat.Metric.Tags
+	default:
+		if stat.Metric != nil {
+			r.Name = stat.Metric.MetricName
+			r.Value = stat.Metric.Value.Float()
+			r.Tags = stat.Metric.Tags
+		}
+	}
+	for _, tag := range r.Tags {
+		if key, value := statistics.SplitTag(tag); key == "name" {
+			r.Collector = value
+			break
+		}
+	}
+	return r
+}
+
+// Tag returns the value of the `key:value` tag with the given key.
+func (r Record) Tag(key string) string {
+	for _, tag := range r.Tags {
+		if k, v := statistics.SplitTag(tag); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// DB is a time ordered store of Records backed by an embedded bolt database.
+type DB struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path, migrating it to the current schema.
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(migrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// OpenReadOnly opens an existing database for reading.
+// Writers are blocked while it is open, so it should be closed promptly.
+func OpenReadOnly(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version != SchemaVersion {
+			return fmt.Errorf("history schema version %d is not supported, expected %d", version, SchemaVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0, nil
+	}
+	v := meta.Get(versionKey)
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+func migrate(tx *bolt.Tx) error {
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("history schema version %d is newer than supported version %d", version, SchemaVersion)
+	}
+	if version == 0 {
+		// fresh database
+		if _, err := tx.CreateBucketIfNotExists(recordsBucket); err != nil {
+			return err
+		}
+		version = SchemaVersion
+	}
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("failed to migrate history schema from version %d: %v", version, err)
+		}
+	}
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	return meta.Put(versionKey, []byte(strconv.Itoa(version)))
+}
+
+// Append stores the records.
+func (d *DB) Append(records ...Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		for _, r := range records {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key(r.Timestamp, seq), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Query calls fn in timestamp order for every record in [from, to).
+func (d *DB) Query(from time.Time, to time.Time, fn func(Record) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(recordsBucket).Cursor()
+		end := key(to, 0)
+		for k, v := c.Seek(key(from, 0)); k != nil && string(k) < string(end); k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Prune deletes every record older than before, returning how many were removed.
+func (d *DB) Prune(before time.Time) (int, error) {
+	pruned := 0
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket)
+		end := key(before, 0)
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.Next() {
+			expired = append(expired, append([]byte{}, k...))
+		}
+		// deleting while iterating a bolt cursor skips keys, so delete afterwards
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(expired)
+		return nil
+	})
+	return pruned, err
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// key orders records by timestamp, the sequence keeps records at the same instant unique.
+func key(ts time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k[:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
@@ -0,0 +1,80 @@
+// Package testutil holds the stand-ins shared by the tests of the reporters
+package testutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Request is a request received by a Server and the status it was answered with
+type Request struct {
+	At     time.Time
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+	Status int
+}
+
+// Server is a stand-in HTTP endpoint recording every request. It answers with the queued statuses,
+// then with the status its answer func returns.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []Request
+	statuses []int
+}
+
+// Status returns an answer func answering every request with status
+func Status(status int) func(*http.Request) int {
+	return func(*http.Request) int {
+		return status
+	}
+}
+
+// NewServer starts a Server answering with statuses, then with answer
+func NewServer(answer func(*http.Request) int, statuses ...int) *Server {
+	s := &Server{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at := time.Now()
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		s.mu.Lock()
+		var status int
+		if len(s.statuses) > 0 {
+			status = s.statuses[0]
+			s.statuses = s.statuses[1:]
+		}
+		s.mu.Unlock()
+		if status == 0 {
+			status = answer(r)
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{
+			At:     at,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: r.Header,
+			Body:   body,
+			Status: status,
+		})
+		s.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
-	"github.com/go-yaml/yaml"
+	"github.com/platinummonkey/isp-monitor/alerting"
+	"github.com/platinummonkey/isp-monitor/api"
 	"github.com/platinummonkey/isp-monitor/collectors"
 	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/dashboard"
+	"github.com/platinummonkey/isp-monitor/dispatch"
+	"github.com/platinummonkey/isp-monitor/fault"
 	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/outage"
 	"github.com/platinummonkey/isp-monitor/reporters"
+	_ "github.com/platinummonkey/isp-monitor/reporters/datadog"
+	_ "github.com/platinummonkey/isp-monitor/reporters/file"
+	_ "github.com/platinummonkey/isp-monitor/reporters/history"
+	_ "github.com/platinummonkey/isp-monitor/reporters/influxdb"
+	_ "github.com/platinummonkey/isp-monitor/reporters/log"
+	_ "github.com/platinummonkey/isp-monitor/reporters/mqtt"
+	_ "github.com/platinummonkey/isp-monitor/reporters/prometheus"
+	_ "github.com/platinummonkey/isp-monitor/reporters/webhook"
 	"go.uber.org/zap"
 )
 
@@ -29,77 +44,167 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(runReport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
 	flag.Parse()
 
 	logger.Initialize(options.debug)
 	logger.Get().Info("starting ISP monitor...")
 
-	var err error
-	var cfg config.Config
-	contents, err := ioutil.ReadFile(options.config)
+	cfg, err := loadConfig(options.config)
 	if err != nil {
-		if !strings.Contains(err.Error(), "no such file") {
-			logger.Get().Fatal("no such configuration file exists...")
-			logger.Get().Sync()
-			os.Exit(1)
-		}
-		contents = []byte{}
-	}
-	if len(contents) > 0 {
-		err = yaml.Unmarshal(contents, &cfg)
-		if err != nil {
-			logger.Get().Fatal("invalid configuration file...", zap.Error(err))
-			logger.Get().Sync()
-			os.Exit(1)
-		}
-	}
-
-	statReporters := make(map[string]reporters.Interface, 0)
-	if len(cfg.Reporters) == 0 {
-		// assume log only
-		cfg.Reporters = append(cfg.Reporters, config.Section{
-			Name: "defaultLog",
-			Type: "log",
-		})
-	}
-	for _, c := range cfg.Reporters {
-		rep := reporters.CreateReporterFromConfig(c, options.debug)
-		if rep != nil {
-			statReporters[rep.Name()] = rep
-		}
+		logger.Get().Fatal("invalid configuration file...", zap.Error(err))
+		logger.Get().Sync()
+		os.Exit(1)
 	}
 
-	statCollectors := make(map[string]collectors.Interface, 0)
+	cfg = withDefaultReporters(cfg)
 	if len(cfg.Collectors) == 0 {
 		logger.Get().Fatal("no collectors are configured! Please configure collectors!")
 		logger.Get().Sync()
 		os.Exit(1)
 	}
 
-	for _, c := range cfg.Collectors {
-		col := collectors.CreateCollectorFromConfig(c, options.debug)
-		if col != nil {
-			statCollectors[col.Name()] = col
+	m := &monitor{
+		cfg:   cfg,
+		debug: options.debug,
+		// every reporter is given its own queue so a slow reporter does not delay the collectors
+		dispatcher: dispatch.NewFromConfig(cfg.Dispatcher, nil),
+		// the collectors and analyzers report to a group so reporters can be replaced on reload
+		group:      reporters.NewGroup("reporters", nil),
+		collectors: make(map[string]*runningCollector),
+		reporters:  make(map[string]*runningReporter),
+	}
+	for _, c := range cfg.Reporters {
+		m.startReporter(c)
+	}
+	statReporters := map[string]reporters.Interface{m.group.Name(): m.group}
+
+	// analysis components are fed by the collectors alongside the reporters and report to them in turn
+	analyzers := make(map[string]reporters.Interface, 0)
+	var tracker *outage.Tracker
+	if cfg.Outage != nil || cfg.Topology != nil || cfg.Dashboard != nil {
+		trackerReporters := statReporters
+		if cfg.Topology != nil {
+			// fault attribution is fed the target states decided by the outage tracker
+			attributor := fault.NewAttributorFromConfig(cfg.Topology, statReporters)
+			trackerReporters = make(map[string]reporters.Interface, len(statReporters)+1)
+			for name, r := range statReporters {
+				trackerReporters[name] = r
+			}
+			trackerReporters[attributor.Name()] = attributor
+		}
+		tracker = outage.NewTrackerFromConfig(cfg.Outage, trackerReporters)
+		analyzers[tracker.Name()] = tracker
+	}
+	if cfg.Dashboard != nil {
+		plan := speedTestPlan(cfg)
+		if board := dashboard.NewFromConfig(cfg.Dashboard, dashboard.Plan{Download: plan.Download, Upload: plan.Upload}, tracker); board != nil {
+			analyzers[board.Name()] = board
 		}
 	}
+	if len(cfg.Alerts) > 0 {
+		engine := alerting.NewEngineFromConfig(cfg.Alerts, statReporters)
+		analyzers[engine.Name()] = engine
+	}
+	m.collectorReporters = make(map[string]reporters.Interface, len(statReporters)+len(analyzers))
+	for name, r := range statReporters {
+		m.collectorReporters[name] = r
+	}
+	for name, a := range analyzers {
+		m.collectorReporters[name] = a
+	}
+
+	if cfg.API != nil {
+		m.apiServer = api.NewFromConfig(cfg.API, m.collectorReporters)
+	}
 
 	// start running all collectors
-	for _, c := range statCollectors {
-		c.Run(statReporters)
+	ctx, cancel := context.WithCancel(context.Background())
+	if m.apiServer != nil {
+		ctx = collectors.WithObserver(ctx, m.apiServer.Observe)
+	}
+	m.ctx = ctx
+	for _, c := range cfg.Collectors {
+		m.startCollector(c)
 	}
 
 	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
-
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// wait for exit
-	go func() {
-		<-sigs
-		logger.Get().Info("exiting...")
-		logger.Get().Sync()
-		done <- true
-	}()
-	<-done
+	// wait for exit, reloading the config on SIGHUP
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		m.reload(options.config)
+	}
+	logger.Get().Info("exiting, waiting for collectors to stop...")
+	if m.apiServer != nil {
+		if err := m.apiServer.Close(); err != nil {
+			logger.Get().Warn("failed to stop api server", zap.Error(err))
+		}
+	}
+	cancel()
+	m.stopCollectors()
+	// analyzers may still report to the reporters while closing
+	closeReporters(analyzers)
+	m.dispatcher.Close()
+	closeReporters(m.dispatcher.Reporters())
+	logger.Get().Info("exiting...")
+	logger.Get().Sync()
 	os.Exit(0)
 }
+
+// loadConfig reads and validates the config file at path like the validate subcommand, a missing
+// file is an empty config. It is used on startup and on reload so both accept the same configs.
+func loadConfig(path string) (config.Config, error) {
+	var cfg config.Config
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !strings.Contains(err.Error(), "no such file") {
+			return cfg, err
+		}
+		contents = []byte{}
+	}
+	if len(contents) == 0 {
+		return cfg, nil
+	}
+	if errs := config.Validate(contents, configSchema()); len(errs) > 0 {
+		problems := make([]string, 0, len(errs))
+		for _, e := range errs {
+			problems = append(problems, e.Error())
+		}
+		return cfg, fmt.Errorf("%d problem(s) found: %s", len(errs), strings.Join(problems, "; "))
+	}
+	return config.Parse(contents)
+}
+
+// speedTestPlan returns the plan of the first configured speedtest collector
+func speedTestPlan(cfg config.Config) collectors.SpeedTestPlan {
+	for _, section := range cfg.Collectors {
+		if section.Type != "speedtest" {
+			continue
+		}
+		var opts collectors.SpeedTestOptions
+		section.DecodeOptions(&opts)
+		return opts.Plan
+	}
+	return collectors.SpeedTestPlan{}
+}
+
+// closeReporters flushes and closes every reporter, logging any failures
+func closeReporters(reps map[string]reporters.Interface) {
+	for name, r := range reps {
+		if err := r.Flush(); err != nil {
+			logger.Get().Warn("failed to flush reporter", zap.String("name", name), zap.Error(err))
+		}
+		if err := r.Close(); err != nil {
+			logger.Get().Warn("failed to close reporter", zap.String("name", name), zap.Error(err))
+		}
+	}
+}
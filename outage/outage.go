@@ -0,0 +1,533 @@
+package outage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+const metricPrefix = "isp_monitor.outage."
+
+// StateMetric is the gauge reported for every target sample, its value is the state severity.
+const StateMetric = metricPrefix + "state"
+
+// State is the health of a target
+type State string
+
+// Supported target states, from best to worst
+const (
+	StateUp       State = "up"
+	StateDegraded State = "degraded"
+	StateDown     State = "down"
+)
+
+func (s State) severity() int {
+	switch s {
+	case StateDegraded:
+		return 1
+	case StateDown:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// StateFromSeverity returns the State reported by a StateMetric value
+func StateFromSeverity(v float64) State {
+	switch {
+	case v >= 2:
+		return StateDown
+	case v >= 1:
+		return StateDegraded
+	default:
+		return StateUp
+	}
+}
+
+// Thresholds decide the state of a target from its samples
+type Thresholds struct {
+	// DegradedLoss and DownLoss are packet loss percentages.
+	DegradedLoss float64 `json:"degraded_loss"`
+	DownLoss     float64 `json:"down_loss"`
+	// DegradedRTT marks a target degraded when its average RTT exceeds it, disabled when empty.
+	DegradedRTT string `json:"degraded_rtt" config:"duration"`
+	// DegradedAfter, DownAfter and UpAfter are how many consecutive samples are needed to enter a state.
+	DegradedAfter int `json:"degraded_after"`
+	DownAfter     int `json:"down_after"`
+	UpAfter       int `json:"up_after"`
+
+	degradedRTT time.Duration
+}
+
+// Options are the options for the outage tracker
+type Options struct {
+	Thresholds
+	// Targets overrides thresholds per collector name.
+	Targets map[string]Thresholds `json:"targets"`
+	// IncidentLog is a JSON Lines file finished incidents are appended to and loaded from.
+	IncidentLog string `json:"incident_log"`
+	// MaxIncidents bounds how many incidents are kept in memory.
+	MaxIncidents int `json:"max_incidents"`
+}
+
+// DefaultThresholds are used for any threshold that is not configured
+var DefaultThresholds = Thresholds{
+	DegradedLoss:  5,
+	DownLoss:      100,
+	DegradedAfter: 2,
+	DownAfter:     3,
+	UpAfter:       2,
+}
+
+// withDefaults fills unset thresholds from defaults.
+func (t Thresholds) withDefaults(defaults Thresholds) Thresholds {
+	if t.DegradedLoss <= 0 {
+		t.DegradedLoss = defaults.DegradedLoss
+	}
+	if t.DownLoss <= 0 {
+		t.DownLoss = defaults.DownLoss
+	}
+	if t.DegradedRTT == "" {
+		t.DegradedRTT = defaults.DegradedRTT
+	}
+	if t.DegradedAfter <= 0 {
+		t.DegradedAfter = defaults.DegradedAfter
+	}
+	if t.DownAfter <= 0 {
+		t.DownAfter = defaults.DownAfter
+	}
+	if t.UpAfter <= 0 {
+		t.UpAfter = defaults.UpAfter
+	}
+	t.degradedRTT = 0
+	if d, err := time.ParseDuration(t.DegradedRTT); err == nil && d > 0 {
+		t.degradedRTT = d
+	}
+	return t
+}
+
+func (t Thresholds) after(s State) int {
+	switch s {
+	case StateDegraded:
+		return t.DegradedAfter
+	case StateDown:
+		return t.DownAfter
+	default:
+		return t.UpAfter
+	}
+}
+
+// Incident is a period during which a target was not up
+type Incident struct {
+	Target string `json:"target"`
+	// State is the worst state seen during the incident.
+	State State      `json:"state"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// Duration returns how long the incident lasted, or has lasted so far if ongoing
+func (i Incident) Duration() time.Duration {
+	if i.End == nil {
+		return time.Since(i.Start)
+	}
+	return i.End.Sub(i.Start)
+}
+
+// target tracks the state machine of a single collector
+type target struct {
+	state        State
+	since        time.Time
+	pending      State
+	pendingSince time.Time
+	pendingCount int
+	incident     *Incident
+}
+
+// Tracker decides up/degraded/down per target from the statistics collectors report and
+// emits an Event to its reporters on every transition.
+// It implements reporters.Interface so it can be fed like any other reporter.
+type Tracker struct {
+	name         string
+	thresholds   Thresholds
+	overrides    map[string]Thresholds
+	incidentLog  string
+	maxIncidents int
+	reporters    map[string]reporters.Interface
+
+	mu        sync.Mutex
+	targets   map[string]*target
+	incidents []Incident
+}
+
+// NewTrackerFromConfig creates a Tracker from the `outage` config, reporting transitions to reps.
+func NewTrackerFromConfig(options map[string]interface{}, reps map[string]reporters.Interface) *Tracker {
+	var opts Options
+	config.DecodeOptions(options, &opts)
+	return NewTracker(opts, reps)
+}
+
+// NewTracker creates a Tracker, loading previous incidents from the incident log if configured.
+func NewTracker(opts Options, reps map[string]reporters.Interface) *Tracker {
+	if opts.MaxIncidents <= 0 {
+		opts.MaxIncidents = 1000
+	}
+	thresholds := opts.Thresholds.withDefaults(DefaultThresholds)
+	overrides := make(map[string]Thresholds, len(opts.Targets))
+	for name, t := range opts.Targets {
+		overrides[name] = t.withDefaults(thresholds)
+	}
+	t := &Tracker{
+		name:         "outage",
+		thresholds:   thresholds,
+		overrides:    overrides,
+		incidentLog:  opts.IncidentLog,
+		maxIncidents: opts.MaxIncidents,
+		reporters:    reps,
+		targets:      make(map[string]*target),
+	}
+	if t.incidentLog != "" {
+		if err := t.loadIncidents(); err != nil {
+			logger.Get().Warn("failed to load incident log", zap.String("path", t.incidentLog), zap.Error(err))
+		}
+	}
+	return t
+}
+
+// Name returns the name of the tracker
+func (t *Tracker) Name() string {
+	return t.name
+}
+
+// Timing feeds a timing metric
+func (t *Tracker) Timing(metric string, duration time.Duration, tags ...string) {
+	t.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeTiming, metric, statistics.NewDurationValue(duration), tags...)))
+}
+
+// Count feeds a count metric
+func (t *Tracker) Count(metric string, val int64, tags ...string) {
+	t.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeCount, metric, statistics.NewIntValue(val), tags...)))
+}
+
+// Histogram feeds a histogram metric
+func (t *Tracker) Histogram(metric string, val float64, tags ...string) {
+	t.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeHistogram, metric, statistics.NewFloatValue(val), tags...)))
+}
+
+// Gauge feeds a gauge metric
+func (t *Tracker) Gauge(metric string, val float64, tags ...string) {
+	t.ReportStatistics(single(statistics.NewMetric(statistics.MetricTypeGauge, metric, statistics.NewFloatValue(val), tags...)))
+}
+
+// Event is ignored, events do not affect target state
+func (t *Tracker) Event(title string, message string, tags ...string) {}
+
+// ReportStatistics treats every batch of statistics from a collector as one sample per target,
+// taken at the time its statistics were measured.
+func (t *Tracker) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	samples := make(map[string]State)
+	sampledAt := make(map[string]time.Time)
+	for _, stat := range stats.Stats() {
+		if stat.Metric == nil {
+			continue
+		}
+		name := tag(stat.Metric.Tags, "name")
+		if name == "" || strings.HasPrefix(stat.Metric.MetricName, metricPrefix) {
+			continue
+		}
+		s := t.classify(t.thresholdsFor(name), stat.Metric)
+		if current, ok := samples[name]; !ok || s.severity() > current.severity() {
+			samples[name] = s
+		}
+		if at := stat.TimestampOr(now); at.After(sampledAt[name]) {
+			sampledAt[name] = at
+		}
+	}
+
+	out := statistics.NewStatistics()
+	t.mu.Lock()
+	names := make([]string, 0, len(samples))
+	for name := range samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.sample(name, samples[name], sampledAt[name], out)
+	}
+	t.mu.Unlock()
+
+	if len(out.Stats()) > 0 {
+		out.Stamp(now, 0)
+		for _, r := range t.reporters {
+			r.ReportStatistics(out)
+		}
+	}
+}
+
+// Flush is a no-op, finished incidents are written as they end
+func (t *Tracker) Flush() error {
+	return nil
+}
+
+// Close is a no-op, ongoing incidents are not finished by shutting down
+func (t *Tracker) Close() error {
+	return nil
+}
+
+// States returns the current state of every target seen so far
+func (t *Tracker) States() map[string]State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make(map[string]State, len(t.targets))
+	for name, tgt := range t.targets {
+		states[name] = tgt.state
+	}
+	return states
+}
+
+// Incidents returns the incidents overlapping [from, to), including ongoing ones, oldest first
+func (t *Tracker) Incidents(from time.Time, to time.Time) []Incident {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	incidents := make([]Incident, 0)
+	overlaps := func(i Incident) bool {
+		return i.Start.Before(to) && (i.End == nil || i.End.After(from))
+	}
+	for _, i := range t.incidents {
+		if overlaps(i) {
+			incidents = append(incidents, i)
+		}
+	}
+	for _, tgt := range t.targets {
+		if tgt.incident != nil && overlaps(*tgt.incident) {
+			incidents = append(incidents, *tgt.incident)
+		}
+	}
+	sort.Slice(incidents, func(a, b int) bool {
+		return incidents[a].Start.Before(incidents[b].Start)
+	})
+	return incidents
+}
+
+func (t *Tracker) thresholdsFor(name string) Thresholds {
+	if th, ok := t.overrides[name]; ok {
+		return th
+	}
+	return t.thresholds
+}
+
+// classify decides the state a single metric indicates
+func (t *Tracker) classify(th Thresholds, m *statistics.Metric) State {
+	metric := m.MetricName[strings.LastIndex(m.MetricName, ".")+1:]
+	loss := -1.0
+	switch metric {
+	case "collect_failure":
+		return StateDown
+	case "success", "reached":
+		if m.Value.Float() == 0 {
+			return StateDown
+		}
+	case "timeouts", "errors":
+		if m.Value.Int() > 0 {
+			return StateDegraded
+		}
+	case "packet_loss":
+		loss = m.Value.Float()
+	case "avg_rtt":
+		if th.degradedRTT > 0 && m.Value.Duration() >= th.degradedRTT {
+			return StateDegraded
+		}
+	}
+	if loss >= th.DownLoss {
+		return StateDown
+	}
+	if loss >= th.DegradedLoss {
+		return StateDegraded
+	}
+	return StateUp
+}
+
+// sample advances the state machine of a target with a sample taken at now, adding any resulting
+// statistics to out. Lock must be held.
+func (t *Tracker) sample(name string, s State, now time.Time, out *statistics.Statistics) {
+	tgt, ok := t.targets[name]
+	if !ok {
+		tgt = &target{state: StateUp, since: now}
+		t.targets[name] = tgt
+	}
+
+	if s == tgt.state {
+		tgt.pendingCount = 0
+	} else {
+		current := tgt.state.severity()
+		if tgt.pendingCount == 0 || (s.severity()-current)*(tgt.pending.severity()-current) < 0 {
+			tgt.pending = s
+			tgt.pendingSince = now
+			tgt.pendingCount = 0
+		} else if abs(s.severity()-current) < abs(tgt.pending.severity()-current) {
+			// consecutive samples worse (or better) than the current state count toward the state
+			// closest to it, so a target alternating between down and degraded becomes degraded
+			tgt.pending = s
+		}
+		tgt.pendingCount++
+		if tgt.pendingCount >= t.thresholdsFor(name).after(tgt.pending) {
+			t.transition(name, tgt, tgt.pending, tgt.pendingSince, out)
+		}
+	}
+
+	gauge := statistics.NewStatistic(
+		statistics.NewMetric(
+			statistics.MetricTypeGauge,
+			StateMetric,
+			statistics.NewFloatValue(float64(tgt.state.severity())),
+			fmt.Sprintf("name:%s", name),
+		),
+		nil,
+	)
+	gauge.Timestamp = now
+	out.Add(gauge)
+}
+
+// transition moves a target into state at the time the state was first observed. Lock must be held.
+func (t *Tracker) transition(name string, tgt *target, state State, at time.Time, out *statistics.Statistics) {
+	previous := tgt.state
+	lasted := at.Sub(tgt.since)
+	tgt.state = state
+	tgt.since = at
+	tgt.pendingCount = 0
+
+	tags := []string{
+		fmt.Sprintf("name:%s", name),
+		fmt.Sprintf("state:%s", state),
+		fmt.Sprintf("previous_state:%s", previous),
+	}
+
+	var message string
+	switch {
+	case previous == StateUp:
+		tgt.incident = &Incident{Target: name, State: state, Start: at}
+		message = fmt.Sprintf("%s is %s since %s", name, state, at.Format(time.RFC3339))
+	case state == StateUp:
+		incident := *tgt.incident
+		incident.End = &at
+		tgt.incident = nil
+		t.finish(incident)
+		message = fmt.Sprintf("%s recovered after being %s for %s (%s to %s)",
+			name, incident.State, incident.Duration().Round(time.Second),
+			incident.Start.Format(time.RFC3339), at.Format(time.RFC3339))
+		tags = append(tags, fmt.Sprintf("duration:%s", incident.Duration().Round(time.Second)))
+		duration := statistics.NewStatistic(
+			statistics.NewMetric(
+				statistics.MetricTypeTiming,
+				metricPrefix+"duration",
+				statistics.NewDurationValue(incident.Duration()),
+				fmt.Sprintf("name:%s", name),
+				fmt.Sprintf("state:%s", incident.State),
+			),
+			nil,
+		)
+		duration.Timestamp = at
+		out.Add(duration)
+	default:
+		if state.severity() > tgt.incident.State.severity() {
+			tgt.incident.State = state
+		}
+		message = fmt.Sprintf("%s is %s after being %s for %s", name, state, previous, lasted.Round(time.Second))
+	}
+
+	logger.Get().Info("target state changed", zap.String("name", name), zap.String("from", string(previous)), zap.String("to", string(state)))
+	event := statistics.NewStatistic(
+		nil,
+		statistics.NewEvent(fmt.Sprintf("%s is %s", name, state), message, tags...),
+	)
+	// the transition happened when the state was first observed, not when it was decided
+	event.Timestamp = at
+	out.Add(event)
+}
+
+// finish records a finished incident and appends it to the incident log. Lock must be held.
+func (t *Tracker) finish(incident Incident) {
+	t.incidents = append(t.incidents, incident)
+	if over := len(t.incidents) - t.maxIncidents; over > 0 {
+		t.incidents = t.incidents[over:]
+	}
+	if t.incidentLog == "" {
+		return
+	}
+	if err := appendIncident(t.incidentLog, incident); err != nil {
+		logger.Get().Warn("failed to write incident log", zap.String("path", t.incidentLog), zap.Error(err))
+	}
+}
+
+func appendIncident(path string, incident Incident) error {
+	data, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (t *Tracker) loadIncidents() error {
+	f, err := os.Open(t.incidentLog)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var incident Incident
+		if err := json.Unmarshal(scanner.Bytes(), &incident); err != nil {
+			continue
+		}
+		t.incidents = append(t.incidents, incident)
+	}
+	if over := len(t.incidents) - t.maxIncidents; over > 0 {
+		t.incidents = t.incidents[over:]
+	}
+	return scanner.Err()
+}
+
+func single(metric *statistics.Metric) *statistics.Statistics {
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(metric, nil))
+	return stats
+}
+
+func tag(tags []string, key string) string {
+	for _, t := range tags {
+		if k, v := statistics.SplitTag(t); k == key {
+			return v
+		}
+	}
+	return ""
+}
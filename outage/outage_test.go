@@ -0,0 +1,248 @@
+package outage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// recorder is a stand-in reporter recording the statistics it is reported
+type recorder struct {
+	mu    sync.Mutex
+	stats []*statistics.Statistic
+}
+
+func (r *recorder) Timing(string, time.Duration, ...string) {}
+func (r *recorder) Count(string, int64, ...string)          {}
+func (r *recorder) Histogram(string, float64, ...string)    {}
+func (r *recorder) Gauge(string, float64, ...string)        {}
+func (r *recorder) Event(string, string, ...string)         {}
+func (r *recorder) Flush() error                            { return nil }
+func (r *recorder) Close() error                            { return nil }
+func (r *recorder) Name() string                            { return "recorder" }
+
+func (r *recorder) ReportStatistics(stats *statistics.Statistics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = append(r.stats, stats.Stats()...)
+}
+
+// events returns the events reported so far and forgets them
+func (r *recorder) events() []*statistics.Statistic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]*statistics.Statistic, 0)
+	for _, stat := range r.stats {
+		if stat.Event != nil {
+			events = append(events, stat)
+		}
+	}
+	r.stats = nil
+	return events
+}
+
+func newTracker(opts Options) (*Tracker, *recorder) {
+	r := &recorder{}
+	return NewTracker(opts, map[string]reporters.Interface{"recorder": r}), r
+}
+
+// loss returns the packet loss of a target measured at
+func loss(name string, percent float64, at time.Time) *statistics.Statistics {
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeHistogram, "isp_monitor.pinger.packet_loss",
+		statistics.NewFloatValue(percent), "name:"+name), nil))
+	stats.Stamp(at, 0)
+	return stats
+}
+
+var start = time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// minute returns the time n minutes after start
+func minute(n int) time.Time {
+	return start.Add(time.Duration(n) * time.Minute)
+}
+
+// feed reports the packet losses of a target measured a minute apart, from minute from
+func feed(tr *Tracker, name string, from int, losses ...float64) {
+	for i, l := range losses {
+		tr.ReportStatistics(loss(name, l, minute(from+i)))
+	}
+}
+
+func TestDownAndRecovered(t *testing.T) {
+	tr, r := newTracker(Options{})
+
+	feed(tr, "gateway", 0, 100, 100)
+	if s := tr.States()["gateway"]; s != StateUp {
+		t.Fatalf("expected gateway to stay up before down_after samples, got %s", s)
+	}
+	feed(tr, "gateway", 2, 100)
+	if s := tr.States()["gateway"]; s != StateDown {
+		t.Fatalf("expected gateway to be down, got %s", s)
+	}
+	events := r.events()
+	if len(events) != 1 || events[0].Event.Title != "gateway is down" {
+		t.Fatalf("expected a down event, got %+v", events)
+	}
+	// the target went down when it was first seen down
+	if !events[0].Timestamp.Equal(minute(0)) {
+		t.Errorf("expected the down event at %s, got %s", minute(0), events[0].Timestamp)
+	}
+
+	feed(tr, "gateway", 3, 0, 0)
+	if s := tr.States()["gateway"]; s != StateUp {
+		t.Fatalf("expected gateway to recover, got %s", s)
+	}
+	events = r.events()
+	if len(events) != 1 || events[0].Event.Title != "gateway is up" || !events[0].Timestamp.Equal(minute(3)) {
+		t.Fatalf("expected an up event at %s, got %+v", minute(3), events)
+	}
+	incidents := tr.Incidents(minute(-60), minute(60))
+	if len(incidents) != 1 {
+		t.Fatalf("expected an incident, got %+v", incidents)
+	}
+	if i := incidents[0]; i.State != StateDown || !i.Start.Equal(minute(0)) || i.End == nil || i.Duration() != 3*time.Minute {
+		t.Errorf("expected a 3 minute down incident from %s, got %+v", minute(0), i)
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	tr, r := newTracker(Options{})
+	feed(tr, "gateway", 0, 10, 10)
+	if s := tr.States()["gateway"]; s != StateDegraded {
+		t.Fatalf("expected gateway to be degraded, got %s", s)
+	}
+	// getting worse while degraded takes down_after samples again
+	feed(tr, "gateway", 2, 100, 100, 100)
+	if s := tr.States()["gateway"]; s != StateDown {
+		t.Fatalf("expected gateway to be down, got %s", s)
+	}
+	events := r.events()
+	if len(events) != 2 || events[1].Event.Title != "gateway is down" || !events[1].Timestamp.Equal(minute(2)) {
+		t.Fatalf("expected degraded then down events, got %+v", events)
+	}
+	incidents := tr.Incidents(minute(-60), minute(60))
+	if len(incidents) != 1 || incidents[0].State != StateDown || incidents[0].End != nil {
+		t.Errorf("expected an ongoing down incident, got %+v", incidents)
+	}
+}
+
+func TestFlapping(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		losses   []float64
+		expected State
+		since    time.Time
+	}{
+		{
+			// samples alternating between down and degraded count toward degraded
+			name:     "down and degraded",
+			losses:   []float64{100, 10},
+			expected: StateDegraded,
+			since:    minute(0),
+		},
+		{
+			name:     "degraded and down",
+			losses:   []float64{10, 100, 100},
+			expected: StateDegraded,
+			since:    minute(0),
+		},
+		{
+			// a sample as good as the current state restarts the count
+			name:     "up and down",
+			losses:   []float64{100, 100, 0, 100, 100, 0},
+			expected: StateUp,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, r := newTracker(Options{})
+			feed(tr, "gateway", 0, tc.losses...)
+			if s := tr.States()["gateway"]; s != tc.expected {
+				t.Fatalf("expected gateway to be %s, got %s", tc.expected, s)
+			}
+			events := r.events()
+			if tc.expected == StateUp {
+				if len(events) != 0 {
+					t.Errorf("expected no transition, got %+v", events)
+				}
+				return
+			}
+			if len(events) != 1 || !events[0].Timestamp.Equal(tc.since) {
+				t.Errorf("expected a single transition at %s, got %+v", tc.since, events)
+			}
+		})
+	}
+}
+
+func TestTargetThresholds(t *testing.T) {
+	tr, _ := newTracker(Options{
+		Targets: map[string]Thresholds{"modem": {DownAfter: 1, DegradedRTT: "100ms"}},
+	})
+	feed(tr, "modem", 0, 100)
+	feed(tr, "gateway", 0, 100)
+	states := tr.States()
+	if states["modem"] != StateDown || states["gateway"] != StateUp {
+		t.Fatalf("expected only modem to be down after a sample, got %v", states)
+	}
+
+	// a slow round trip degrades
+	for i := 1; i <= 4; i++ {
+		stats := statistics.NewStatistics()
+		stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeTiming, "isp_monitor.pinger.avg_rtt",
+			statistics.NewDurationValue(150*time.Millisecond), "name:modem"), nil))
+		stats.Stamp(minute(i), 0)
+		tr.ReportStatistics(stats)
+	}
+	if s := tr.States()["modem"]; s != StateDegraded {
+		t.Fatalf("expected modem to be degraded by its rtt, got %s", s)
+	}
+}
+
+func TestCollectFailureIsDown(t *testing.T) {
+	tr, _ := newTracker(Options{Thresholds: Thresholds{DownAfter: 1}})
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeCount, "isp_monitor.pinger.collect_failure",
+		statistics.NewIntValue(1), "name:gateway"), nil))
+	tr.ReportStatistics(stats)
+	if s := tr.States()["gateway"]; s != StateDown {
+		t.Fatalf("expected a failed collection to be down, got %s", s)
+	}
+}
+
+func TestStateGauge(t *testing.T) {
+	tr, r := newTracker(Options{})
+	feed(tr, "gateway", 0, 0)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.stats) != 1 {
+		t.Fatalf("expected a state gauge, got %+v", r.stats)
+	}
+	gauge := r.stats[0]
+	if gauge.Metric.MetricName != StateMetric || gauge.Metric.Value.Float() != 0 || !gauge.Timestamp.Equal(minute(0)) {
+		t.Errorf("expected an up state gauge at %s, got %+v at %s", minute(0), gauge.Metric, gauge.Timestamp)
+	}
+}
+
+func TestIncidentLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "incidents.jsonl")
+
+	tr, _ := newTracker(Options{Thresholds: Thresholds{DownAfter: 1, UpAfter: 1}, IncidentLog: path})
+	feed(tr, "gateway", 0, 100, 0)
+
+	reloaded, _ := newTracker(Options{IncidentLog: path})
+	incidents := reloaded.Incidents(minute(-60), minute(60))
+	if len(incidents) != 1 || incidents[0].Target != "gateway" || !incidents[0].Start.Equal(minute(0)) || !incidents[0].End.Equal(minute(1)) {
+		t.Errorf("expected the incident to be loaded from the log, got %+v", incidents)
+	}
+}
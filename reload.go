@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/platinummonkey/isp-monitor/api"
+	"github.com/platinummonkey/isp-monitor/collectors"
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/dispatch"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"go.uber.org/zap"
+)
+
+// runningCollector is a collector started from a config section, with its own context so it can be stopped alone
+type runningCollector struct {
+	section   config.Section
+	collector collectors.Interface
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// runningReporter is a reporter started from a config section
+type runningReporter struct {
+	section config.Section
+	name    string
+}
+
+// monitor runs the configured collectors and reporters, starting and stopping them as the config is reloaded
+type monitor struct {
+	cfg   config.Config
+	debug bool
+
+	// ctx is the parent of every collector's context
+	ctx        context.Context
+	dispatcher *dispatch.Dispatcher
+	// group holds the queued reporters, the collectors and analyzers report to it
+	group *reporters.Group
+	// collectorReporters are the reporters and analyzers passed to every collector
+	collectorReporters map[string]reporters.Interface
+	apiServer          *api.Server
+
+	collectors map[string]*runningCollector
+	reporters  map[string]*runningReporter
+}
+
+// sectionKey identifies a section across reloads by its name, falling back to its type like the default names
+func sectionKey(s config.Section) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Type
+}
+
+// withDefaultReporters returns cfg with the log reporter configured when it has no reporters
+func withDefaultReporters(cfg config.Config) config.Config {
+	if len(cfg.Reporters) == 0 {
+		// assume log only
+		cfg.Reporters = []config.Section{{
+			Name: "defaultLog",
+			Type: "log",
+		}}
+	}
+	return cfg
+}
+
+// startReporter creates the reporter of a section and adds it to the group behind its own queue
+func (m *monitor) startReporter(section config.Section) {
+	rep := reporters.CreateReporterFromConfig(section, m.debug)
+	if rep == nil {
+		logger.Get().Warn("failed to create reporter", zap.String("name", section.Name), zap.String("type", section.Type))
+		return
+	}
+	name := rep.Name()
+	queue, replaced := m.dispatcher.Add(name, rep)
+	m.group.Set(name, queue)
+	if replaced != nil {
+		closeReporters(map[string]reporters.Interface{name: replaced})
+	}
+	m.reporters[sectionKey(section)] = &runningReporter{section: section, name: name}
+}
+
+// stopReporter removes the reporter of a section from the group, then flushes and closes it
+func (m *monitor) stopReporter(key string) {
+	running, ok := m.reporters[key]
+	if !ok {
+		return
+	}
+	delete(m.reporters, key)
+	m.group.Remove(running.name)
+	if queue := m.dispatcher.Remove(running.name); queue != nil {
+		closeReporters(map[string]reporters.Interface{running.name: queue})
+	}
+}
+
+// startCollector creates the collector of a section and starts running it
+func (m *monitor) startCollector(section config.Section) {
+	col := collectors.CreateCollectorFromConfig(section, m.debug)
+	if col == nil {
+		logger.Get().Warn("failed to create collector", zap.String("name", section.Name), zap.String("type", section.Type))
+		return
+	}
+	if m.apiServer != nil {
+		m.apiServer.Register(col, section.Type)
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	running := &runningCollector{
+		section:   section,
+		collector: col,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	m.collectors[sectionKey(section)] = running
+	go func() {
+		defer close(running.done)
+		col.Run(ctx, m.collectorReporters)
+	}()
+}
+
+// stopCollector stops the collector of a section, waiting for its current collection to end
+func (m *monitor) stopCollector(key string) {
+	running, ok := m.collectors[key]
+	if !ok {
+		return
+	}
+	delete(m.collectors, key)
+	running.cancel()
+	<-running.done
+	if m.apiServer != nil {
+		m.apiServer.Unregister(running.collector.Name())
+	}
+}
+
+// stopCollectors stops every collector
+func (m *monitor) stopCollectors() {
+	for key := range m.collectors {
+		m.collectors[key].cancel()
+	}
+	for key := range m.collectors {
+		m.stopCollector(key)
+	}
+}
+
+// sectionDiff is how the sections of a config changed, by section key
+type sectionDiff struct {
+	added     []string
+	removed   []string
+	changed   []string
+	unchanged int
+}
+
+func (d sectionDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0
+}
+
+// diffSections compares the running sections with the configured ones, the last section of a name wins
+func diffSections(running map[string]config.Section, configured []config.Section) (sectionDiff, map[string]config.Section) {
+	sections := make(map[string]config.Section, len(configured))
+	for _, s := range configured {
+		sections[sectionKey(s)] = s
+	}
+	diff := sectionDiff{
+		added:   make([]string, 0),
+		removed: make([]string, 0),
+		changed: make([]string, 0),
+	}
+	for key, s := range sections {
+		old, ok := running[key]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, key)
+		case !reflect.DeepEqual(old, s):
+			diff.changed = append(diff.changed, key)
+		default:
+			diff.unchanged++
+		}
+	}
+	for key := range running {
+		if _, ok := sections[key]; !ok {
+			diff.removed = append(diff.removed, key)
+		}
+	}
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.changed)
+	return diff, sections
+}
+
+// reload re-reads the config at path and starts, stops or replaces the collectors and reporters whose
+// sections changed, leaving the others running. The running config is kept when the new one is invalid.
+func (m *monitor) reload(path string) {
+	logger.Get().Info("reloading configuration", zap.String("path", path))
+	cfg, err := loadConfig(path)
+	if err != nil {
+		logger.Get().Warn("invalid configuration file, keeping the running configuration", zap.Error(err))
+		return
+	}
+	if len(cfg.Collectors) == 0 {
+		logger.Get().Warn("no collectors are configured, keeping the running configuration")
+		return
+	}
+	cfg = withDefaultReporters(cfg)
+
+	runningReporters := make(map[string]config.Section, len(m.reporters))
+	for key, r := range m.reporters {
+		runningReporters[key] = r.section
+	}
+	reporterDiff, reporterSections := diffSections(runningReporters, cfg.Reporters)
+	runningCollectors := make(map[string]config.Section, len(m.collectors))
+	for key, c := range m.collectors {
+		runningCollectors[key] = c.section
+	}
+	collectorDiff, collectorSections := diffSections(runningCollectors, cfg.Collectors)
+
+	// collectors report to the group, so reporters are replaced without touching the collectors
+	for _, key := range append(collectorDiff.removed, collectorDiff.changed...) {
+		m.stopCollector(key)
+	}
+	for _, key := range append(reporterDiff.removed, reporterDiff.changed...) {
+		m.stopReporter(key)
+	}
+	for _, key := range append(reporterDiff.changed, reporterDiff.added...) {
+		m.startReporter(reporterSections[key])
+	}
+	for _, key := range append(collectorDiff.changed, collectorDiff.added...) {
+		m.startCollector(collectorSections[key])
+	}
+
+	for _, section := range m.unreloadedSections(cfg) {
+		logger.Get().Warn("configuration section changed, restart to apply it", zap.String("section", section))
+	}
+	m.cfg.Collectors = cfg.Collectors
+	m.cfg.Reporters = cfg.Reporters
+
+	if collectorDiff.empty() && reporterDiff.empty() {
+		logger.Get().Info("configuration reloaded, no collectors or reporters changed")
+		return
+	}
+	logger.Get().Info("configuration reloaded",
+		zap.Strings("collectors_added", collectorDiff.added),
+		zap.Strings("collectors_removed", collectorDiff.removed),
+		zap.Strings("collectors_changed", collectorDiff.changed),
+		zap.Int("collectors_unchanged", collectorDiff.unchanged),
+		zap.Strings("reporters_added", reporterDiff.added),
+		zap.Strings("reporters_removed", reporterDiff.removed),
+		zap.Strings("reporters_changed", reporterDiff.changed),
+		zap.Int("reporters_unchanged", reporterDiff.unchanged),
+	)
+}
+
+// unreloadedSections returns the sections of cfg that changed but are only applied on start
+func (m *monitor) unreloadedSections(cfg config.Config) []string {
+	changed := make([]string, 0)
+	running := reflect.ValueOf(m.cfg)
+	configured := reflect.ValueOf(cfg)
+	t := running.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("yaml")
+		if name == "collectors" || name == "reporters" {
+			continue
+		}
+		if !reflect.DeepEqual(running.Field(i).Interface(), configured.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/history"
+	"github.com/platinummonkey/isp-monitor/report"
+	historyreporter "github.com/platinummonkey/isp-monitor/reporters/history"
+)
+
+// dateLayout is the layout of the -from and -to flags, RFC 3339 timestamps are accepted too
+const dateLayout = "2006-01-02"
+
+// runReport implements the `report` subcommand, returning the exit code
+func runReport(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	configPath := flags.String("config", options.config, "config file to find the history database and plan in")
+	dbPath := flags.String("db", "", "history database to read, defaults to the path of the configured history reporter")
+	fromFlag := flags.String("from", "", "first day of the report (YYYY-MM-DD), defaults to 30 days before -to")
+	toFlag := flags.String("to", "", "last day of the report (YYYY-MM-DD), defaults to now")
+	format := flags.String("format", report.FormatMarkdown, "report format, markdown or html")
+	output := flags.String("output", "", "file to write the report to, defaults to stdout")
+	planDownload := flags.Float64("plan-download", 0, "advertised download speed in Mbps, defaults to the configured plan")
+	planUpload := flags.Float64("plan-upload", 0, "advertised upload speed in Mbps, defaults to the configured plan")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration file: %v\n", err)
+		return 1
+	}
+
+	to := time.Now()
+	if *toFlag != "" {
+		if to, err = parseDate(*toFlag, true); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -to: %v\n", err)
+			return 2
+		}
+	}
+	from := to.AddDate(0, 0, -30)
+	if *fromFlag != "" {
+		if from, err = parseDate(*fromFlag, false); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -from: %v\n", err)
+			return 2
+		}
+	}
+	if !from.Before(to) {
+		fmt.Fprintln(os.Stderr, "-from must be before -to")
+		return 2
+	}
+
+	plan := report.Plan{Download: *planDownload, Upload: *planUpload}
+	configured := speedTestPlan(cfg)
+	if plan.Download == 0 {
+		plan.Download = configured.Download
+	}
+	if plan.Upload == 0 {
+		plan.Upload = configured.Upload
+	}
+
+	path := *dbPath
+	if path == "" {
+		path = historyPath(cfg)
+	}
+	db, err := history.OpenReadOnly(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open history database %s: %v\n", path, err)
+		return 1
+	}
+	defer db.Close()
+
+	r, err := report.Build(db, from, to, plan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read history: %v\n", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create report: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := r.Render(w, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseDate parses a day in local time, or an RFC 3339 timestamp. The end of the day is returned when endOfDay is set.
+func parseDate(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(dateLayout, s, time.Local)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// historyPath returns the database of the first configured history reporter
+func historyPath(cfg config.Config) string {
+	for _, section := range cfg.Reporters {
+		if section.Type != "history" {
+			continue
+		}
+		var opts historyreporter.HistoryOptions
+		section.DecodeOptions(&opts)
+		if opts.Path != "" {
+			return opts.Path
+		}
+		break
+	}
+	return historyreporter.DefaultPath
+}
@@ -0,0 +1,146 @@
+package report
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"text/template"
+	"time"
+)
+
+// Formats a report can be rendered in
+const (
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+var funcs = map[string]interface{}{
+	"num": func(v float64) string {
+		return fmt.Sprintf("%.1f", v)
+	},
+	"pct": func(v float64) string {
+		return fmt.Sprintf("%.2f%%", v)
+	},
+	"ofPlan": func(v float64, plan float64) string {
+		if plan <= 0 {
+			return "n/a"
+		}
+		return fmt.Sprintf("%.0f%%", PctOfPlan(v, plan))
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+	"time": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+}
+
+const markdownTemplate = `# Internet connection report
+
+Period: {{ time .From }} to {{ time .To }} (generated {{ time .Generated }})
+
+## Uptime
+
+| Target | Samples | Uptime | Degraded |
+| --- | ---: | ---: | ---: |
+{{ range .Targets }}| {{ .Name }} | {{ .Samples }} | {{ pct .Uptime }} | {{ pct .Degraded }} |
+{{ else }}| no data | | | |
+{{ end }}
+## Outages
+
+Outages: {{ len .Outages }}, totalling {{ duration .OutageTime }}.
+
+{{ if .Outages }}| Target | State | Start | End | Duration |
+| --- | --- | --- | --- | ---: |
+{{ range .Outages }}| {{ .Target }} | {{ .State }} | {{ time .Start }} | {{ if .Ongoing }}ongoing{{ else }}{{ time .End }}{{ end }} | {{ duration .Duration }} |
+{{ end }}{{ end }}
+## Latency and packet loss
+
+| Target | RTT p50 (ms) | RTT p95 (ms) | RTT p99 (ms) | RTT max (ms) | Loss mean | Loss p95 | Loss max |
+| --- | ---: | ---: | ---: | ---: | ---: | ---: | ---: |
+{{ range .Targets }}| {{ .Name }} | {{ num .RTT.P50 }} | {{ num .RTT.P95 }} | {{ num .RTT.P99 }} | {{ num .RTT.Max }} | {{ pct .Loss.Mean }} | {{ pct .Loss.P95 }} | {{ pct .Loss.Max }} |
+{{ end }}
+## Speed tests
+
+Tests run: {{ len .SpeedTests }}. Advertised speed: {{ if .Plan.Download }}{{ num .Plan.Download }}{{ else }}unknown{{ end }} Mbps down / {{ if .Plan.Upload }}{{ num .Plan.Upload }}{{ else }}unknown{{ end }} Mbps up.
+
+| | Mean | Median | p95 | Max | Mean of plan | Median of plan |
+| --- | ---: | ---: | ---: | ---: | ---: | ---: |
+| Download (Mbps) | {{ num .Download.Mean }} | {{ num .Download.P50 }} | {{ num .Download.P95 }} | {{ num .Download.Max }} | {{ ofPlan .Download.Mean .Plan.Download }} | {{ ofPlan .Download.P50 .Plan.Download }} |
+| Upload (Mbps) | {{ num .Upload.Mean }} | {{ num .Upload.P50 }} | {{ num .Upload.P95 }} | {{ num .Upload.Max }} | {{ ofPlan .Upload.Mean .Plan.Upload }} | {{ ofPlan .Upload.P50 .Plan.Upload }} |
+{{ if .SpeedTests }}
+| Time | Server | Download (Mbps) | Of plan | Upload (Mbps) | Of plan |
+| --- | --- | ---: | ---: | ---: | ---: |
+{{ range .SpeedTests }}| {{ time .Time }} | {{ .Server }} | {{ num .Download }} | {{ ofPlan .Download $.Plan.Download }} | {{ num .Upload }} | {{ ofPlan .Upload $.Plan.Upload }} |
+{{ end }}{{ end }}`
+
+const htmlTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Internet connection report</title>
+<style>
+  body { font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; max-width: 1000px; margin: 24px auto; color: #222; }
+  table { border-collapse: collapse; width: 100%; margin-bottom: 16px; }
+  th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; }
+  th:first-child, td:first-child { text-align: left; }
+  th { background: #f4f5f7; }
+  .down { color: #c0392b; font-weight: bold; }
+  .degraded { color: #d98c00; }
+</style>
+</head>
+<body>
+<h1>Internet connection report</h1>
+<p>Period: {{ time .From }} to {{ time .To }} (generated {{ time .Generated }})</p>
+
+<h2>Uptime</h2>
+<table>
+<tr><th>Target</th><th>Samples</th><th>Uptime</th><th>Degraded</th></tr>
+{{ range .Targets }}<tr><td>{{ .Name }}</td><td>{{ .Samples }}</td><td>{{ pct .Uptime }}</td><td>{{ pct .Degraded }}</td></tr>
+{{ else }}<tr><td colspan="4">no data</td></tr>
+{{ end }}</table>
+
+<h2>Outages</h2>
+<p>Outages: {{ len .Outages }}, totalling {{ duration .OutageTime }}.</p>
+{{ if .Outages }}<table>
+<tr><th>Target</th><th>State</th><th>Start</th><th>End</th><th>Duration</th></tr>
+{{ range .Outages }}<tr><td>{{ .Target }}</td><td class="{{ .State }}">{{ .State }}</td><td>{{ time .Start }}</td><td>{{ if .Ongoing }}ongoing{{ else }}{{ time .End }}{{ end }}</td><td>{{ duration .Duration }}</td></tr>
+{{ end }}</table>{{ end }}
+
+<h2>Latency and packet loss</h2>
+<table>
+<tr><th>Target</th><th>RTT p50 (ms)</th><th>RTT p95 (ms)</th><th>RTT p99 (ms)</th><th>RTT max (ms)</th><th>Loss mean</th><th>Loss p95</th><th>Loss max</th></tr>
+{{ range .Targets }}<tr><td>{{ .Name }}</td><td>{{ num .RTT.P50 }}</td><td>{{ num .RTT.P95 }}</td><td>{{ num .RTT.P99 }}</td><td>{{ num .RTT.Max }}</td><td>{{ pct .Loss.Mean }}</td><td>{{ pct .Loss.P95 }}</td><td>{{ pct .Loss.Max }}</td></tr>
+{{ end }}</table>
+
+<h2>Speed tests</h2>
+<p>Tests run: {{ len .SpeedTests }}. Advertised speed: {{ if .Plan.Download }}{{ num .Plan.Download }}{{ else }}unknown{{ end }} Mbps down / {{ if .Plan.Upload }}{{ num .Plan.Upload }}{{ else }}unknown{{ end }} Mbps up.</p>
+<table>
+<tr><th></th><th>Mean</th><th>Median</th><th>p95</th><th>Max</th><th>Mean of plan</th><th>Median of plan</th></tr>
+<tr><td>Download (Mbps)</td><td>{{ num .Download.Mean }}</td><td>{{ num .Download.P50 }}</td><td>{{ num .Download.P95 }}</td><td>{{ num .Download.Max }}</td><td>{{ ofPlan .Download.Mean .Plan.Download }}</td><td>{{ ofPlan .Download.P50 .Plan.Download }}</td></tr>
+<tr><td>Upload (Mbps)</td><td>{{ num .Upload.Mean }}</td><td>{{ num .Upload.P50 }}</td><td>{{ num .Upload.P95 }}</td><td>{{ num .Upload.Max }}</td><td>{{ ofPlan .Upload.Mean .Plan.Upload }}</td><td>{{ ofPlan .Upload.P50 .Plan.Upload }}</td></tr>
+</table>
+{{ if .SpeedTests }}<table>
+<tr><th>Time</th><th>Server</th><th>Download (Mbps)</th><th>Of plan</th><th>Upload (Mbps)</th><th>Of plan</th></tr>
+{{ range .SpeedTests }}<tr><td>{{ time .Time }}</td><td>{{ .Server }}</td><td>{{ num .Download }}</td><td>{{ ofPlan .Download $.Plan.Download }}</td><td>{{ num .Upload }}</td><td>{{ ofPlan .Upload $.Plan.Upload }}</td></tr>
+{{ end }}</table>{{ end }}
+</body>
+</html>
+`
+
+var (
+	markdown = template.Must(template.New("markdown").Funcs(funcs).Parse(markdownTemplate))
+	html     = htmltemplate.Must(htmltemplate.New("html").Funcs(funcs).Parse(htmlTemplate))
+)
+
+// Render writes the report to w in the given format
+func (r *Report) Render(w io.Writer, format string) error {
+	switch format {
+	case FormatMarkdown:
+		return markdown.Execute(w, r)
+	case FormatHTML:
+		return html.Execute(w, r)
+	default:
+		return fmt.Errorf("unknown report format %q, expected %s or %s", format, FormatMarkdown, FormatHTML)
+	}
+}
@@ -0,0 +1,298 @@
+package report
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/history"
+	"github.com/platinummonkey/isp-monitor/outage"
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// Metrics the report is built from
+const (
+	pingRTTMetric     = "isp_monitor.pinger.avg_rtt"
+	tcpRTTMetric      = "isp_monitor.tcp.avg_rtt"
+	pingLossMetric    = "isp_monitor.pinger.packet_loss"
+	tcpLossMetric     = "isp_monitor.tcp.packet_loss"
+	downloadMetric    = "isp_monitor.speedtest.download_mbps"
+	uploadMetric      = "isp_monitor.speedtest.upload_mbps"
+	collectFailSuffix = ".collect_failure"
+)
+
+// Plan is the advertised speed in Mbps
+type Plan struct {
+	Download float64
+	Upload   float64
+}
+
+// Percentiles summarizes a set of samples
+type Percentiles struct {
+	Count int
+	Mean  float64
+	P50   float64
+	P95   float64
+	P99   float64
+	Max   float64
+}
+
+// Target summarizes the quality of a single collector's target
+type Target struct {
+	Name string
+	// Samples is how many samples the uptime is computed from.
+	Samples int
+	// Uptime and Degraded are the percentages of samples the target was not down, and degraded.
+	Uptime   float64
+	Degraded float64
+	// RTT is in milliseconds and Loss in percent.
+	RTT  Percentiles
+	Loss Percentiles
+}
+
+// Outage is a period during which a target was degraded or down
+type Outage struct {
+	Target string
+	// State is the worst state seen during the outage.
+	State outage.State
+	Start time.Time
+	End   time.Time
+	// Ongoing is set when the target had not recovered by the end of the report.
+	Ongoing bool
+}
+
+// Duration returns how long the outage lasted within the report
+func (o Outage) Duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
+
+// SpeedTest is a single speed test result in Mbps
+type SpeedTest struct {
+	Time     time.Time
+	Server   string
+	Download float64
+	Upload   float64
+}
+
+// Report is the evidence gathered for a period
+type Report struct {
+	From       time.Time
+	To         time.Time
+	Generated  time.Time
+	Plan       Plan
+	Targets    []Target
+	Outages    []Outage
+	SpeedTests []SpeedTest
+	Download   Percentiles
+	Upload     Percentiles
+}
+
+// OutageTime returns the total time targets spent in outages
+func (r *Report) OutageTime() time.Duration {
+	var total time.Duration
+	for _, o := range r.Outages {
+		total += o.Duration()
+	}
+	return total
+}
+
+// PctOfPlan returns v as a percentage of the advertised speed, 0 when unknown
+func PctOfPlan(v float64, plan float64) float64 {
+	if plan <= 0 {
+		return 0
+	}
+	return v / plan * 100
+}
+
+// sample is the state of a target at a point in time
+type sample struct {
+	at    time.Time
+	state outage.State
+}
+
+// targetData is everything read for a single target
+type targetData struct {
+	// states are from the outage tracker, fallback are derived from loss and failures when it was not enabled.
+	states   []sample
+	fallback []sample
+	rtt      []float64
+	loss     []float64
+}
+
+// Build reads the history in [from, to) and computes the report.
+// Target states come from the outage tracker when it was enabled, otherwise from packet loss and collect failures.
+func Build(db *history.DB, from time.Time, to time.Time, plan Plan) (*Report, error) {
+	targets := make(map[string]*targetData)
+	get := func(name string) *targetData {
+		t, ok := targets[name]
+		if !ok {
+			t = &targetData{}
+			targets[name] = t
+		}
+		return t
+	}
+	speedTests := make(map[string]*SpeedTest)
+
+	err := db.Query(from, to, func(r history.Record) error {
+		if r.Type == statistics.EventType {
+			return nil
+		}
+		switch {
+		case r.Name == outage.StateMetric:
+			target := r.Tag("name")
+			if target != "" {
+				get(target).states = append(get(target).states, sample{at: r.Timestamp, state: outage.StateFromSeverity(r.Value)})
+			}
+		case r.Name == downloadMetric || r.Name == uploadMetric:
+			// both speeds of a test are recorded within the same second
+			key := r.Collector + "\x00" + r.Timestamp.Truncate(time.Second).String()
+			st, ok := speedTests[key]
+			if !ok {
+				st = &SpeedTest{Time: r.Timestamp, Server: r.Tag("server_sponsor")}
+				speedTests[key] = st
+			}
+			if r.Name == downloadMetric {
+				st.Download = r.Value
+			} else {
+				st.Upload = r.Value
+			}
+		case r.Collector == "":
+			// not attributable to a target
+		case r.Name == pingRTTMetric || r.Name == tcpRTTMetric:
+			get(r.Collector).rtt = append(get(r.Collector).rtt, r.Value)
+		case r.Name == pingLossMetric || r.Name == tcpLossMetric:
+			loss := r.Value
+			t := get(r.Collector)
+			t.loss = append(t.loss, loss)
+			state := outage.StateUp
+			if loss >= 100 {
+				state = outage.StateDown
+			}
+			t.fallback = append(t.fallback, sample{at: r.Timestamp, state: state})
+		case strings.HasSuffix(r.Name, collectFailSuffix):
+			t := get(r.Collector)
+			t.fallback = append(t.fallback, sample{at: r.Timestamp, state: outage.StateDown})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		From:      from,
+		To:        to,
+		Generated: time.Now(),
+		Plan:      plan,
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data := targets[name]
+		samples := data.states
+		if len(samples) == 0 {
+			samples = data.fallback
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i].at.Before(samples[j].at)
+		})
+		target := Target{
+			Name:    name,
+			Samples: len(samples),
+			RTT:     percentiles(data.rtt),
+			Loss:    percentiles(data.loss),
+		}
+		if len(samples) > 0 {
+			down, degraded := 0, 0
+			for _, s := range samples {
+				switch s.state {
+				case outage.StateDown:
+					down++
+				case outage.StateDegraded:
+					degraded++
+				}
+			}
+			target.Uptime = float64(len(samples)-down) / float64(len(samples)) * 100
+			target.Degraded = float64(degraded) / float64(len(samples)) * 100
+		}
+		report.Targets = append(report.Targets, target)
+		report.Outages = append(report.Outages, outages(name, samples)...)
+	}
+	sort.Slice(report.Outages, func(i, j int) bool {
+		return report.Outages[i].Start.Before(report.Outages[j].Start)
+	})
+
+	downloads := make([]float64, 0, len(speedTests))
+	uploads := make([]float64, 0, len(speedTests))
+	for _, st := range speedTests {
+		report.SpeedTests = append(report.SpeedTests, *st)
+		downloads = append(downloads, st.Download)
+		uploads = append(uploads, st.Upload)
+	}
+	sort.Slice(report.SpeedTests, func(i, j int) bool {
+		return report.SpeedTests[i].Time.Before(report.SpeedTests[j].Time)
+	})
+	report.Download = percentiles(downloads)
+	report.Upload = percentiles(uploads)
+	return report, nil
+}
+
+// outages turns time ordered samples into the periods the target was not up.
+// An outage ends at the first sample the target is up again.
+func outages(target string, samples []sample) []Outage {
+	out := make([]Outage, 0)
+	var current *Outage
+	for _, s := range samples {
+		if s.state == outage.StateUp {
+			if current != nil {
+				current.End = s.at
+				out = append(out, *current)
+				current = nil
+			}
+			continue
+		}
+		if current == nil {
+			current = &Outage{Target: target, State: s.state, Start: s.at}
+		} else if s.state == outage.StateDown {
+			current.State = outage.StateDown
+		}
+		current.End = s.at
+	}
+	if current != nil {
+		current.Ongoing = true
+		out = append(out, *current)
+	}
+	return out
+}
+
+// percentiles computes nearest-rank percentiles of values
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return Percentiles{
+		Count: len(sorted),
+		Mean:  sum / float64(len(sorted)),
+		P50:   rank(50),
+		P95:   rank(95),
+		P99:   rank(99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
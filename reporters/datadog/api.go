@@ -0,0 +1,183 @@
+package datadog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// DefaultAPIURL is the Datadog API spooled statistics are submitted to
+const DefaultAPIURL = "https://api.datadoghq.com"
+
+// maxSeriesPerRequest bounds how many metrics are submitted in a single request
+const maxSeriesPerRequest = 500
+
+// histogramAggregates are the gauges the agent derives from histograms and timings, a single sample
+// yields the same value for all of them
+var histogramAggregates = []string{"avg", "median", "max", "95percentile"}
+
+// point is a spooled statistic with the time it was measured at
+type point struct {
+	Type      statistics.Type `json:"type"`
+	Metric    string          `json:"metric,omitempty"`
+	Value     float64         `json:"value,omitempty"`
+	Title     string          `json:"title,omitempty"`
+	Message   string          `json:"message,omitempty"`
+	Tags      []string        `json:"tags,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// pointOf returns the point of a statistic measured at ts, timings are in milliseconds like dogstatsd's
+func pointOf(stat *statistics.Statistic, ts time.Time) (point, bool) {
+	p := point{Type: stat.Type(), Timestamp: ts}
+	switch p.Type {
+	case statistics.EventType:
+		p.Title, p.Message, p.Tags = stat.Event.Title, stat.Event.Message, stat.Event.Tags
+	case statistics.MetricTypeCount:
+		p.Metric, p.Value, p.Tags = stat.Metric.MetricName, float64(stat.Metric.Value.Int()), stat.Metric.Tags
+	case statistics.MetricTypeGauge, statistics.MetricTypeHistogram:
+		p.Metric, p.Value, p.Tags = stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags
+	case statistics.MetricTypeTiming:
+		p.Metric, p.Tags = stat.Metric.MetricName, stat.Metric.Tags
+		p.Value = float64(stat.Metric.Value.Duration()) / float64(time.Millisecond)
+	default:
+		return p, false
+	}
+	return p, true
+}
+
+// series is a metric submitted to the API
+type series struct {
+	Metric string       `json:"metric"`
+	Points [][2]float64 `json:"points"`
+	Type   string       `json:"type"`
+	Tags   []string     `json:"tags,omitempty"`
+}
+
+// event is an event submitted to the API
+type event struct {
+	Title        string   `json:"title"`
+	Text         string   `json:"text"`
+	DateHappened int64    `json:"date_happened"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// API submits metrics and events to the Datadog HTTP API which, unlike dogstatsd, keeps the time they
+// were measured at. Metrics are named and tagged like the dogstatsd client would.
+type API struct {
+	url       string
+	key       string
+	namespace string
+	tags      []string
+	client    *http.Client
+}
+
+// NewAPI returns an API submitting to apiURL with apiKey, DefaultAPIURL is used when apiURL is empty.
+// namespace prefixes every metric and tags are added to every metric and event.
+func NewAPI(apiURL string, apiKey string, namespace string, tags []string, timeout time.Duration) *API {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return &API{
+		url:       strings.TrimSuffix(apiURL, "/"),
+		key:       apiKey,
+		namespace: namespace,
+		tags:      tags,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// SubmitMetrics submits metric points, it reports whether a failure is worth retrying.
+func (a *API) SubmitMetrics(points []point) (bool, error) {
+	payload := struct {
+		Series []series `json:"series"`
+	}{Series: make([]series, 0, len(points))}
+	for _, p := range points {
+		tags := append(append([]string{}, p.Tags...), a.tags...)
+		at := float64(p.Timestamp.Unix())
+		switch p.Type {
+		case statistics.MetricTypeCount, statistics.MetricTypeGauge:
+			payload.Series = append(payload.Series, series{
+				Metric: a.namespace + p.Metric,
+				Points: [][2]float64{{at, p.Value}},
+				Type:   string(p.Type),
+				Tags:   tags,
+			})
+		case statistics.MetricTypeHistogram, statistics.MetricTypeTiming:
+			for _, aggregate := range histogramAggregates {
+				payload.Series = append(payload.Series, series{
+					Metric: a.namespace + p.Metric + "." + aggregate,
+					Points: [][2]float64{{at, p.Value}},
+					Type:   string(statistics.MetricTypeGauge),
+					Tags:   tags,
+				})
+			}
+			payload.Series = append(payload.Series, series{
+				Metric: a.namespace + p.Metric + ".count",
+				Points: [][2]float64{{at, 1}},
+				Type:   string(statistics.MetricTypeCount),
+				Tags:   tags,
+			})
+		}
+	}
+	return a.post("/api/v1/series", payload)
+}
+
+// SubmitEvent submits an event point, it reports whether a failure is worth retrying.
+func (a *API) SubmitEvent(p point) (bool, error) {
+	return a.post("/api/v1/events", event{
+		Title:        p.Title,
+		Text:         p.Message,
+		DateHappened: p.Timestamp.Unix(),
+		Tags:         append(append([]string{}, p.Tags...), a.tags...),
+	})
+}
+
+// Validate checks that the API can be reached with the API key, it reports whether a failure is worth retrying.
+func (a *API) Validate() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, a.url+"/api/v1/validate", nil)
+	if err != nil {
+		return false, err
+	}
+	return a.do(req)
+}
+
+// post submits a JSON payload to path, reporting whether a failure is worth retrying.
+func (a *API) post(path string, payload interface{}) (bool, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.url+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return a.do(req)
+}
+
+// do sends a request with the API key, reporting whether a failure is worth retrying.
+func (a *API) do(req *http.Request) (bool, error) {
+	req.Header.Set("DD-API-KEY", a.key)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("datadog api returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	default:
+		return false, fmt.Errorf("datadog api rejected request with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
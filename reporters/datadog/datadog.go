@@ -2,18 +2,43 @@ package datadog
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
 	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/spool"
 	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
 )
 
+func init() {
+	reporters.RegisterReporterType("datadog", NewFromConfig)
+	reporters.RegisterReporterOptions("datadog", func() interface{} { return &DataDogOptions{} })
+}
+
+// spoolRetryInterval is how often submitting spooled statistics, or reaching the API while nothing is
+// spooled, is retried
+const spoolRetryInterval = time.Minute
+
 // DataDog implements a dogstatsd reporter interface
 type DataDog struct {
 	name   string
 	client *statsd.Client
+	api    *API
+	spool  *spool.Spool
+
+	mu sync.Mutex
+	// offline is whether the API was last found unreachable, the agent could not forward to it either
+	offline bool
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
 }
 
 // DataDogOptions are the options specific to the DataDog reporter
@@ -24,14 +49,21 @@ type DataDogOptions struct {
 	Buffered              bool     `json:"buffered"`
 	MaxMessagesPerPayload int      `json:"max_messages_per_payload"`
 	AsyncUDS              bool     `json:"async_uds"`
-	WriteTimeoutUDS       string   `json:"write_timeout_uds"`
+	WriteTimeoutUDS       string   `json:"write_timeout_uds" config:"duration"`
+	// SpoolDir enables spooling statistics the agent cannot be reached for to disk, to submit them
+	// with their original timestamps through the Datadog API, which requires APIKey.
+	SpoolDir      string `json:"spool_dir"`
+	SpoolMaxBytes int64  `json:"spool_max_bytes"`
+	APIKey        string `json:"api_key"`
+	APIURL        string `json:"api_url"`
+	Timeout       string `json:"timeout" config:"duration"`
 }
 
 // NewFromConfig will return a new DataDog reporter from the provided config.
 func NewFromConfig(cfg config.Section, debug bool) reporters.Interface {
 	var opts DataDogOptions
-	if data, err := json.Marshal(cfg.Options); err == nil {
-		json.Unmarshal(data, &opts)
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid datadog options", zap.String("name", cfg.Name), zap.Error(err))
 	}
 
 	statsOpts := make([]statsd.Option, 0)
@@ -54,7 +86,12 @@ func NewFromConfig(cfg config.Section, debug bool) reporters.Interface {
 		statsOpts = append(statsOpts, statsd.WithAsyncUDS())
 	}
 	if opts.Buffered {
-		statsOpts = append(statsOpts, statsd.Buffered())
+		if opts.SpoolDir != "" {
+			// a buffered client reports failures for whole buffers, the statistics lost cannot be spooled
+			logger.Get().Warn("datadog buffered is ignored with spool_dir", zap.String("name", cfg.Name))
+		} else {
+			statsOpts = append(statsOpts, statsd.Buffered())
+		}
 	}
 	if opts.MaxMessagesPerPayload > 0 {
 		statsOpts = append(statsOpts, statsd.WithMaxMessagesPerPayload(opts.MaxMessagesPerPayload))
@@ -63,22 +100,107 @@ func NewFromConfig(cfg config.Section, debug bool) reporters.Interface {
 		statsOpts = append(statsOpts, statsd.WithTags(opts.Tags))
 	}
 
+	var api *API
+	var sp *spool.Spool
+	if opts.SpoolDir != "" {
+		if opts.APIKey == "" {
+			logger.Get().Warn("datadog spool_dir requires an api_key to submit spooled statistics", zap.String("name", cfg.Name))
+			return nil
+		}
+		var err error
+		if sp, err = spool.Open(opts.SpoolDir, opts.SpoolMaxBytes); err != nil {
+			logger.Get().Warn("failed to open datadog spool", zap.String("name", cfg.Name), zap.String("dir", opts.SpoolDir), zap.Error(err))
+			return nil
+		}
+		timeout := time.Second * 10
+		if d, err := time.ParseDuration(opts.Timeout); err == nil && d > 0 {
+			timeout = d
+		}
+		api = NewAPI(opts.APIURL, opts.APIKey, opts.Namespace, opts.Tags, timeout)
+	}
+
 	client, err := statsd.New(opts.Address, statsOpts...)
 	if err != nil {
 		return nil
 	}
-	return New(cfg.Name, client)
+	return New(cfg.Name, client, api, sp)
 }
 
-// New returns a DataDog reporter using the provided client.
-func New(name string, client *statsd.Client) *DataDog {
+// New returns a DataDog reporter using the provided client. When api and sp are both set, statistics
+// the client fails to send, or that are reported while the API is unreachable, are spooled to sp and
+// submitted through api.
+func New(name string, client *statsd.Client, api *API, sp *spool.Spool) *DataDog {
 	if name == "" {
 		name = "datadog"
 	}
-	return &DataDog{
+	d := &DataDog{
 		name:   name,
 		client: client,
+		api:    api,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
 	}
+	if api != nil && sp != nil {
+		d.spool = sp
+		go d.loop()
+	} else {
+		close(d.done)
+	}
+	return d
+}
+
+// loop periodically submits spooled statistics, or checks whether the API can be reached when nothing is spooled
+func (d *DataDog) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if d.spool.Len() == 0 {
+				d.check()
+				continue
+			}
+			if err := d.Flush(); err != nil {
+				logger.Get().Warn("failed to submit spooled statistics to datadog", zap.String("name", d.name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// check checks whether the API can be reached. An API rejecting the check is not treated as
+// unreachable, the agent still forwards what it is sent.
+func (d *DataDog) check() {
+	retry, err := d.api.Validate()
+	if err != nil && !retry {
+		logger.Get().Warn("datadog api rejected the api key check", zap.String("name", d.name), zap.Error(err))
+	}
+	d.setOffline(err != nil && retry, err)
+}
+
+// setOffline records whether the API is unreachable, logging when that changes
+func (d *DataDog) setOffline(offline bool, cause error) {
+	d.mu.Lock()
+	changed := d.offline != offline
+	d.offline = offline
+	d.mu.Unlock()
+	if !changed {
+		return
+	}
+	if offline {
+		logger.Get().Warn("datadog api is unreachable, spooling statistics instead of sending them to the agent", zap.String("name", d.name), zap.Error(cause))
+	} else {
+		logger.Get().Info("datadog api is reachable again, sending statistics to the agent", zap.String("name", d.name))
+	}
+}
+
+// isOffline returns whether the API was last found unreachable
+func (d *DataDog) isOffline() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.offline
 }
 
 // Name the name of the reporter
@@ -108,27 +230,146 @@ func (d *DataDog) Gauge(metric string, value float64, tags ...string) {
 
 // Event reports an event
 func (d *DataDog) Event(title string, message string, tags ...string) {
+	d.event(title, message, tags, time.Time{})
+}
+
+// event reports an event that happened at ts, the agent uses the time it is received when ts is zero
+func (d *DataDog) event(title string, message string, tags []string, ts time.Time) {
 	e := statsd.NewEvent(title, message)
 	e.Tags = tags
+	e.Timestamp = ts
 	d.client.Event(e)
 }
 
-// ReportStatistics implements statistics reporting
+// ReportStatistics implements statistics reporting.
+// Events keep the time they happened at, dogstatsd metrics cannot carry a timestamp. When a spool is
+// configured, the statistics the agent cannot be reached for are spooled with the time they were
+// measured, and so is everything while the API is unreachable, rather than left to the agent to forward.
 func (d *DataDog) ReportStatistics(stats *statistics.Statistics) {
+	if d.spool != nil && d.isOffline() {
+		d.spoolStatistics(stats.Stats(), errors.New("datadog api is unreachable"))
+		return
+	}
+	failed := make([]*statistics.Statistic, 0)
+	var cause error
 	for _, stat := range stats.Stats() {
-		switch stat.Type() {
+		if err := d.send(stat); err != nil && d.spool != nil {
+			cause = err
+			failed = append(failed, stat)
+		}
+	}
+	if cause != nil {
+		d.spoolStatistics(failed, cause)
+	}
+}
+
+// spoolStatistics spools statistics with the time they were measured, cause is why they were not sent
+func (d *DataDog) spoolStatistics(failed []*statistics.Statistic, cause error) {
+	now := time.Now()
+	records := make([]string, 0, len(failed))
+	for _, stat := range failed {
+		if p, ok := pointOf(stat, stat.TimestampOr(now)); ok {
+			data, err := json.Marshal(p)
+			if err != nil {
+				continue
+			}
+			records = append(records, string(data))
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	if err := d.spool.Append(records); err != nil {
+		logger.Get().Warn("failed to spool datadog statistics", zap.String("name", d.name), zap.Int("dropped", len(records)), zap.NamedError("cause", cause), zap.Error(err))
+		return
+	}
+	logger.Get().Debug("spooled datadog statistics", zap.String("name", d.name), zap.Int("spooled", len(records)), zap.Error(cause))
+}
+
+// send sends a statistic to the agent
+func (d *DataDog) send(stat *statistics.Statistic) error {
+	switch stat.Type() {
+	case statistics.EventType:
+		e := statsd.NewEvent(stat.Event.Title, stat.Event.Message)
+		e.Tags = stat.Event.Tags
+		e.Timestamp = stat.Timestamp
+		return d.client.Event(e)
+	case statistics.MetricTypeCount:
+		return d.client.Count(stat.Metric.MetricName, stat.Metric.Value.Int(), stat.Metric.Tags, 1.0)
+	case statistics.MetricTypeGauge:
+		return d.client.Gauge(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags, 1.0)
+	case statistics.MetricTypeTiming:
+		return d.client.Timing(stat.Metric.MetricName, stat.Metric.Value.Duration(), stat.Metric.Tags, 1.0)
+	case statistics.MetricTypeHistogram:
+		return d.client.Histogram(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags, 1.0)
+	default:
+		// ignore
+		return nil
+	}
+}
+
+// Flush sends any buffered statistics to the agent and submits the spooled statistics in order
+func (d *DataDog) Flush() error {
+	err := d.client.Flush()
+	if d.spool == nil || d.spool.Len() == 0 {
+		return err
+	}
+	if replayErr := d.spool.Replay(d.submitSpooled); replayErr != nil {
+		return fmt.Errorf("%d statistics still spooled: %v", d.spool.Len(), replayErr)
+	}
+	return err
+}
+
+// submitSpooled submits spooled statistics in order, returning how many were handled before the API became unreachable.
+// Statistics the API rejects are dropped rather than blocking the spool.
+func (d *DataDog) submitSpooled(records []string) (int, error) {
+	points := make([]point, 0, len(records))
+	for _, record := range records {
+		var p point
+		if err := json.Unmarshal([]byte(record), &p); err != nil {
+			logger.Get().Warn("dropping invalid spooled statistic", zap.String("name", d.name), zap.Error(err))
+			p = point{}
+		}
+		points = append(points, p)
+	}
+
+	for i := 0; i < len(points); {
+		// consecutive metrics are submitted together, events one at a time
+		n := 1
+		var retry bool
+		var err error
+		switch points[i].Type {
+		case "":
+			// invalid
 		case statistics.EventType:
-			d.Event(stat.Event.Title, stat.Event.Message, stat.Event.Tags...)
-		case statistics.MetricTypeCount:
-			d.Count(stat.Metric.MetricName, stat.Metric.Value.Int(), stat.Metric.Tags...)
-		case statistics.MetricTypeGauge:
-			d.Gauge(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags...)
-		case statistics.MetricTypeTiming:
-			d.Timing(stat.Metric.MetricName, stat.Metric.Value.Duration(), stat.Metric.Tags...)
-		case statistics.MetricTypeHistogram:
-			d.Histogram(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags...)
+			retry, err = d.api.SubmitEvent(points[i])
 		default:
-			// ignore
+			for n < maxSeriesPerRequest && i+n < len(points) && points[i+n].Type != statistics.EventType && points[i+n].Type != "" {
+				n++
+			}
+			retry, err = d.api.SubmitMetrics(points[i : i+n])
+		}
+		if err != nil {
+			if retry {
+				d.setOffline(true, err)
+				return i, err
+			}
+			logger.Get().Warn("dropping spooled statistics rejected by datadog", zap.String("name", d.name), zap.Int("statistics", n), zap.Error(err))
 		}
+		i += n
+	}
+	d.setOffline(false, nil)
+	return len(records), nil
+}
+
+// Close submits what is spooled, then flushes and closes the client connection
+func (d *DataDog) Close() error {
+	d.once.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+	if err := d.Flush(); err != nil {
+		logger.Get().Warn("failed to flush datadog", zap.String("name", d.name), zap.Error(err))
 	}
+	return d.client.Close()
 }
@@ -0,0 +1,263 @@
+package datadog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/platinummonkey/isp-monitor/internal/testutil"
+	"github.com/platinummonkey/isp-monitor/spool"
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// newServer starts a stand-in Datadog API answering with the queued statuses, then accepting
+// series and events
+func newServer(statuses ...int) *testutil.Server {
+	return testutil.NewServer(func(r *http.Request) int {
+		switch r.URL.Path {
+		case "/api/v1/series", "/api/v1/events":
+			return http.StatusAccepted
+		case "/api/v1/validate":
+			return http.StatusOK
+		default:
+			return http.StatusNotFound
+		}
+	}, statuses...)
+}
+
+// submitted returns the series and events the stand-in accepted
+func submitted(s *testutil.Server) ([]series, []event) {
+	var (
+		accepted []series
+		events   []event
+	)
+	for _, r := range s.Requests() {
+		if r.Status != http.StatusAccepted {
+			continue
+		}
+		switch r.Path {
+		case "/api/v1/series":
+			var payload struct {
+				Series []series `json:"series"`
+			}
+			json.Unmarshal(r.Body, &payload)
+			accepted = append(accepted, payload.Series...)
+		case "/api/v1/events":
+			var e event
+			json.Unmarshal(r.Body, &e)
+			events = append(events, e)
+		}
+	}
+	return accepted, events
+}
+
+// newUnreachable returns a reporter whose agent socket does not exist, spooling to a temporary directory
+func newUnreachable(t *testing.T, s *testutil.Server) (*DataDog, func()) {
+	dir, err := ioutil.TempDir("", "datadog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := statsd.New(statsd.UnixAddressPrefix+filepath.Join(dir, "missing.sock"), statsd.WithNamespace("isp."))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	sp, err := spool.Open(filepath.Join(dir, "spool"), 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	api := NewAPI(s.URL, "secret", "isp.", []string{"host:test"}, time.Second)
+	d := New("datadog", client, api, sp)
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// agent is a stand-in dogstatsd agent listening over UDP
+type agent struct {
+	net.PacketConn
+}
+
+func newAgent(t *testing.T) *agent {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &agent{pc}
+}
+
+// received returns the datagrams received within wait
+func (a *agent) received(wait time.Duration) []string {
+	var received []string
+	buf := make([]byte, 65536)
+	a.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, _, err := a.ReadFrom(buf)
+		if err != nil {
+			return received
+		}
+		received = append(received, string(buf[:n]))
+	}
+}
+
+// newReachable returns a reporter sending to a reachable agent, spooling to a temporary directory
+func newReachable(t *testing.T, s *testutil.Server, a *agent) (*DataDog, func()) {
+	dir, err := ioutil.TempDir("", "datadog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := statsd.New(a.LocalAddr().String())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	sp, err := spool.Open(filepath.Join(dir, "spool"), 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	d := New("datadog", client, NewAPI(s.URL, "secret", "", nil, time.Second), sp)
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSpoolsWhileTheAgentIsUnreachable(t *testing.T) {
+	s := newServer(http.StatusServiceUnavailable)
+	defer s.Close()
+	d, cleanup := newUnreachable(t, s)
+	defer cleanup()
+
+	measured := time.Unix(1570000000, 0)
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, "isp_monitor.pinger.packet_loss",
+		statistics.NewFloatValue(100), "name:gateway"), nil))
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeTiming, "isp_monitor.pinger.avg_rtt",
+		statistics.NewDurationValue(25*time.Millisecond), "name:gateway"), nil))
+	stats.Add(statistics.NewStatistic(nil, statistics.NewEvent("outage", "gateway is down", "name:gateway")))
+	stats.Stamp(measured, 0)
+	d.ReportStatistics(stats)
+	if n := d.spool.Len(); n != 3 {
+		t.Fatalf("expected 3 statistics to be spooled, got %d", n)
+	}
+
+	// the api is unavailable at first, the statistics stay spooled
+	if err := d.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := d.spool.Len(); n != 3 {
+		t.Fatalf("expected 3 statistics to still be spooled, got %d", n)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if n := d.spool.Len(); n != 0 {
+		t.Fatalf("expected the spool to be empty, %d statistics are left", n)
+	}
+
+	for _, r := range s.Requests() {
+		if key := r.Header.Get("DD-API-KEY"); key != "secret" {
+			t.Errorf("expected the api key to be sent, got %q", key)
+		}
+	}
+	expected := map[string]float64{
+		"isp.isp_monitor.pinger.packet_loss":          100,
+		"isp.isp_monitor.pinger.avg_rtt.avg":          25,
+		"isp.isp_monitor.pinger.avg_rtt.median":       25,
+		"isp.isp_monitor.pinger.avg_rtt.max":          25,
+		"isp.isp_monitor.pinger.avg_rtt.95percentile": 25,
+		"isp.isp_monitor.pinger.avg_rtt.count":        1,
+	}
+	accepted, events := submitted(s)
+	if len(accepted) != len(expected) {
+		t.Fatalf("expected %d series, got %d: %+v", len(expected), len(accepted), accepted)
+	}
+	for _, series := range accepted {
+		value, ok := expected[series.Metric]
+		if !ok {
+			t.Errorf("unexpected series %s", series.Metric)
+			continue
+		}
+		if len(series.Points) != 1 || series.Points[0][0] != float64(measured.Unix()) || series.Points[0][1] != value {
+			t.Errorf("expected %s to be %v at %d, got %v", series.Metric, value, measured.Unix(), series.Points)
+		}
+		if len(series.Tags) != 2 || series.Tags[0] != "name:gateway" || series.Tags[1] != "host:test" {
+			t.Errorf("unexpected tags %v for %s", series.Tags, series.Metric)
+		}
+	}
+	if len(events) != 1 || events[0].Title != "outage" || events[0].DateHappened != measured.Unix() {
+		t.Errorf("expected the outage event at %d, got %+v", measured.Unix(), events)
+	}
+}
+
+func TestDropsRejectedSpooledStatistics(t *testing.T) {
+	s := newServer(http.StatusForbidden)
+	defer s.Close()
+	d, cleanup := newUnreachable(t, s)
+	defer cleanup()
+
+	stats := statistics.NewStatistics()
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, "isp_monitor.test",
+		statistics.NewFloatValue(1)), nil))
+	d.ReportStatistics(stats)
+	if err := d.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if n := d.spool.Len(); n != 0 {
+		t.Fatalf("expected statistics the api rejects to be dropped, %d are spooled", n)
+	}
+}
+
+func TestSpoolsWhileTheAPIIsUnreachable(t *testing.T) {
+	// the agent is reachable but cannot forward to the api either
+	s := newServer(http.StatusServiceUnavailable)
+	defer s.Close()
+	a := newAgent(t)
+	defer a.Close()
+	d, cleanup := newReachable(t, s, a)
+	defer cleanup()
+
+	gauge := func(value float64) *statistics.Statistics {
+		stats := statistics.NewStatistics()
+		stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, "isp_monitor.test",
+			statistics.NewFloatValue(value)), nil))
+		return stats
+	}
+
+	d.check()
+	d.ReportStatistics(gauge(1))
+	if n := d.spool.Len(); n != 1 {
+		t.Fatalf("expected the statistic to be spooled, got %d", n)
+	}
+	if received := a.received(50 * time.Millisecond); len(received) != 0 {
+		t.Fatalf("expected nothing to be sent to the agent, got %q", received)
+	}
+
+	// submitting what is spooled finds the api reachable again
+	if err := d.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if n := d.spool.Len(); n != 0 {
+		t.Fatalf("expected the spool to be empty, %d statistics are left", n)
+	}
+	d.ReportStatistics(gauge(2))
+	if n := d.spool.Len(); n != 0 {
+		t.Fatalf("expected nothing to be spooled, got %d", n)
+	}
+	if received := a.received(time.Second); len(received) != 1 || received[0] != "isp_monitor.test:2.000000|g" {
+		t.Fatalf("expected the statistic to be sent to the agent, got %q", received)
+	}
+
+	if accepted, _ := submitted(s); len(accepted) != 1 || accepted[0].Metric != "isp_monitor.test" || accepted[0].Points[0][1] != 1 {
+		t.Errorf("expected the spooled statistic to be submitted, got %+v", accepted)
+	}
+}
@@ -0,0 +1,427 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/history"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	reporters.RegisterReporterType("file", NewFromConfig)
+	reporters.RegisterReporterOptions("file", func() interface{} { return &FileOptions{} })
+}
+
+// Supported file formats
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// rotatedTimeFormat is appended to rotated file names.
+const rotatedTimeFormat = "20060102T150405"
+
+var csvHeader = []string{"timestamp", "type", "name", "value", "message", "tags"}
+
+// File is a reporter that appends every statistic as a JSON Lines or CSV row.
+type File struct {
+	name           string
+	path           string
+	format         string
+	maxSize        int64
+	rotateInterval time.Duration
+	compress       bool
+	maxBackups     int
+
+	mu       sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	openedAt time.Time
+
+	// rotated files are compressed and pruned in order by a single worker, Close waits for it through finishing
+	rotateMu  sync.Mutex
+	rotated   []string
+	finishing sync.WaitGroup
+	working   bool
+}
+
+// FileOptions are the options specific to the File reporter
+type FileOptions struct {
+	Path           string `json:"path"`
+	Format         string `json:"format"`
+	MaxSizeMB      int    `json:"max_size_mb"`
+	RotateInterval string `json:"rotate_interval" config:"duration"`
+	Compress       bool   `json:"compress"`
+	MaxBackups     int    `json:"max_backups"`
+}
+
+// NewFromConfig creates a new file reporter from config.
+func NewFromConfig(cfg config.Section, _ bool) reporters.Interface {
+	var opts FileOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid file options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if opts.Path == "" {
+		opts.Path = "isp_monitor.jsonl"
+	}
+	if opts.Format == "" {
+		opts.Format = FormatJSONL
+		if strings.EqualFold(filepath.Ext(opts.Path), ".csv") {
+			opts.Format = FormatCSV
+		}
+	}
+	rotateInterval := time.Duration(0)
+	if opts.RotateInterval != "" {
+		if d, err := time.ParseDuration(opts.RotateInterval); err == nil && d > 0 {
+			rotateInterval = d
+		}
+	}
+
+	f, err := New(cfg.Name, opts.Path, opts.Format, int64(opts.MaxSizeMB)<<20, rotateInterval, opts.Compress, opts.MaxBackups)
+	if err != nil {
+		logger.Get().Warn("failed to open file reporter", zap.String("path", opts.Path), zap.Error(err))
+		return nil
+	}
+	return f
+}
+
+// New creates a file reporter appending to path in the given format.
+// Files are rotated once they exceed maxSize bytes or are older than rotateInterval, zero disables either.
+// Rotated files are optionally gzipped and only the newest maxBackups are kept, zero keeps all.
+func New(
+	name string,
+	path string,
+	format string,
+	maxSize int64,
+	rotateInterval time.Duration,
+	compress bool,
+	maxBackups int,
+) (*File, error) {
+	if name == "" {
+		name = "file"
+	}
+	format = strings.ToLower(format)
+	if format != FormatJSONL && format != FormatCSV {
+		return nil, fmt.Errorf("unsupported format %q, expected %q or %q", format, FormatJSONL, FormatCSV)
+	}
+	f := &File{
+		name:           name,
+		path:           path,
+		format:         format,
+		maxSize:        maxSize,
+		rotateInterval: rotateInterval,
+		compress:       compress,
+		maxBackups:     maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Name returns the name of the reporter
+func (f *File) Name() string {
+	return f.name
+}
+
+// Timing reports a timing metric
+func (f *File) Timing(metric string, duration time.Duration, tags ...string) {
+	f.writeStatistics(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeTiming, metric, statistics.NewDurationValue(duration), tags...), nil))
+}
+
+// Count reports a count metric
+func (f *File) Count(metric string, val int64, tags ...string) {
+	f.writeStatistics(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeCount, metric, statistics.NewIntValue(val), tags...), nil))
+}
+
+// Histogram reports a histogram metric
+func (f *File) Histogram(metric string, val float64, tags ...string) {
+	f.writeStatistics(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeHistogram, metric, statistics.NewFloatValue(val), tags...), nil))
+}
+
+// Gauge reports a gauge metric
+func (f *File) Gauge(metric string, val float64, tags ...string) {
+	f.writeStatistics(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, metric, statistics.NewFloatValue(val), tags...), nil))
+}
+
+// Event reports an event
+func (f *File) Event(title string, message string, tags ...string) {
+	f.writeStatistics(statistics.NewStatistic(nil, statistics.NewEvent(title, message, tags...)))
+}
+
+// ReportStatistics implements statistics reporting
+func (f *File) ReportStatistics(stats *statistics.Statistics) {
+	f.writeStatistics(stats.Stats()...)
+}
+
+// Flush writes buffered rows to disk
+func (f *File) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Close flushes and closes the current file
+func (f *File) Close() error {
+	f.mu.Lock()
+	err := f.closeFile()
+	f.mu.Unlock()
+	f.finishing.Wait()
+	return err
+}
+
+func (f *File) writeStatistics(stats ...*statistics.Statistic) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return
+	}
+	now := time.Now()
+	for _, stat := range stats {
+		switch stat.Type() {
+		case statistics.EventType, statistics.MetricTypeCount, statistics.MetricTypeGauge,
+			statistics.MetricTypeTiming, statistics.MetricTypeHistogram:
+		default:
+			continue
+		}
+		row, err := f.formatRow(history.FromStatistic(stat, now))
+		if err != nil {
+			logger.Get().Warn("failed to format statistic", zap.String("name", f.name), zap.Error(err))
+			continue
+		}
+		if f.shouldRotate(int64(len(row)), now) {
+			if err := f.rotate(now); err != nil {
+				logger.Get().Warn("failed to rotate file", zap.String("name", f.name), zap.String("path", f.path), zap.Error(err))
+				if f.file == nil {
+					return
+				}
+			}
+		}
+		n, err := f.buf.Write(row)
+		f.size += int64(n)
+		if err != nil {
+			logger.Get().Warn("failed to write statistic", zap.String("name", f.name), zap.String("path", f.path), zap.Error(err))
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		logger.Get().Warn("failed to write statistics", zap.String("name", f.name), zap.String("path", f.path), zap.Error(err))
+	}
+}
+
+func (f *File) formatRow(r history.Record) ([]byte, error) {
+	if f.format == FormatJSONL {
+		row, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		return append(row, '\n'), nil
+	}
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write([]string{
+		r.Timestamp.Format(time.RFC3339Nano),
+		string(r.Type),
+		r.Name,
+		strconv.FormatFloat(r.Value, 'f', -1, 64),
+		r.Message,
+		strings.Join(r.Tags, ","),
+	})
+	w.Flush()
+	return []byte(b.String()), w.Error()
+}
+
+func (f *File) shouldRotate(next int64, now time.Time) bool {
+	if f.maxSize > 0 && f.size > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.rotateInterval > 0 && now.Sub(f.openedAt) >= f.rotateInterval
+}
+
+// open opens the current file for appending, writing the CSV header to new files.
+func (f *File) open() error {
+	if dir := filepath.Dir(f.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.buf = bufio.NewWriter(file)
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	if f.format == FormatCSV && f.size == 0 {
+		w := csv.NewWriter(f.buf)
+		w.Write(csvHeader)
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		f.size = int64(f.buf.Buffered())
+	}
+	return nil
+}
+
+func (f *File) closeFile() error {
+	if f.file == nil {
+		return nil
+	}
+	flushErr := f.buf.Flush()
+	closeErr := f.file.Close()
+	f.file = nil
+	f.buf = nil
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// rotate moves the current file aside and opens a fresh one.
+func (f *File) rotate(now time.Time) error {
+	if err := f.closeFile(); err != nil {
+		logger.Get().Warn("failed to close file before rotating", zap.String("path", f.path), zap.Error(err))
+	}
+	rotated := f.rotatedPath(now)
+	if err := os.Rename(f.path, rotated); err != nil {
+		// keep appending to the current file rather than losing data
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.rotateMu.Lock()
+	f.rotated = append(f.rotated, rotated)
+	start := !f.working
+	f.working = true
+	f.rotateMu.Unlock()
+	if start {
+		f.finishing.Add(1)
+		go f.finishRotations()
+	}
+	return nil
+}
+
+// finishRotations finishes the rotated files in the order they were rotated until there are none left
+func (f *File) finishRotations() {
+	defer f.finishing.Done()
+	for {
+		f.rotateMu.Lock()
+		if len(f.rotated) == 0 {
+			f.working = false
+			f.rotateMu.Unlock()
+			return
+		}
+		rotated := f.rotated[0]
+		f.rotated = f.rotated[1:]
+		f.rotateMu.Unlock()
+		f.finishRotation(rotated)
+	}
+}
+
+// rotatedPath returns the path to move the current file to, a sequence number is added when the file
+// was already rotated within the same second. It is padded so backups sort in the order they were rotated.
+func (f *File) rotatedPath(now time.Time) string {
+	ext := filepath.Ext(f.path)
+	base := fmt.Sprintf("%s-%s", strings.TrimSuffix(f.path, ext), now.Format(rotatedTimeFormat))
+	rotated := base + ext
+	for seq := 1; exists(rotated) || exists(rotated+".gz"); seq++ {
+		rotated = fmt.Sprintf("%s_%03d%s", base, seq, ext)
+	}
+	return rotated
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// finishRotation compresses a rotated file and removes backups beyond maxBackups.
+func (f *File) finishRotation(rotated string) {
+	if !exists(rotated) {
+		// already pruned by a later rotation
+		return
+	}
+	if f.compress {
+		if err := gzipFile(rotated); err != nil {
+			logger.Get().Warn("failed to compress rotated file", zap.String("path", rotated), zap.Error(err))
+		}
+	}
+	if f.maxBackups <= 0 {
+		return
+	}
+	ext := filepath.Ext(f.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	// the timestamp and sequence suffix sorts chronologically
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			logger.Get().Warn("failed to remove old rotated file", zap.String("path", backups[0]), zap.Error(err))
+		}
+		backups = backups[1:]
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		zw.Close()
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,137 @@
+package reporters
+
+import (
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// Group is a reporter passing everything on to a set of reporters that can change while it is in use,
+// so reporters can be added and removed without recreating what reports to them.
+type Group struct {
+	name string
+
+	mu sync.Mutex
+	// reporters is replaced rather than modified so it can be ranged over without holding mu
+	reporters map[string]Interface
+}
+
+// NewGroup creates a Group passing everything on to reps
+func NewGroup(name string, reps map[string]Interface) *Group {
+	g := &Group{
+		name:      name,
+		reporters: make(map[string]Interface, len(reps)),
+	}
+	for n, r := range reps {
+		g.reporters[n] = r
+	}
+	return g
+}
+
+// Set adds r to the group under name, replacing any reporter of the same name
+func (g *Group) Set(name string, r Interface) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	reps := make(map[string]Interface, len(g.reporters)+1)
+	for n, rep := range g.reporters {
+		reps[n] = rep
+	}
+	reps[name] = r
+	g.reporters = reps
+}
+
+// Remove removes the reporter of the given name from the group and returns it, nil when there is none.
+// The reporter is not closed.
+func (g *Group) Remove(name string) Interface {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, ok := g.reporters[name]
+	if !ok {
+		return nil
+	}
+	reps := make(map[string]Interface, len(g.reporters))
+	for n, rep := range g.reporters {
+		if n != name {
+			reps[n] = rep
+		}
+	}
+	g.reporters = reps
+	return r
+}
+
+// Reporters returns the reporters in the group, keyed by the name they were added with
+func (g *Group) Reporters() map[string]Interface {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reporters
+}
+
+// Timing reports a timing metric to every reporter
+func (g *Group) Timing(metric string, duration time.Duration, tags ...string) {
+	for _, r := range g.Reporters() {
+		r.Timing(metric, duration, tags...)
+	}
+}
+
+// Count reports a count metric to every reporter
+func (g *Group) Count(metric string, val int64, tags ...string) {
+	for _, r := range g.Reporters() {
+		r.Count(metric, val, tags...)
+	}
+}
+
+// Histogram reports a histogram metric to every reporter
+func (g *Group) Histogram(metric string, val float64, tags ...string) {
+	for _, r := range g.Reporters() {
+		r.Histogram(metric, val, tags...)
+	}
+}
+
+// Gauge reports a gauge metric to every reporter
+func (g *Group) Gauge(metric string, val float64, tags ...string) {
+	for _, r := range g.Reporters() {
+		r.Gauge(metric, val, tags...)
+	}
+}
+
+// Event reports an event to every reporter
+func (g *Group) Event(title string, message string, tags ...string) {
+	for _, r := range g.Reporters() {
+		r.Event(title, message, tags...)
+	}
+}
+
+// ReportStatistics reports a batch of statistics to every reporter
+func (g *Group) ReportStatistics(stats *statistics.Statistics) {
+	for _, r := range g.Reporters() {
+		r.ReportStatistics(stats)
+	}
+}
+
+// Flush flushes every reporter, returning the first error
+func (g *Group) Flush() error {
+	var first error
+	for _, r := range g.Reporters() {
+		if err := r.Flush(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close closes every reporter, returning the first error
+func (g *Group) Close() error {
+	var first error
+	for _, r := range g.Reporters() {
+		if err := r.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Name returns the name of the group
+func (g *Group) Name() string {
+	return g.name
+}
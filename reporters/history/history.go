@@ -0,0 +1,227 @@
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	store "github.com/platinummonkey/isp-monitor/history"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	reporters.RegisterReporterType("history", NewFromConfig)
+	reporters.RegisterReporterOptions("history", func() interface{} { return &HistoryOptions{} })
+}
+
+// maxPending bounds how many records are held in memory while the database cannot be written.
+const maxPending = 100000
+
+// pruneInterval is how often expired records are removed.
+const pruneInterval = time.Hour
+
+// History is a reporter that persists every statistic to a local history database.
+// The database is only held open while flushing so it can be read by other processes.
+type History struct {
+	name      string
+	path      string
+	retention time.Duration
+
+	mu        sync.Mutex
+	pending   []store.Record
+	lastPrune time.Time
+
+	writeMu sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// DefaultPath is the database used when no path is configured
+const DefaultPath = "isp_monitor_history.db"
+
+// HistoryOptions are the options specific to the History reporter
+type HistoryOptions struct {
+	Path          string `json:"path"`
+	Retention     string `json:"retention" config:"duration"`
+	FlushInterval string `json:"flush_interval" config:"duration"`
+}
+
+// NewFromConfig creates a new history reporter from config.
+func NewFromConfig(cfg config.Section, _ bool) reporters.Interface {
+	var opts HistoryOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid history options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if opts.Path == "" {
+		opts.Path = DefaultPath
+	}
+	retention := config.DurationFromString(opts.Retention, time.Hour*24*365)
+	flushInterval := config.DurationFromString(opts.FlushInterval, time.Minute)
+
+	h, err := New(cfg.Name, opts.Path, retention, flushInterval)
+	if err != nil {
+		logger.Get().Warn("failed to open history database", zap.String("path", opts.Path), zap.Error(err))
+		return nil
+	}
+	return h
+}
+
+// New creates a history reporter writing to the database at path, keeping records for retention.
+// The database is created and migrated immediately so configuration errors surface early.
+func New(name string, path string, retention time.Duration, flushInterval time.Duration) (*History, error) {
+	if name == "" {
+		name = "history"
+	}
+	db, err := store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	h := &History{
+		name:      name,
+		path:      path,
+		retention: retention,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go h.loop(flushInterval)
+	return h, nil
+}
+
+func (h *History) loop(flushInterval time.Duration) {
+	defer close(h.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			if err := h.Flush(); err != nil {
+				logger.Get().Warn("failed to write history", zap.String("name", h.name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Name returns the name of the reporter
+func (h *History) Name() string {
+	return h.name
+}
+
+// Timing reports a timing metric
+func (h *History) Timing(metric string, duration time.Duration, tags ...string) {
+	h.add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeTiming, metric, statistics.NewDurationValue(duration), tags...), nil))
+}
+
+// Count reports a count metric
+func (h *History) Count(metric string, val int64, tags ...string) {
+	h.add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeCount, metric, statistics.NewIntValue(val), tags...), nil))
+}
+
+// Histogram reports a histogram metric
+func (h *History) Histogram(metric string, val float64, tags ...string) {
+	h.add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeHistogram, metric, statistics.NewFloatValue(val), tags...), nil))
+}
+
+// Gauge reports a gauge metric
+func (h *History) Gauge(metric string, val float64, tags ...string) {
+	h.add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, metric, statistics.NewFloatValue(val), tags...), nil))
+}
+
+// Event reports an event
+func (h *History) Event(title string, message string, tags ...string) {
+	h.add(statistics.NewStatistic(nil, statistics.NewEvent(title, message, tags...)))
+}
+
+// ReportStatistics implements statistics reporting
+func (h *History) ReportStatistics(stats *statistics.Statistics) {
+	for _, stat := range stats.Stats() {
+		switch stat.Type() {
+		case statistics.EventType, statistics.MetricTypeCount, statistics.MetricTypeGauge,
+			statistics.MetricTypeTiming, statistics.MetricTypeHistogram:
+			h.add(stat)
+		default:
+			// ignore
+		}
+	}
+}
+
+// Flush writes pending records and prunes expired ones at most once per pruneInterval.
+// On failure the records are kept for the next flush.
+func (h *History) Flush() error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	h.mu.Lock()
+	batch := h.pending
+	h.pending = nil
+	prune := time.Since(h.lastPrune) >= pruneInterval
+	h.mu.Unlock()
+
+	if len(batch) == 0 && !prune {
+		return nil
+	}
+	if err := h.write(batch, prune); err != nil {
+		h.requeue(batch)
+		return err
+	}
+	return nil
+}
+
+// Close stops the background flusher and writes any pending records.
+func (h *History) Close() error {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+	return h.Flush()
+}
+
+func (h *History) write(batch []store.Record, prune bool) error {
+	db, err := store.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Append(batch...); err != nil {
+		return err
+	}
+	if prune && h.retention > 0 {
+		pruned, err := db.Prune(time.Now().Add(-h.retention))
+		if err != nil {
+			// the batch is already written, pruning is retried on the next flush
+			logger.Get().Warn("failed to prune history", zap.String("name", h.name), zap.Error(err))
+			return nil
+		}
+		if pruned > 0 {
+			logger.Get().Debug("pruned history", zap.String("name", h.name), zap.Int("records", pruned))
+		}
+		h.mu.Lock()
+		h.lastPrune = time.Now()
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+func (h *History) add(stat *statistics.Statistic) {
+	h.mu.Lock()
+	h.pending = append(h.pending, store.FromStatistic(stat, time.Now()))
+	h.mu.Unlock()
+}
+
+// requeue puts a failed batch back ahead of newer records, dropping the oldest beyond maxPending.
+func (h *History) requeue(batch []store.Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = append(batch, h.pending...)
+	if over := len(h.pending) - maxPending; over > 0 {
+		h.pending = h.pending[over:]
+	}
+}
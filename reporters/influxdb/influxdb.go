@@ -0,0 +1,456 @@
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/spool"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	reporters.RegisterReporterType("influxdb", NewFromConfig)
+	reporters.RegisterReporterOptions("influxdb", func() interface{} { return &InfluxDBOptions{} })
+}
+
+// eventMeasurement is the measurement events are written to
+const eventMeasurement = "isp_monitor.events"
+
+// InfluxDB is a reporter that batches statistics and writes them as line protocol over HTTP.
+type InfluxDB struct {
+	name         string
+	writeURL     string
+	username     string
+	password     string
+	client       *http.Client
+	batchSize    int
+	maxRetries   int
+	retryBackoff time.Duration
+	spool        *spool.Spool
+
+	mu      sync.Mutex
+	pending []string
+
+	writeMu sync.Mutex
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// InfluxDBOptions are the options specific to the InfluxDB reporter
+type InfluxDBOptions struct {
+	Address         string `json:"address"`
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retention_policy"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	BatchSize       int    `json:"batch_size"`
+	FlushInterval   string `json:"flush_interval" config:"duration"`
+	Timeout         string `json:"timeout" config:"duration"`
+	MaxRetries      int    `json:"max_retries"`
+	RetryBackoff    string `json:"retry_backoff" config:"duration"`
+	// SpoolDir enables spooling points that cannot be written to disk, to write them once InfluxDB is reachable again.
+	SpoolDir      string `json:"spool_dir"`
+	SpoolMaxBytes int64  `json:"spool_max_bytes"`
+}
+
+// NewFromConfig will return a new InfluxDB reporter from the provided config.
+func NewFromConfig(cfg config.Section, _ bool) reporters.Interface {
+	var opts InfluxDBOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid influxdb options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if opts.Address == "" {
+		opts.Address = "http://localhost:8086"
+	}
+	if opts.Database == "" {
+		opts.Database = "isp_monitor"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+
+	writeURL, err := WriteURL(opts.Address, opts.Database, opts.RetentionPolicy)
+	if err != nil {
+		logger.Get().Warn("invalid influxdb address", zap.String("address", opts.Address), zap.Error(err))
+		return nil
+	}
+	var sp *spool.Spool
+	if opts.SpoolDir != "" {
+		if sp, err = spool.Open(opts.SpoolDir, opts.SpoolMaxBytes); err != nil {
+			logger.Get().Warn("failed to open influxdb spool", zap.String("dir", opts.SpoolDir), zap.Error(err))
+			return nil
+		}
+	}
+
+	return New(
+		cfg.Name,
+		writeURL,
+		opts.Username,
+		opts.Password,
+		opts.BatchSize,
+		config.DurationFromString(opts.FlushInterval, time.Second*10),
+		config.DurationFromString(opts.Timeout, time.Second*5),
+		opts.MaxRetries,
+		config.DurationFromString(opts.RetryBackoff, time.Second),
+		sp,
+	)
+}
+
+// WriteURL builds the v1 `/write` endpoint for the given server address, database and retention policy.
+func WriteURL(address string, database string, retentionPolicy string) (string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("address must be of the form http(s)://host:port, got %q", address)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+	q := u.Query()
+	q.Set("db", database)
+	q.Set("precision", "ns")
+	if retentionPolicy != "" {
+		q.Set("rp", retentionPolicy)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// New returns an InfluxDB reporter writing to writeURL and starts its background flusher.
+// Points that cannot be written because InfluxDB is unreachable are spooled to sp when it is not nil.
+func New(
+	name string,
+	writeURL string,
+	username string,
+	password string,
+	batchSize int,
+	flushInterval time.Duration,
+	timeout time.Duration,
+	maxRetries int,
+	retryBackoff time.Duration,
+	sp *spool.Spool,
+) *InfluxDB {
+	if name == "" {
+		name = "influxdb"
+	}
+	i := &InfluxDB{
+		name:         name,
+		writeURL:     writeURL,
+		username:     username,
+		password:     password,
+		client:       &http.Client{Timeout: timeout},
+		batchSize:    batchSize,
+		maxRetries:   maxRetries,
+		retryBackoff: retryBackoff,
+		spool:        sp,
+		pending:      make([]string, 0, batchSize),
+		trigger:      make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go i.loop(flushInterval)
+	return i
+}
+
+func (i *InfluxDB) loop(flushInterval time.Duration) {
+	defer close(i.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+		case <-i.trigger:
+		}
+		if err := i.Flush(); err != nil {
+			logger.Get().Warn("failed to write to influxdb", zap.String("name", i.name), zap.Error(err))
+		}
+	}
+}
+
+// Name the name of the reporter
+func (i *InfluxDB) Name() string {
+	return i.name
+}
+
+// Timing reports a timing metric in milliseconds
+func (i *InfluxDB) Timing(metric string, duration time.Duration, tags ...string) {
+	i.add(timingLine(metric, duration, tags, time.Now()))
+}
+
+// Count reports a count metric
+func (i *InfluxDB) Count(metric string, val int64, tags ...string) {
+	i.add(countLine(metric, val, tags, time.Now()))
+}
+
+// Histogram reports a histogram metric
+func (i *InfluxDB) Histogram(metric string, val float64, tags ...string) {
+	i.add(metricLine(metric, formatFloat(val), tags, time.Now()))
+}
+
+// Gauge reports a gauge metric
+func (i *InfluxDB) Gauge(metric string, val float64, tags ...string) {
+	i.add(metricLine(metric, formatFloat(val), tags, time.Now()))
+}
+
+// Event reports an event
+func (i *InfluxDB) Event(title string, message string, tags ...string) {
+	i.add(eventLine(title, message, tags, time.Now()))
+}
+
+// ReportStatistics implements statistics reporting, writing each statistic at the time it was measured
+func (i *InfluxDB) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	for _, stat := range stats.Stats() {
+		ts := stat.TimestampOr(now)
+		switch stat.Type() {
+		case statistics.EventType:
+			i.add(eventLine(stat.Event.Title, stat.Event.Message, stat.Event.Tags, ts))
+		case statistics.MetricTypeCount:
+			i.add(countLine(stat.Metric.MetricName, stat.Metric.Value.Int(), stat.Metric.Tags, ts))
+		case statistics.MetricTypeGauge, statistics.MetricTypeHistogram:
+			i.add(metricLine(stat.Metric.MetricName, formatFloat(stat.Metric.Value.Float()), stat.Metric.Tags, ts))
+		case statistics.MetricTypeTiming:
+			i.add(timingLine(stat.Metric.MetricName, stat.Metric.Value.Duration(), stat.Metric.Tags, ts))
+		default:
+			// ignore
+		}
+	}
+}
+
+// Flush writes all pending points, retrying with backoff on failure.
+// Points that still cannot be written are spooled when a spool is configured, otherwise they are dropped.
+// A batch InfluxDB rejects is dropped on its own.
+// Spooled points are written first, so points are always written in the order they were reported.
+func (i *InfluxDB) Flush() error {
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+
+	i.mu.Lock()
+	batch := i.pending
+	i.pending = make([]string, 0, i.batchSize)
+	i.mu.Unlock()
+
+	if i.spool != nil && i.spool.Len() > 0 {
+		if err := i.spool.Replay(i.writeSpooled); err != nil {
+			return i.spoolPoints(batch, err)
+		}
+	}
+
+	rejected := 0
+	var rejectErr error
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > i.batchSize {
+			n = i.batchSize
+		}
+		if retry, err := i.writeWithRetry(batch[:n]); err != nil {
+			if !retry {
+				// only the rejected batch is dropped, the others are still written
+				logger.Get().Warn("dropping points rejected by influxdb", zap.String("name", i.name), zap.Int("points", n), zap.Error(err))
+				rejected += n
+				rejectErr = err
+				batch = batch[n:]
+				continue
+			}
+			if i.spool != nil {
+				return i.spoolPoints(batch, err)
+			}
+			return fmt.Errorf("dropped %d points: %v", len(batch)+rejected, err)
+		}
+		batch = batch[n:]
+	}
+	if rejectErr != nil {
+		return fmt.Errorf("dropped %d rejected points: %v", rejected, rejectErr)
+	}
+	return nil
+}
+
+// spoolPoints spools points that could not be written because of cause
+func (i *InfluxDB) spoolPoints(points []string, cause error) error {
+	if len(points) == 0 {
+		return fmt.Errorf("%d points still spooled: %v", i.spool.Len(), cause)
+	}
+	if err := i.spool.Append(points); err != nil {
+		return fmt.Errorf("dropped %d points: %v, failed to spool: %v", len(points), cause, err)
+	}
+	return fmt.Errorf("spooled %d points, %d in total: %v", len(points), i.spool.Len(), cause)
+}
+
+// writeSpooled writes spooled points in batches, returning how many were written before InfluxDB became unreachable.
+// Points InfluxDB rejects are dropped rather than blocking the spool.
+func (i *InfluxDB) writeSpooled(points []string) (int, error) {
+	written := 0
+	for written < len(points) {
+		n := len(points) - written
+		if n > i.batchSize {
+			n = i.batchSize
+		}
+		if retry, err := i.writeWithRetry(points[written : written+n]); err != nil {
+			if retry {
+				return written, err
+			}
+			logger.Get().Warn("dropping spooled points rejected by influxdb", zap.String("name", i.name), zap.Int("points", n), zap.Error(err))
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close stops the background flusher and writes any pending points.
+func (i *InfluxDB) Close() error {
+	i.once.Do(func() {
+		close(i.stop)
+	})
+	<-i.done
+	return i.Flush()
+}
+
+func (i *InfluxDB) add(l string) {
+	if l == "" {
+		return
+	}
+	i.mu.Lock()
+	i.pending = append(i.pending, l)
+	full := len(i.pending) >= i.batchSize
+	i.mu.Unlock()
+	if full {
+		select {
+		case i.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// writeWithRetry writes lines, retrying with backoff. It reports whether the final failure was worth retrying.
+func (i *InfluxDB) writeWithRetry(lines []string) (bool, error) {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	backoff := i.retryBackoff
+	var retry bool
+	var err error
+	for attempt := 0; attempt <= i.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		retry, err = i.write(body)
+		if err == nil || !retry {
+			return retry, err
+		}
+	}
+	return retry, err
+}
+
+// write posts a batch, reporting whether a failure is worth retrying.
+func (i *InfluxDB) write(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, i.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("influxdb returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	default:
+		return false, fmt.Errorf("influxdb rejected write with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+func timingLine(metric string, duration time.Duration, tags []string, ts time.Time) string {
+	return metricLine(metric, formatFloat(float64(duration)/float64(time.Millisecond)), tags, ts)
+}
+
+func countLine(metric string, val int64, tags []string, ts time.Time) string {
+	return metricLine(metric, strconv.FormatInt(val, 10)+"i", tags, ts)
+}
+
+func eventLine(title string, message string, tags []string, ts time.Time) string {
+	return line(eventMeasurement, tags, "title="+quoteField(title)+",message="+quoteField(message), ts)
+}
+
+func metricLine(metric string, value string, tags []string, ts time.Time) string {
+	if value == "" {
+		return ""
+	}
+	return line(metric, tags, "value="+value, ts)
+}
+
+// line formats a single point of line protocol.
+func line(measurement string, tags []string, fields string, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(escape(measurement, ", "))
+	for _, tag := range tags {
+		key, value := statistics.SplitTag(tag)
+		if key == "" || value == "" {
+			// line protocol has no notion of a tag without a value
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(escape(key, ",= "))
+		b.WriteString("=")
+		b.WriteString(escape(value, ",= "))
+	}
+	b.WriteString(" ")
+	b.WriteString(fields)
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	return b.String()
+}
+
+// formatFloat formats a float field, returning an empty string for values line protocol cannot represent.
+func formatFloat(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func quoteField(s string) string {
+	return `"` + escape(s, `"\`) + `"`
+}
+
+func escape(s string, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
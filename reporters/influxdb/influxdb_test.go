@@ -0,0 +1,185 @@
+package influxdb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/internal/testutil"
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// newServer starts a stand-in InfluxDB answering with the queued statuses, then 204
+func newServer(statuses ...int) *testutil.Server {
+	return testutil.NewServer(testutil.Status(http.StatusNoContent), statuses...)
+}
+
+// bodies returns the bodies of the writes received
+func bodies(s *testutil.Server) []string {
+	requests := s.Requests()
+	writes := make([]string, 0, len(requests))
+	for _, r := range requests {
+		writes = append(writes, string(r.Body))
+	}
+	return writes
+}
+
+func newReporter(t *testing.T, s *testutil.Server, batchSize int, maxRetries int) *InfluxDB {
+	writeURL, err := WriteURL(s.URL, "isp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a long flush interval leaves flushing to the test
+	return New("influxdb", writeURL, "", "", batchSize, time.Hour, time.Second, maxRetries, time.Millisecond, nil)
+}
+
+func gauges(n int, ts time.Time) *statistics.Statistics {
+	stats := statistics.NewStatistics()
+	for i := 0; i < n; i++ {
+		stats.Add(statistics.NewStatistic(
+			statistics.NewMetric(statistics.MetricTypeGauge, "isp_monitor.test", statistics.NewFloatValue(float64(i)), "name:gateway"),
+			nil,
+		))
+	}
+	stats.Stamp(ts, 0)
+	return stats
+}
+
+func TestFlushWritesInBatches(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	i := newReporter(t, s, 2, 0)
+	defer i.Close()
+
+	ts := time.Unix(1570000000, 0)
+	i.ReportStatistics(gauges(5, ts))
+	if err := i.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	writes := bodies(s)
+	if len(writes) != 3 {
+		t.Fatalf("expected 3 writes of at most 2 points, got %d: %q", len(writes), writes)
+	}
+	expected := []string{
+		"isp_monitor.test,name=gateway value=0 1570000000000000000\nisp_monitor.test,name=gateway value=1 1570000000000000000\n",
+		"isp_monitor.test,name=gateway value=2 1570000000000000000\nisp_monitor.test,name=gateway value=3 1570000000000000000\n",
+		"isp_monitor.test,name=gateway value=4 1570000000000000000\n",
+	}
+	for n, write := range writes {
+		if write != expected[n] {
+			t.Errorf("write %d: expected %q, got %q", n, expected[n], write)
+		}
+	}
+	if q := s.Requests()[0].Query; !strings.Contains(q, "db=isp") || !strings.Contains(q, "precision=ns") {
+		t.Errorf("unexpected write query %q", q)
+	}
+}
+
+func TestFullBatchTriggersFlush(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	i := newReporter(t, s, 2, 0)
+	defer i.Close()
+
+	i.ReportStatistics(gauges(2, time.Now()))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(bodies(s)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("a full batch was not written before the flush interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlushRetriesServerErrors(t *testing.T) {
+	s := newServer(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer s.Close()
+	i := newReporter(t, s, 10, 3)
+	defer i.Close()
+
+	i.ReportStatistics(gauges(1, time.Now()))
+	if err := i.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	writes := bodies(s)
+	if len(writes) != 3 {
+		t.Fatalf("expected 2 failed writes and a retry, got %d writes", len(writes))
+	}
+	if writes[0] != writes[2] {
+		t.Errorf("retry wrote %q, expected %q", writes[2], writes[0])
+	}
+}
+
+func TestFlushGivesUpAfterMaxRetries(t *testing.T) {
+	s := newServer(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer s.Close()
+	i := newReporter(t, s, 10, 2)
+	defer i.Close()
+
+	i.ReportStatistics(gauges(1, time.Now()))
+	if err := i.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := len(bodies(s)); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+	// the points were dropped
+	if err := i.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if n := len(bodies(s)); n != 3 {
+		t.Fatalf("expected dropped points not to be written again, got %d writes", n)
+	}
+}
+
+func TestFlushDoesNotRetryRejectedWrites(t *testing.T) {
+	s := newServer(http.StatusBadRequest)
+	defer s.Close()
+	i := newReporter(t, s, 10, 3)
+	defer i.Close()
+
+	i.ReportStatistics(gauges(1, time.Now()))
+	if err := i.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := len(bodies(s)); n != 1 {
+		t.Fatalf("expected a rejected write not to be retried, got %d writes", n)
+	}
+}
+
+func TestFlushDropsOnlyRejectedBatches(t *testing.T) {
+	s := newServer(http.StatusNoContent, http.StatusBadRequest)
+	defer s.Close()
+	i := newReporter(t, s, 2, 3)
+	defer i.Close()
+
+	i.ReportStatistics(gauges(5, time.Unix(1570000000, 0)))
+	if err := i.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	writes := bodies(s)
+	if len(writes) != 3 {
+		t.Fatalf("expected the batches after the rejected one to be written, got %d writes", len(writes))
+	}
+	if expected := "isp_monitor.test,name=gateway value=4 1570000000000000000\n"; writes[2] != expected {
+		t.Errorf("expected the last batch %q, got %q", expected, writes[2])
+	}
+}
+
+func TestLineEscaping(t *testing.T) {
+	ts := time.Unix(0, 42)
+	got := eventLine(`outage "down"`, `gateway, lost`, []string{"name:my gateway", "key=odd:a,b", "empty:"}, ts)
+	expected := `isp_monitor.events,name=my\ gateway,key\=odd=a\,b title="outage \"down\"",message="gateway, lost" 42`
+	if got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if l := metricLine("m", formatFloat(0/zero()), nil, ts); l != "" {
+		t.Errorf("expected NaN to be dropped, got %q", l)
+	}
+}
+
+func zero() float64 {
+	return 0
+}
@@ -13,6 +13,8 @@ import (
 
 func init() {
 	reporters.RegisterReporterType("log", NewFromConfig)
+	// the log reporter takes no options
+	reporters.RegisterReporterOptions("log", func() interface{} { return &struct{}{} })
 }
 
 // Log is a reporter that only logs using the built in logger.
@@ -88,3 +90,13 @@ func (l *Log) ReportStatistics(stats *statistics.Statistics) {
 		}
 	}
 }
+
+// Flush is a no-op, the log reporter writes synchronously.
+func (l *Log) Flush() error {
+	return nil
+}
+
+// Close is a no-op, the shared logger is synced on exit.
+func (l *Log) Close() error {
+	return nil
+}
@@ -0,0 +1,440 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	reporters.RegisterReporterType("mqtt", NewFromConfig)
+	reporters.RegisterReporterOptions("mqtt", func() interface{} { return &MQTTOptions{} })
+}
+
+// metricPrefix is stripped from metric names when deriving topics
+const metricPrefix = "isp_monitor."
+
+// defaultTarget is used in topics for statistics without a `name:` tag
+const defaultTarget = "default"
+
+// seriesTags are the tags telling apart the metrics of a single target, such as the queries of a dns
+// collector, in the order they appear in topics
+var seriesTags = []string{"resolver", "query", "record_type", "rcode", "url", "hop", "direction", "window"}
+
+// Availability payloads published to the status topic
+const (
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+)
+
+// MQTT is a reporter that publishes every metric to its own topic, along with
+// Home Assistant MQTT discovery payloads so each one appears as a sensor.
+type MQTT struct {
+	name            string
+	client          paho.Client
+	topicPrefix     string
+	discoveryPrefix string
+	nodeID          string
+	qos             byte
+	retain          bool
+	metrics         []string
+	timeout         time.Duration
+
+	mu         sync.Mutex
+	discovered map[string]bool
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// MQTTOptions are the options specific to the MQTT reporter
+type MQTTOptions struct {
+	Broker      string `json:"broker"`
+	ClientID    string `json:"client_id"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	TopicPrefix string `json:"topic_prefix"`
+	QoS         int    `json:"qos"`
+	Retain      bool   `json:"retain"`
+	// Discovery enables Home Assistant discovery, it defaults to true.
+	Discovery       *bool  `json:"discovery"`
+	DiscoveryPrefix string `json:"discovery_prefix"`
+	// Metrics are metric names, or glob patterns, to publish. Every metric is published when empty.
+	Metrics []string `json:"metrics"`
+	Timeout string   `json:"timeout" config:"duration"`
+}
+
+// NewFromConfig will return a new MQTT reporter from the provided config.
+func NewFromConfig(cfg config.Section, _ bool) reporters.Interface {
+	var opts MQTTOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid mqtt options", zap.String("name", cfg.Name), zap.Error(err))
+		return nil
+	}
+	if opts.Broker == "" {
+		opts.Broker = "tcp://localhost:1883"
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "isp_monitor"
+	}
+	if opts.TopicPrefix == "" {
+		opts.TopicPrefix = "isp_monitor"
+	}
+	if opts.QoS < 0 || opts.QoS > 2 {
+		logger.Get().Warn("mqtt qos must be 0, 1 or 2", zap.String("name", cfg.Name), zap.Int("qos", opts.QoS))
+		return nil
+	}
+	discoveryPrefix := ""
+	if opts.Discovery == nil || *opts.Discovery {
+		discoveryPrefix = opts.DiscoveryPrefix
+		if discoveryPrefix == "" {
+			discoveryPrefix = "homeassistant"
+		}
+	}
+
+	return New(
+		cfg.Name,
+		opts.Broker,
+		opts.ClientID,
+		opts.Username,
+		opts.Password,
+		opts.TopicPrefix,
+		discoveryPrefix,
+		byte(opts.QoS),
+		opts.Retain,
+		opts.Metrics,
+		config.DurationFromString(opts.Timeout, time.Second*5),
+	)
+}
+
+// New returns an MQTT reporter and starts connecting to the broker in the background.
+// Home Assistant discovery is disabled when discoveryPrefix is empty.
+func New(
+	name string,
+	broker string,
+	clientID string,
+	username string,
+	password string,
+	topicPrefix string,
+	discoveryPrefix string,
+	qos byte,
+	retain bool,
+	metrics []string,
+	timeout time.Duration,
+) *MQTT {
+	if name == "" {
+		name = "mqtt"
+	}
+	m := &MQTT{
+		name:            name,
+		topicPrefix:     strings.TrimSuffix(topicPrefix, "/"),
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		nodeID:          sanitize(clientID),
+		qos:             qos,
+		retain:          retain,
+		metrics:         metrics,
+		timeout:         timeout,
+		discovered:      make(map[string]bool),
+		stop:            make(chan struct{}),
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetConnectTimeout(timeout).
+		SetWriteTimeout(timeout).
+		SetAutoReconnect(true).
+		SetWill(m.statusTopic(), payloadOffline, qos, true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger.Get().Warn("lost connection to mqtt broker", zap.String("name", name), zap.Error(err))
+		})
+	m.client = paho.NewClient(opts)
+	go m.connect()
+	return m
+}
+
+// connect retries the initial connection until it succeeds, the client reconnects by itself afterwards.
+func (m *MQTT) connect() {
+	backoff := time.Second
+	for {
+		token := m.client.Connect()
+		if token.WaitTimeout(m.timeout) && token.Error() == nil {
+			return
+		}
+		logger.Get().Warn("failed to connect to mqtt broker", zap.String("name", m.name), zap.Error(token.Error()))
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// onConnect announces availability and has discovery payloads resent, the broker may have lost them.
+func (m *MQTT) onConnect(c paho.Client) {
+	logger.Get().Info("connected to mqtt broker", zap.String("name", m.name))
+	m.mu.Lock()
+	m.discovered = make(map[string]bool)
+	m.mu.Unlock()
+	c.Publish(m.statusTopic(), m.qos, true, payloadOnline)
+}
+
+// Name the name of the reporter
+func (m *MQTT) Name() string {
+	return m.name
+}
+
+// Timing publishes a timing metric in milliseconds
+func (m *MQTT) Timing(metric string, duration time.Duration, tags ...string) {
+	m.publishMetric(statistics.MetricTypeTiming, metric, float64(duration)/float64(time.Millisecond), tags)
+}
+
+// Count publishes a count metric
+func (m *MQTT) Count(metric string, val int64, tags ...string) {
+	m.publishMetric(statistics.MetricTypeCount, metric, float64(val), tags)
+}
+
+// Histogram publishes a histogram metric
+func (m *MQTT) Histogram(metric string, val float64, tags ...string) {
+	m.publishMetric(statistics.MetricTypeHistogram, metric, val, tags)
+}
+
+// Gauge publishes a gauge metric
+func (m *MQTT) Gauge(metric string, val float64, tags ...string) {
+	m.publishMetric(statistics.MetricTypeGauge, metric, val, tags)
+}
+
+// Event publishes an event as JSON to the events topic of its target
+func (m *MQTT) Event(title string, message string, tags ...string) {
+	m.event(title, message, tags, time.Now())
+}
+
+func (m *MQTT) event(title string, message string, tags []string, ts time.Time) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"title":     title,
+		"message":   message,
+		"tags":      tags,
+		"timestamp": ts,
+	})
+	if err != nil {
+		return
+	}
+	m.publish(m.topicPrefix+"/"+sanitize(target(tags))+"/events", false, payload)
+}
+
+// ReportStatistics implements statistics reporting
+func (m *MQTT) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	for _, stat := range stats.Stats() {
+		switch stat.Type() {
+		case statistics.EventType:
+			m.event(stat.Event.Title, stat.Event.Message, stat.Event.Tags, stat.TimestampOr(now))
+		case statistics.MetricTypeCount:
+			m.Count(stat.Metric.MetricName, stat.Metric.Value.Int(), stat.Metric.Tags...)
+		case statistics.MetricTypeGauge:
+			m.Gauge(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags...)
+		case statistics.MetricTypeTiming:
+			m.Timing(stat.Metric.MetricName, stat.Metric.Value.Duration(), stat.Metric.Tags...)
+		case statistics.MetricTypeHistogram:
+			m.Histogram(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags...)
+		default:
+			// ignore
+		}
+	}
+}
+
+// Flush is a no-op, messages are published as they are reported
+func (m *MQTT) Flush() error {
+	return nil
+}
+
+// Close marks this monitor offline and disconnects from the broker
+func (m *MQTT) Close() error {
+	m.once.Do(func() {
+		close(m.stop)
+		if m.client.IsConnected() {
+			m.client.Publish(m.statusTopic(), m.qos, true, payloadOffline).WaitTimeout(m.timeout)
+		}
+		m.client.Disconnect(uint(m.timeout / time.Millisecond))
+	})
+	return nil
+}
+
+// StateTopic returns the topic a metric is published to for the given tags: its target, a `<key>_<value>`
+// level for each tag telling it apart from the other metrics of the target, then the metric
+func (m *MQTT) StateTopic(metric string, tags []string) string {
+	topic := append([]string{m.topicPrefix, sanitize(target(tags))}, levels(tags)...)
+	return strings.Join(topic, "/") + "/" + strings.Replace(strings.TrimPrefix(metric, metricPrefix), ".", "/", -1)
+}
+
+func (m *MQTT) statusTopic() string {
+	return m.topicPrefix + "/status"
+}
+
+func (m *MQTT) selected(metric string) bool {
+	if len(m.metrics) == 0 {
+		return true
+	}
+	for _, pattern := range m.metrics {
+		if ok, _ := path.Match(pattern, metric); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MQTT) publishMetric(metricType statistics.Type, metric string, val float64, tags []string) {
+	if !m.selected(metric) {
+		return
+	}
+	topic := m.StateTopic(metric, tags)
+	if m.discoveryPrefix != "" && m.client.IsConnected() {
+		m.discover(metricType, metric, tags, topic)
+	}
+	m.publish(topic, m.retain, []byte(strconv.FormatFloat(val, 'f', -1, 64)))
+}
+
+// discover publishes the retained Home Assistant config for a sensor the first time it is seen
+func (m *MQTT) discover(metricType statistics.Type, metric string, tags []string, stateTopic string) {
+	name := append([]string{target(tags)}, levels(tags)...)
+	objectID := sanitize(strings.Join(name, "_") + "_" + strings.TrimPrefix(metric, metricPrefix))
+	m.mu.Lock()
+	seen := m.discovered[objectID]
+	m.discovered[objectID] = true
+	m.mu.Unlock()
+	if seen {
+		return
+	}
+
+	sensor := map[string]interface{}{
+		"name":               fmt.Sprintf("%s %s", strings.Join(name, " "), strings.Replace(strings.TrimPrefix(metric, metricPrefix), ".", " ", -1)),
+		"unique_id":          m.nodeID + "_" + objectID,
+		"state_topic":        stateTopic,
+		"availability_topic": m.statusTopic(),
+		"device": map[string]interface{}{
+			"identifiers":  []string{m.nodeID},
+			"name":         "ISP Monitor",
+			"manufacturer": "isp-monitor",
+			"model":        m.nodeID,
+		},
+	}
+	if unit := unitOf(metricType, metric); unit != "" {
+		sensor["unit_of_measurement"] = unit
+	}
+	if icon := iconOf(metric); icon != "" {
+		sensor["icon"] = icon
+	}
+	payload, err := json.Marshal(sensor)
+	if err != nil {
+		return
+	}
+	m.publish(fmt.Sprintf("%s/sensor/%s/%s/config", m.discoveryPrefix, m.nodeID, objectID), true, payload)
+}
+
+func (m *MQTT) publish(topic string, retain bool, payload []byte) {
+	token := m.client.Publish(topic, m.qos, retain, payload)
+	if m.qos == 0 {
+		// fire and forget, errors are reported right away
+		if token.WaitTimeout(0) && token.Error() != nil {
+			logger.Get().Debug("failed to publish to mqtt", zap.String("name", m.name), zap.String("topic", topic), zap.Error(token.Error()))
+		}
+		return
+	}
+	go func() {
+		if !token.WaitTimeout(m.timeout) {
+			logger.Get().Debug("timed out publishing to mqtt", zap.String("name", m.name), zap.String("topic", topic))
+		} else if token.Error() != nil {
+			logger.Get().Debug("failed to publish to mqtt", zap.String("name", m.name), zap.String("topic", topic), zap.Error(token.Error()))
+		}
+	}()
+}
+
+// unitOf guesses the Home Assistant unit of measurement of a metric
+func unitOf(metricType statistics.Type, metric string) string {
+	switch {
+	case metricType == statistics.MetricTypeTiming:
+		return "ms"
+	case strings.HasSuffix(metric, "_loss"):
+		return "%"
+	case strings.HasSuffix(metric, "_mbps"):
+		return "Mbit/s"
+	case strings.HasSuffix(metric, "_distance"):
+		return "km"
+	default:
+		return ""
+	}
+}
+
+// iconOf picks a Material Design icon for well known metrics
+func iconOf(metric string) string {
+	switch {
+	case strings.HasSuffix(metric, "download_mbps"):
+		return "mdi:download"
+	case strings.HasSuffix(metric, "upload_mbps"):
+		return "mdi:upload"
+	case strings.HasSuffix(metric, "_rtt"), strings.HasSuffix(metric, "_latency"):
+		return "mdi:timer-outline"
+	case strings.HasSuffix(metric, "_loss"):
+		return "mdi:lan-disconnect"
+	default:
+		return ""
+	}
+}
+
+// target returns the value of the `name:` tag
+func target(tags []string) string {
+	for _, tag := range tags {
+		if k, v := statistics.SplitTag(tag); k == "name" && v != "" {
+			return v
+		}
+	}
+	return defaultTarget
+}
+
+// levels returns a `<key>_<value>` topic level for each of the series tags present in tags
+func levels(tags []string) []string {
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if k, v := statistics.SplitTag(tag); v != "" {
+			values[k] = v
+		}
+	}
+	l := make([]string, 0)
+	for _, key := range seriesTags {
+		if v, ok := values[key]; ok {
+			l = append(l, sanitize(key+"_"+v))
+		}
+	}
+	return l
+}
+
+// sanitize keeps a topic level or discovery id to characters Home Assistant accepts
+func sanitize(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
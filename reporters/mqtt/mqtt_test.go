@@ -0,0 +1,218 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/statistics"
+)
+
+// message is a message published to the broker
+type message struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// broker is an embedded stand-in MQTT 3.1.1 broker accepting every client and recording what they
+// publish. It does not route messages to subscribers.
+type broker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []message
+}
+
+func newBroker(t *testing.T) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *broker) Close() {
+	b.listener.Close()
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := readLength(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			qos := header >> 1 & 3
+			n := int(binary.BigEndian.Uint16(body))
+			topic := string(body[2 : 2+n])
+			rest := body[2+n:]
+			if qos > 0 {
+				conn.Write([]byte{0x40, 2, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, message{topic: topic, payload: string(rest), retain: header&1 == 1})
+			b.mu.Unlock()
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// readLength reads the variable length remaining length of a packet
+func readLength(r *bufio.Reader) (int, error) {
+	length, shift := 0, uint(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		shift += 7
+	}
+}
+
+// waitFor waits for a message published to topic and returns it
+func (b *broker) waitFor(t *testing.T, topic string) message {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		for _, m := range b.messages {
+			if m.topic == topic {
+				b.mu.Unlock()
+				return m
+			}
+		}
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing was published to %s", topic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lookupTime is a dns lookup time of the resolvers collector
+func lookupTime(resolver string, query string, d time.Duration) *statistics.Statistic {
+	return statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeTiming, "isp_monitor.dns.lookup_time",
+		statistics.NewDurationValue(d), "name:resolvers", "resolver:"+resolver, "query:"+query, "record_type:A"), nil)
+}
+
+func TestPublish(t *testing.T) {
+	b := newBroker(t)
+	defer b.Close()
+	m := New("mqtt", b.URL(), "isp monitor", "", "", "isp_monitor/", "homeassistant", 1, true, nil, time.Second)
+	if status := b.waitFor(t, "isp_monitor/status"); status.payload != payloadOnline || !status.retain {
+		t.Fatalf("expected a retained online status, got %+v", status)
+	}
+
+	stats := statistics.NewStatistics()
+	stats.Add(lookupTime("1.1.1.1:53", "example.com", 12*time.Millisecond))
+	stats.Add(lookupTime("8.8.8.8:53", "example.com", 30*time.Millisecond))
+	stats.Add(statistics.NewStatistic(statistics.NewMetric(statistics.MetricTypeGauge, "isp_monitor.pinger.packet_loss",
+		statistics.NewFloatValue(2.5), "name:gateway", "address:192.0.2.1"), nil))
+	m.ReportStatistics(stats)
+
+	for _, tc := range []struct {
+		topic    string
+		payload  string
+		objectID string
+		unit     string
+	}{
+		{
+			topic:    "isp_monitor/resolvers/resolver_1_1_1_1_53/query_example_com/record_type_A/dns/lookup_time",
+			payload:  "12",
+			objectID: "resolvers_resolver_1_1_1_1_53_query_example_com_record_type_A_dns_lookup_time",
+			unit:     "ms",
+		},
+		{
+			topic:    "isp_monitor/resolvers/resolver_8_8_8_8_53/query_example_com/record_type_A/dns/lookup_time",
+			payload:  "30",
+			objectID: "resolvers_resolver_8_8_8_8_53_query_example_com_record_type_A_dns_lookup_time",
+			unit:     "ms",
+		},
+		{
+			topic:    "isp_monitor/gateway/pinger/packet_loss",
+			payload:  "2.5",
+			objectID: "gateway_pinger_packet_loss",
+			unit:     "%",
+		},
+	} {
+		state := b.waitFor(t, tc.topic)
+		if state.payload != tc.payload || !state.retain {
+			t.Errorf("expected %s to be retained with %s, got %+v", tc.topic, tc.payload, state)
+		}
+
+		config := b.waitFor(t, "homeassistant/sensor/isp_monitor/"+tc.objectID+"/config")
+		var sensor map[string]interface{}
+		if err := json.Unmarshal([]byte(config.payload), &sensor); err != nil {
+			t.Fatalf("invalid discovery payload %q: %v", config.payload, err)
+		}
+		if !config.retain {
+			t.Errorf("expected the discovery payload of %s to be retained", tc.objectID)
+		}
+		if sensor["unique_id"] != "isp_monitor_"+tc.objectID {
+			t.Errorf("unexpected unique id %v for %s", sensor["unique_id"], tc.objectID)
+		}
+		if sensor["state_topic"] != tc.topic {
+			t.Errorf("expected state topic %s, got %v", tc.topic, sensor["state_topic"])
+		}
+		if sensor["unit_of_measurement"] != tc.unit {
+			t.Errorf("expected unit %s for %s, got %v", tc.unit, tc.objectID, sensor["unit_of_measurement"])
+		}
+	}
+
+	m.Event("outage", "gateway is down", "name:gateway")
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(b.waitFor(t, "isp_monitor/gateway/events").payload), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["title"] != "outage" {
+		t.Errorf("unexpected event %v", event)
+	}
+
+	m.Close()
+	b.mu.Lock()
+	last := b.messages[len(b.messages)-1]
+	b.mu.Unlock()
+	if last.topic != "isp_monitor/status" || last.payload != payloadOffline {
+		t.Errorf("expected an offline status on close, got %+v", last)
+	}
+}
@@ -0,0 +1,358 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	reporters.RegisterReporterType("prometheus", NewFromConfig)
+	reporters.RegisterReporterOptions("prometheus", func() interface{} { return &PrometheusOptions{} })
+}
+
+// DefaultHistogramBuckets are used for histogram statistics, which are mostly
+// percentages and millisecond latencies.
+var DefaultHistogramBuckets = []float64{0, 1, 5, 10, 25, 50, 75, 100, 250, 500, 1000}
+
+// Prometheus is a reporter that exposes statistics on an HTTP endpoint for scraping.
+type Prometheus struct {
+	name             string
+	namespace        string
+	timingBuckets    []float64
+	histogramBuckets []float64
+	registry         *prom.Registry
+	server           *http.Server
+
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// family is a metric and its series, keyed by their labels. Its label names are the union of the tag
+// keys of every series, so a tag first seen on a later statistic still tells series apart; series
+// without a label expose it empty, which Prometheus treats as unset.
+type family struct {
+	metricType statistics.Type
+	help       string
+	buckets    []float64
+	labels     map[string]bool
+	series     map[string]*series
+}
+
+// series is the value of a counter or gauge, or the observations of a histogram, for a set of labels
+type series struct {
+	labels  map[string]string
+	value   float64
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+// PrometheusOptions are the options specific to the Prometheus reporter
+type PrometheusOptions struct {
+	Address          string    `json:"address"`
+	Path             string    `json:"path"`
+	Namespace        string    `json:"namespace"`
+	TimingBuckets    []float64 `json:"timing_buckets"`
+	HistogramBuckets []float64 `json:"histogram_buckets"`
+}
+
+// NewFromConfig will return a new Prometheus reporter serving from the provided config.
+func NewFromConfig(cfg config.Section, _ bool) reporters.Interface {
+	var opts PrometheusOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid prometheus options", zap.String("name", cfg.Name), zap.Error(err))
+	}
+	if opts.Address == "" {
+		opts.Address = ":9400"
+	}
+	if opts.Path == "" {
+		opts.Path = "/metrics"
+	}
+
+	p := New(cfg.Name, opts.Namespace, opts.TimingBuckets, opts.HistogramBuckets)
+	if err := p.Serve(opts.Address, opts.Path); err != nil {
+		logger.Get().Warn("failed to start prometheus reporter", zap.String("address", opts.Address), zap.Error(err))
+		return nil
+	}
+	return p
+}
+
+// New returns a Prometheus reporter with its own registry, it does not serve until Serve is called.
+func New(name string, namespace string, timingBuckets []float64, histogramBuckets []float64) *Prometheus {
+	if name == "" {
+		name = "prometheus"
+	}
+	if len(timingBuckets) == 0 {
+		timingBuckets = prom.DefBuckets
+	}
+	if len(histogramBuckets) == 0 {
+		histogramBuckets = DefaultHistogramBuckets
+	}
+	p := &Prometheus{
+		name:             name,
+		namespace:        sanitize(namespace),
+		timingBuckets:    sortedBuckets(timingBuckets),
+		histogramBuckets: sortedBuckets(histogramBuckets),
+		registry:         prom.NewRegistry(),
+		families:         make(map[string]*family),
+	}
+	p.registry.MustRegister(p)
+	return p
+}
+
+// Handler returns the HTTP handler exposing the collected metrics
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// Serve starts serving the metrics handler on address at path in the background.
+func (p *Prometheus) Serve(address string, path string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, p.Handler())
+	p.server = &http.Server{Handler: mux}
+	go func() {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Get().Warn("prometheus reporter stopped serving", zap.String("name", p.name), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Name the name of the reporter
+func (p *Prometheus) Name() string {
+	return p.name
+}
+
+// Timing reports a timing metric as a histogram in seconds
+func (p *Prometheus) Timing(metric string, duration time.Duration, tags ...string) {
+	p.observe(metric, metricName(metric)+"_seconds", p.timingBuckets, duration.Seconds(), tags)
+}
+
+// Histogram reports a histogram metric
+func (p *Prometheus) Histogram(metric string, val float64, tags ...string) {
+	p.observe(metric, metricName(metric), p.histogramBuckets, val, tags)
+}
+
+// Count reports a count metric as a counter
+func (p *Prometheus) Count(metric string, val int64, tags ...string) {
+	if val < 0 {
+		// counters can only go up
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.lookup(metricName(metric)+"_total", statistics.MetricTypeCount, metric, nil, tags); s != nil {
+		s.value += float64(val)
+	}
+}
+
+// Gauge reports a gauge metric
+func (p *Prometheus) Gauge(metric string, val float64, tags ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.lookup(metricName(metric), statistics.MetricTypeGauge, metric, nil, tags); s != nil {
+		s.value = val
+	}
+}
+
+// Event is a no-op, events have no Prometheus representation
+func (p *Prometheus) Event(title string, message string, tags ...string) {}
+
+// ReportStatistics implements statistics reporting
+func (p *Prometheus) ReportStatistics(stats *statistics.Statistics) {
+	for _, stat := range stats.Stats() {
+		switch stat.Type() {
+		case statistics.EventType:
+			p.Event(stat.Event.Title, stat.Event.Message, stat.Event.Tags...)
+		case statistics.MetricTypeCount:
+			p.Count(stat.Metric.MetricName, stat.Metric.Value.Int(), stat.Metric.Tags...)
+		case statistics.MetricTypeGauge:
+			p.Gauge(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags...)
+		case statistics.MetricTypeTiming:
+			p.Timing(stat.Metric.MetricName, stat.Metric.Value.Duration(), stat.Metric.Tags...)
+		case statistics.MetricTypeHistogram:
+			p.Histogram(stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags...)
+		default:
+			// ignore
+		}
+	}
+}
+
+// Flush is a no-op, metrics are served on scrape
+func (p *Prometheus) Flush() error {
+	return nil
+}
+
+// Close stops serving metrics
+func (p *Prometheus) Close() error {
+	if p.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return p.server.Shutdown(ctx)
+}
+
+func (p *Prometheus) observe(metric string, name string, buckets []float64, val float64, tags []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.lookup(name, statistics.MetricTypeHistogram, metric, buckets, tags)
+	if s == nil {
+		return
+	}
+	s.count++
+	s.sum += val
+	for i, upper := range buckets {
+		if val <= upper {
+			s.buckets[i]++
+		}
+	}
+}
+
+// lookup returns the series of the named metric for tags, creating the metric and series on first use.
+// It returns nil when the name is already used by a metric of another type. p.mu must be held.
+func (p *Prometheus) lookup(name string, metricType statistics.Type, metric string, buckets []float64, tags []string) *series {
+	f, ok := p.families[name]
+	if !ok {
+		f = &family{
+			metricType: metricType,
+			help:       help(metricType, metric),
+			buckets:    buckets,
+			labels:     make(map[string]bool),
+			series:     make(map[string]*series),
+		}
+		p.families[name] = f
+	}
+	if f.metricType != metricType {
+		logger.Get().Debug("dropping prometheus metric reported with another type",
+			zap.String("metric", name), zap.String("type", string(metricType)))
+		return nil
+	}
+	labels := labelSet(tags)
+	key := seriesKey(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: labels, buckets: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+		for label := range labels {
+			f.labels[label] = true
+		}
+	}
+	return s
+}
+
+// Describe sends no descriptors, the label names of a metric grow as new tags are seen
+func (p *Prometheus) Describe(chan<- *prom.Desc) {}
+
+// Collect sends every series, labelled with the label names of its metric
+func (p *Prometheus) Collect(ch chan<- prom.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, f := range p.families {
+		labels := make([]string, 0, len(f.labels))
+		for label := range f.labels {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		desc := prom.NewDesc(prom.BuildFQName(p.namespace, "", name), f.help, labels, nil)
+		for _, s := range f.series {
+			values := make([]string, len(labels))
+			for i, label := range labels {
+				values[i] = s.labels[label]
+			}
+			var m prom.Metric
+			var err error
+			switch f.metricType {
+			case statistics.MetricTypeCount:
+				m, err = prom.NewConstMetric(desc, prom.CounterValue, s.value, values...)
+			case statistics.MetricTypeGauge:
+				m, err = prom.NewConstMetric(desc, prom.GaugeValue, s.value, values...)
+			default:
+				buckets := make(map[float64]uint64, len(f.buckets))
+				for i, upper := range f.buckets {
+					buckets[upper] = s.buckets[i]
+				}
+				m, err = prom.NewConstHistogram(desc, s.count, s.sum, buckets, values...)
+			}
+			if err != nil {
+				logger.Get().Debug("failed to collect prometheus metric", zap.String("metric", name), zap.Error(err))
+				continue
+			}
+			ch <- m
+		}
+	}
+}
+
+func help(metricType statistics.Type, metric string) string {
+	return fmt.Sprintf("isp-monitor %s %s", metricType, metric)
+}
+
+// metricName converts a dotted statistic name into a valid Prometheus metric name.
+func metricName(metric string) string {
+	return sanitize(metric)
+}
+
+// labelSet returns the label names and values of tags
+func labelSet(tags []string) map[string]string {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value := statistics.SplitTag(tag)
+		key = sanitize(key)
+		if key == "" || strings.HasPrefix(key, "__") {
+			continue
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// seriesKey identifies a series by its labels, a label with an empty value is the same as no label
+func seriesKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		if value != "" {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+func sortedBuckets(buckets []float64) []float64 {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// sanitize replaces any character not valid in a Prometheus name with an underscore.
+func sanitize(s string) string {
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
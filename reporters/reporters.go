@@ -16,11 +16,16 @@ type Interface interface {
 	Gauge(metric string, val float64, tags ...string)
 	Event(title string, message string, tags ...string)
 	ReportStatistics(statistics *statistics.Statistics)
+	// Flush sends any statistics the reporter is still buffering.
+	Flush() error
+	// Close flushes and releases the reporter; it must not be used afterwards.
+	Close() error
 
 	Name() string
 }
 
-var registeredReporters map[string]func(config.Section, bool) Interface
+var registeredReporters = make(map[string]func(config.Section, bool) Interface)
+var registeredOptions = make(map[string]func() interface{})
 var mu sync.RWMutex
 
 // RegisterReporterType will register a reporter type
@@ -31,6 +36,28 @@ func RegisterReporterType(collectorType string, registerFunc func(config.Section
 	mu.Unlock()
 }
 
+// RegisterReporterOptions registers the options of a reporter type so configs can be validated,
+// options returns a pointer to a new options struct.
+func RegisterReporterOptions(reporterType string, options func() interface{}) {
+	mu.Lock()
+	registeredOptions[reporterType] = options
+	mu.Unlock()
+}
+
+// ReporterOptions returns a pointer to a new options struct for the reporter type, nil when it
+// registered none. ok is false when the type is unknown.
+func ReporterOptions(reporterType string) (interface{}, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if _, ok := registeredReporters[reporterType]; !ok {
+		return nil, false
+	}
+	if options, ok := registeredOptions[reporterType]; ok {
+		return options(), true
+	}
+	return nil, true
+}
+
 // CreateReporterFromConfig will create a reporter from the given config
 func CreateReporterFromConfig(cfg config.Section, debug bool) Interface {
 	mu.RLock()
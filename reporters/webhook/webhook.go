@@ -0,0 +1,531 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/config"
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"github.com/platinummonkey/isp-monitor/reporters"
+	"github.com/platinummonkey/isp-monitor/spool"
+	"github.com/platinummonkey/isp-monitor/statistics"
+	"go.uber.org/zap"
+)
+
+func init() {
+	reporters.RegisterReporterType("webhook", NewFromConfig)
+	reporters.RegisterReporterOptions("webhook", func() interface{} { return &WebhookOptions{} })
+}
+
+// DefaultSignatureHeader is the header the HMAC-SHA256 signature of the body is sent in
+const DefaultSignatureHeader = "X-Signature-256"
+
+// retryInterval is how often delivering spooled or re-queued notifications is retried
+const retryInterval = time.Minute
+
+// Notification is a single event or metric sent to the webhook.
+// It is the data the payload template is executed with.
+type Notification struct {
+	Type      statistics.Type   `json:"type"`
+	Title     string            `json:"title,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Metric    string            `json:"metric,omitempty"`
+	Value     *float64          `json:"value,omitempty"`
+	Tags      map[string]string `json:"tags"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Tag returns the value of the tag with the given key
+func (n Notification) Tag(key string) string {
+	return n.Tags[key]
+}
+
+// Webhook is a reporter that POSTs events, and optionally selected metrics, as JSON to a URL.
+type Webhook struct {
+	name            string
+	url             string
+	method          string
+	headers         map[string]string
+	template        *template.Template
+	secret          []byte
+	signatureHeader string
+	metrics         []string
+	client          *http.Client
+	maxRetries      int
+	retryBackoff    time.Duration
+	maxPending      int
+	spool           *spool.Spool
+
+	mu      sync.Mutex
+	pending []Notification
+
+	sendMu  sync.Mutex
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// WebhookOptions are the options specific to the Webhook reporter
+type WebhookOptions struct {
+	URL     string            `json:"url" config:"required"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// Template is a text/template producing the request body, the Notification is JSON encoded when empty.
+	Template string `json:"template"`
+	// Secret enables HMAC-SHA256 signing of the body.
+	Secret          string `json:"secret"`
+	SignatureHeader string `json:"signature_header"`
+	// Metrics are metric names, or glob patterns, forwarded alongside events.
+	Metrics      []string `json:"metrics"`
+	Timeout      string   `json:"timeout" config:"duration"`
+	MaxRetries   int      `json:"max_retries"`
+	RetryBackoff string   `json:"retry_backoff" config:"duration"`
+	MaxPending   int      `json:"max_pending"`
+	// SpoolDir enables spooling notifications that cannot be delivered to disk, to deliver them once the endpoint is reachable again.
+	SpoolDir      string `json:"spool_dir"`
+	SpoolMaxBytes int64  `json:"spool_max_bytes"`
+}
+
+// NewFromConfig will return a new Webhook reporter from the provided config.
+func NewFromConfig(cfg config.Section, _ bool) reporters.Interface {
+	var opts WebhookOptions
+	if err := cfg.DecodeOptions(&opts); err != nil {
+		logger.Get().Warn("invalid webhook options", zap.String("name", cfg.Name), zap.Error(err))
+		return nil
+	}
+	if u, err := url.Parse(opts.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		logger.Get().Warn("webhook url must be of the form http(s)://host/path", zap.String("name", cfg.Name), zap.String("url", opts.URL))
+		return nil
+	}
+	if opts.Method == "" {
+		opts.Method = http.MethodPost
+	}
+	if opts.SignatureHeader == "" {
+		opts.SignatureHeader = DefaultSignatureHeader
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 1000
+	}
+
+	var tmpl *template.Template
+	if opts.Template != "" {
+		var err error
+		tmpl, err = ParseTemplate(opts.Template)
+		if err != nil {
+			logger.Get().Warn("invalid webhook template", zap.String("name", cfg.Name), zap.Error(err))
+			return nil
+		}
+	}
+	var sp *spool.Spool
+	if opts.SpoolDir != "" {
+		var err error
+		if sp, err = spool.Open(opts.SpoolDir, opts.SpoolMaxBytes); err != nil {
+			logger.Get().Warn("failed to open webhook spool", zap.String("name", cfg.Name), zap.String("dir", opts.SpoolDir), zap.Error(err))
+			return nil
+		}
+	}
+
+	return New(
+		cfg.Name,
+		opts.URL,
+		opts.Method,
+		opts.Headers,
+		tmpl,
+		opts.Secret,
+		opts.SignatureHeader,
+		opts.Metrics,
+		config.DurationFromString(opts.Timeout, time.Second*10),
+		opts.MaxRetries,
+		config.DurationFromString(opts.RetryBackoff, time.Second),
+		opts.MaxPending,
+		sp,
+	)
+}
+
+// ParseTemplate parses a payload template. Besides the text/template builtins
+// it provides `json`, which encodes a value as JSON, to safely embed strings.
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+// New returns a Webhook reporter and starts its background sender.
+// The body is the JSON encoded Notification when tmpl is nil, and is left unsigned when secret is empty.
+// Notifications that cannot be delivered because the endpoint is unreachable are spooled to sp when it is not nil.
+func New(
+	name string,
+	webhookURL string,
+	method string,
+	headers map[string]string,
+	tmpl *template.Template,
+	secret string,
+	signatureHeader string,
+	metrics []string,
+	timeout time.Duration,
+	maxRetries int,
+	retryBackoff time.Duration,
+	maxPending int,
+	sp *spool.Spool,
+) *Webhook {
+	if name == "" {
+		name = "webhook"
+	}
+	w := &Webhook{
+		name:            name,
+		url:             webhookURL,
+		method:          method,
+		headers:         headers,
+		template:        tmpl,
+		signatureHeader: signatureHeader,
+		metrics:         metrics,
+		client:          &http.Client{Timeout: timeout},
+		maxRetries:      maxRetries,
+		retryBackoff:    retryBackoff,
+		maxPending:      maxPending,
+		spool:           sp,
+		trigger:         make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	if secret != "" {
+		w.secret = []byte(secret)
+	}
+	go w.loop()
+	return w
+}
+
+func (w *Webhook) loop() {
+	defer close(w.done)
+	// spooled and re-queued notifications are retried periodically, even when nothing new is reported
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.trigger:
+		case <-ticker.C:
+			if (w.spool == nil || w.spool.Len() == 0) && w.pendingLen() == 0 {
+				continue
+			}
+		}
+		if err := w.Flush(); err != nil {
+			logger.Get().Warn("failed to deliver webhook", zap.String("name", w.name), zap.Error(err))
+		}
+	}
+}
+
+// Name the name of the reporter
+func (w *Webhook) Name() string {
+	return w.name
+}
+
+// Timing forwards a timing metric in milliseconds if it is selected
+func (w *Webhook) Timing(metric string, duration time.Duration, tags ...string) {
+	w.addMetric(statistics.MetricTypeTiming, metric, float64(duration)/float64(time.Millisecond), tags, time.Now())
+}
+
+// Count forwards a count metric if it is selected
+func (w *Webhook) Count(metric string, val int64, tags ...string) {
+	w.addMetric(statistics.MetricTypeCount, metric, float64(val), tags, time.Now())
+}
+
+// Histogram forwards a histogram metric if it is selected
+func (w *Webhook) Histogram(metric string, val float64, tags ...string) {
+	w.addMetric(statistics.MetricTypeHistogram, metric, val, tags, time.Now())
+}
+
+// Gauge forwards a gauge metric if it is selected
+func (w *Webhook) Gauge(metric string, val float64, tags ...string) {
+	w.addMetric(statistics.MetricTypeGauge, metric, val, tags, time.Now())
+}
+
+// Event forwards an event
+func (w *Webhook) Event(title string, message string, tags ...string) {
+	w.addEvent(title, message, tags, time.Now())
+}
+
+// ReportStatistics implements statistics reporting, timestamping notifications with the time they were measured
+func (w *Webhook) ReportStatistics(stats *statistics.Statistics) {
+	now := time.Now()
+	for _, stat := range stats.Stats() {
+		ts := stat.TimestampOr(now)
+		switch stat.Type() {
+		case statistics.EventType:
+			w.addEvent(stat.Event.Title, stat.Event.Message, stat.Event.Tags, ts)
+		case statistics.MetricTypeCount:
+			w.addMetric(statistics.MetricTypeCount, stat.Metric.MetricName, float64(stat.Metric.Value.Int()), stat.Metric.Tags, ts)
+		case statistics.MetricTypeGauge:
+			w.addMetric(statistics.MetricTypeGauge, stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags, ts)
+		case statistics.MetricTypeTiming:
+			w.addMetric(statistics.MetricTypeTiming, stat.Metric.MetricName, float64(stat.Metric.Value.Duration())/float64(time.Millisecond), stat.Metric.Tags, ts)
+		case statistics.MetricTypeHistogram:
+			w.addMetric(statistics.MetricTypeHistogram, stat.Metric.MetricName, stat.Metric.Value.Float(), stat.Metric.Tags, ts)
+		default:
+			// ignore
+		}
+	}
+}
+
+// Flush delivers all pending notifications in order, retrying each with backoff.
+// When a spool is configured, spooled notifications are delivered first and the endpoint being
+// unreachable spools the remaining notifications in order, otherwise they are re-queued without
+// retrying each of them. Notifications the endpoint rejects are dropped.
+func (w *Webhook) Flush() error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	if w.spool != nil && w.spool.Len() > 0 {
+		if err := w.spool.Replay(w.sendSpooled); err != nil {
+			return w.spoolNotifications(batch, err)
+		}
+	}
+
+	failed := 0
+	var lastErr error
+	for i, n := range batch {
+		if retry, err := w.sendWithRetry(n); err != nil {
+			if retry && w.spool != nil {
+				return w.spoolNotifications(batch[i:], err)
+			}
+			if retry {
+				return w.requeue(batch[i:], err)
+			}
+			failed++
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("dropped %d of %d notifications: %v", failed, len(batch), lastErr)
+	}
+	return nil
+}
+
+// requeue puts notifications that could not be delivered because of cause back in front of the
+// pending notifications, keeping the most recent ones when there are too many
+func (w *Webhook) requeue(batch []Notification, cause error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(append(make([]Notification, 0, len(batch)+len(w.pending)), batch...), w.pending...)
+	if dropped := len(w.pending) - w.maxPending; dropped > 0 {
+		w.pending = w.pending[dropped:]
+		return fmt.Errorf("re-queued %d notifications, dropped the %d oldest pending: %v", len(batch), dropped, cause)
+	}
+	return fmt.Errorf("re-queued %d notifications: %v", len(batch), cause)
+}
+
+// pendingLen returns how many notifications are pending
+func (w *Webhook) pendingLen() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// spoolNotifications spools notifications that could not be delivered because of cause
+func (w *Webhook) spoolNotifications(batch []Notification, cause error) error {
+	if len(batch) == 0 {
+		return fmt.Errorf("%d notifications still spooled: %v", w.spool.Len(), cause)
+	}
+	records := make([]string, 0, len(batch))
+	for _, n := range batch {
+		data, err := json.Marshal(n)
+		if err != nil {
+			continue
+		}
+		records = append(records, string(data))
+	}
+	if err := w.spool.Append(records); err != nil {
+		return fmt.Errorf("dropped %d notifications: %v, failed to spool: %v", len(batch), cause, err)
+	}
+	return fmt.Errorf("spooled %d notifications, %d in total: %v", len(records), w.spool.Len(), cause)
+}
+
+// sendSpooled delivers spooled notifications in order, returning how many were handled before the endpoint became unreachable.
+// Notifications the endpoint rejects are dropped rather than blocking the spool.
+func (w *Webhook) sendSpooled(records []string) (int, error) {
+	for i, record := range records {
+		var n Notification
+		if err := json.Unmarshal([]byte(record), &n); err != nil {
+			logger.Get().Warn("dropping invalid spooled notification", zap.String("name", w.name), zap.Error(err))
+			continue
+		}
+		if retry, err := w.sendWithRetry(n); err != nil {
+			if retry {
+				return i, err
+			}
+			logger.Get().Warn("dropping spooled notification rejected by webhook", zap.String("name", w.name), zap.Error(err))
+		}
+	}
+	return len(records), nil
+}
+
+// Close stops the background sender and delivers any pending notifications, what cannot be
+// delivered is dropped.
+func (w *Webhook) Close() error {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+	err := w.Flush()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		err = fmt.Errorf("dropped %d notifications: %v", len(w.pending), err)
+		w.pending = nil
+	}
+	return err
+}
+
+// selected reports whether a metric is forwarded
+func (w *Webhook) selected(metric string) bool {
+	for _, pattern := range w.metrics {
+		if ok, _ := path.Match(pattern, metric); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) addMetric(metricType statistics.Type, metric string, val float64, tags []string, ts time.Time) {
+	if !w.selected(metric) {
+		return
+	}
+	w.add(Notification{
+		Type:      metricType,
+		Metric:    metric,
+		Value:     &val,
+		Tags:      tagMap(tags),
+		Timestamp: ts,
+	})
+}
+
+func (w *Webhook) addEvent(title string, message string, tags []string, ts time.Time) {
+	w.add(Notification{
+		Type:      statistics.EventType,
+		Title:     title,
+		Message:   message,
+		Tags:      tagMap(tags),
+		Timestamp: ts,
+	})
+}
+
+func (w *Webhook) add(n Notification) {
+	w.mu.Lock()
+	if len(w.pending) >= w.maxPending {
+		// the endpoint is not keeping up, keep the most recent notifications
+		w.pending = w.pending[1:]
+		logger.Get().Warn("webhook queue full, dropping oldest notification", zap.String("name", w.name))
+	}
+	w.pending = append(w.pending, n)
+	w.mu.Unlock()
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Payload renders the request body for a notification
+func (w *Webhook) Payload(n Notification) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(n)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign returns the signature header value for a body, `sha256=` followed by the hex HMAC
+func (w *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWithRetry delivers a notification, retrying with backoff. It reports whether the final failure was worth retrying.
+func (w *Webhook) sendWithRetry(n Notification) (bool, error) {
+	body, err := w.Payload(n)
+	if err != nil {
+		return false, err
+	}
+	backoff := w.retryBackoff
+	var retry bool
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		retry, err = w.send(body)
+		if err == nil || !retry {
+			return retry, err
+		}
+	}
+	return retry, err
+}
+
+// send delivers a body, reporting whether a failure is worth retrying.
+func (w *Webhook) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(w.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	if w.secret != nil {
+		req.Header.Set(w.signatureHeader, w.Sign(body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return true, fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	default:
+		return false, fmt.Errorf("webhook rejected notification with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+func tagMap(tags []string) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value := statistics.SplitTag(tag)
+		m[key] = value
+	}
+	return m
+}
@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/platinummonkey/isp-monitor/internal/testutil"
+)
+
+// newServer starts a stand-in webhook endpoint answering with the queued statuses, then 200
+func newServer(statuses ...int) *testutil.Server {
+	return testutil.NewServer(testutil.Status(http.StatusOK), statuses...)
+}
+
+func newReporter(s *testutil.Server, secret string, signatureHeader string, maxRetries int, retryBackoff time.Duration) *Webhook {
+	return New("webhook", s.URL, http.MethodPost, map[string]string{"X-Test": "yes"}, nil, secret, signatureHeader,
+		nil, time.Second, maxRetries, retryBackoff, 10, nil)
+}
+
+func TestSignature(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	w := newReporter(s, "s3cret", "X-Hub-Signature-256", 0, time.Millisecond)
+	w.Event("outage", "gateway is down", "name:gateway")
+	// closing waits for the background sender and delivers what is left
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	requests := s.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	r := requests[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(r.Body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-Hub-Signature-256"); got != expected {
+		t.Errorf("expected signature %s, got %q", expected, got)
+	}
+	if got := r.Header.Get("X-Test"); got != "yes" {
+		t.Errorf("expected the configured header, got %q", got)
+	}
+	var n Notification
+	if err := json.Unmarshal(r.Body, &n); err != nil {
+		t.Fatalf("invalid body %q: %v", r.Body, err)
+	}
+	if n.Title != "outage" || n.Message != "gateway is down" || n.Tag("name") != "gateway" {
+		t.Errorf("unexpected notification %+v", n)
+	}
+}
+
+func TestUnsignedWithoutSecret(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	w := newReporter(s, "", DefaultSignatureHeader, 0, time.Millisecond)
+	w.Event("outage", "gateway is down")
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	for _, r := range s.Requests() {
+		if sig := r.Header.Get(DefaultSignatureHeader); sig != "" {
+			t.Errorf("expected no signature without a secret, got %q", sig)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s := newServer(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadGateway)
+	defer s.Close()
+	backoff := 20 * time.Millisecond
+	w := newReporter(s, "", DefaultSignatureHeader, 3, backoff)
+	w.Event("outage", "gateway is down")
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	requests := s.Requests()
+	if len(requests) != 4 {
+		t.Fatalf("expected 3 failed attempts and a delivery, got %d requests", len(requests))
+	}
+	for i := 1; i < len(requests); i++ {
+		// the backoff doubles after every attempt
+		wait := backoff << uint(i-1)
+		if gap := requests[i].At.Sub(requests[i-1].At); gap < wait {
+			t.Errorf("attempt %d was sent %s after the previous one, expected at least %s", i+1, gap, wait)
+		}
+		if string(requests[i].Body) != string(requests[0].Body) {
+			t.Errorf("attempt %d sent %q, expected %q", i+1, requests[i].Body, requests[0].Body)
+		}
+	}
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	s := newServer(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	defer s.Close()
+	w := newReporter(s, "", DefaultSignatureHeader, 2, time.Millisecond)
+	defer w.Close()
+
+	w.mu.Lock()
+	w.pending = append(w.pending, Notification{Type: "event", Title: "outage"})
+	w.mu.Unlock()
+	if err := w.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := len(s.Requests()); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestRequeuesWhileUnreachable(t *testing.T) {
+	s := newServer(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer s.Close()
+	w := newReporter(s, "", DefaultSignatureHeader, 1, time.Millisecond)
+	defer w.Close()
+
+	w.mu.Lock()
+	for _, title := range []string{"first", "second", "third"} {
+		w.pending = append(w.pending, Notification{Type: "event", Title: title})
+	}
+	w.mu.Unlock()
+	if err := w.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	// only the first notification is retried, the others are kept for the next flush
+	if n := len(s.Requests()); n != 2 {
+		t.Fatalf("expected 2 attempts, got %d", n)
+	}
+	if n := w.pendingLen(); n != 3 {
+		t.Fatalf("expected 3 notifications to be re-queued, got %d", n)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	requests := s.Requests()
+	if len(requests) != 5 {
+		t.Fatalf("expected the re-queued notifications to be delivered, got %d requests", len(requests))
+	}
+	for i, title := range []string{"first", "second", "third"} {
+		var n Notification
+		if err := json.Unmarshal(requests[2+i].Body, &n); err != nil || n.Title != title {
+			t.Errorf("expected %s to be delivered in order, got %q", title, requests[2+i].Body)
+		}
+	}
+}
+
+func TestRejectedNotRetried(t *testing.T) {
+	s := newServer(http.StatusBadRequest)
+	defer s.Close()
+	w := newReporter(s, "", DefaultSignatureHeader, 3, time.Millisecond)
+	defer w.Close()
+
+	w.mu.Lock()
+	w.pending = append(w.pending, Notification{Type: "event", Title: "outage"})
+	w.mu.Unlock()
+	if err := w.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := len(s.Requests()); n != 1 {
+		t.Fatalf("expected a rejected notification not to be retried, got %d requests", n)
+	}
+}
@@ -0,0 +1,287 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	logger "github.com/platinummonkey/isp-monitor/log"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxBytes is the size cap used when none is configured
+const DefaultMaxBytes = 64 << 20
+
+const segmentExt = ".spool"
+
+// segmentsPerSpool is how many segments a full spool is split into at least, segments are rotated
+// once they reach their share of the size cap so the oldest records are dropped a segment at a time
+const segmentsPerSpool = 16
+
+// segment is a batch of records appended together, stored in its own file, it is at most the
+// segment size unless it holds a single larger record
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+// Spool is a write-ahead buffer on disk for records a reporter failed to send.
+// Records are replayed in the order they were appended, and the oldest are dropped
+// once the spool grows beyond its size cap. It survives restarts.
+type Spool struct {
+	dir      string
+	maxBytes int64
+
+	// replayMu serializes replays so records are never sent twice or out of order
+	replayMu sync.Mutex
+
+	mu       sync.Mutex
+	segments []segment
+	size     int64
+	next     uint64
+}
+
+// Open opens the spool in dir, creating the directory if needed and loading any spooled segments.
+// maxBytes caps the total size of the spool, DefaultMaxBytes is used when it is not positive.
+func Open(dir string, maxBytes int64) (*Spool, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		records, err := s.read(seq)
+		if err != nil {
+			logger.Get().Warn("skipping unreadable spool segment", zap.String("path", s.path(seq)), zap.Error(err))
+			continue
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: f.Size(), records: len(records)})
+		s.size += f.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+	return s, nil
+}
+
+// Len returns how many records are spooled
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, seg := range s.segments {
+		n += seg.records
+	}
+	return n
+}
+
+// Size returns the size of the spool on disk in bytes
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Append spools records after every record already spooled, in new segments of at most the segment
+// size, dropping the oldest segments while the spool is beyond its size cap. The records appended
+// are dropped as well when they alone are beyond it.
+func (s *Spool) Append(records []string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, batch := range split(records, s.maxBytes/segmentsPerSpool) {
+		seq := s.next
+		size, err := s.write(seq, batch)
+		if err != nil {
+			return err
+		}
+		s.next++
+		s.segments = append(s.segments, segment{seq: seq, size: size, records: len(batch)})
+		s.size += size
+	}
+
+	dropped := 0
+	for s.size > s.maxBytes && len(s.segments) > 0 {
+		oldest := s.segments[0]
+		os.Remove(s.path(oldest.seq))
+		s.segments = s.segments[1:]
+		s.size -= oldest.size
+		dropped += oldest.records
+	}
+	if dropped > 0 {
+		logger.Get().Warn("spool full, dropped oldest records", zap.String("dir", s.dir), zap.Int("dropped", dropped))
+	}
+	return nil
+}
+
+// Replay passes the spooled records to send one segment at a time, oldest first.
+// send returns how many of the records, from the start, were sent; they are removed from the spool.
+// Replay stops at the first error, leaving the unsent records spooled in order.
+func (s *Spool) Replay(send func(records []string) (int, error)) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		seq := s.segments[0].seq
+		s.mu.Unlock()
+
+		records, err := s.read(seq)
+		if err != nil {
+			logger.Get().Warn("dropping unreadable spool segment", zap.String("path", s.path(seq)), zap.Error(err))
+			s.remove(seq, nil)
+			continue
+		}
+		sent, sendErr := send(records)
+		if sent > len(records) {
+			sent = len(records)
+		}
+		if err := s.remove(seq, records[sent:]); err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return sendErr
+		}
+	}
+}
+
+// remove replaces segment seq with the remaining records, removing it when there are none.
+// It is a no-op if the segment was dropped in the meantime.
+func (s *Spool) remove(seq uint64, remaining []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(s.segments) && s.segments[i].seq != seq {
+		i++
+	}
+	if i == len(s.segments) {
+		return nil
+	}
+	if len(remaining) == s.segments[i].records {
+		return nil
+	}
+	s.size -= s.segments[i].size
+	if len(remaining) == 0 {
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		return os.Remove(s.path(seq))
+	}
+	size, err := s.write(seq, remaining)
+	if err != nil {
+		// keep what is on disk, the records will be sent again
+		s.size += s.segments[i].size
+		return err
+	}
+	s.segments[i].size = size
+	s.segments[i].records = len(remaining)
+	s.size += size
+	return nil
+}
+
+// split splits records into batches of at most maxBytes once encoded, a record larger than maxBytes
+// is a batch of its own
+func split(records []string, maxBytes int64) [][]string {
+	batches := make([][]string, 0, 1)
+	start, size := 0, int64(0)
+	for i, r := range records {
+		data, _ := json.Marshal(r)
+		// one record per line
+		n := int64(len(data)) + 1
+		if size+n > maxBytes && i > start {
+			batches = append(batches, records[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	return append(batches, records[start:])
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// write atomically replaces segment seq with records, one JSON string per line, returning its size
+func (s *Spool) write(seq uint64, records []string) (int64, error) {
+	path := s.path(seq)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	info, statErr := f.Stat()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *Spool) read(seq uint64) ([]string, error) {
+	f, err := os.Open(s.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := make([]string, 0)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var r string
+		if err := dec.Decode(&r); err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
@@ -0,0 +1,102 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func openSpool(t *testing.T, maxBytes int64) (*Spool, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, maxBytes)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// records returns n records of 99 bytes once spooled
+func records(from int, n int) []string {
+	r := make([]string, 0, n)
+	for i := from; i < from+n; i++ {
+		r = append(r, fmt.Sprintf("%04d%s", i, strings.Repeat("x", 92)))
+	}
+	return r
+}
+
+// replayAll returns every spooled record, leaving the spool empty
+func replayAll(t *testing.T, s *Spool) []string {
+	var replayed []string
+	err := s.Replay(func(records []string) (int, error) {
+		replayed = append(replayed, records...)
+		return len(records), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replayed
+}
+
+func TestAppendKeepsTheCap(t *testing.T) {
+	s, cleanup := openSpool(t, 16*1000)
+	defer cleanup()
+
+	// a single append of 300 records is split into segments, the oldest are dropped
+	if err := s.Append(records(0, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if size := s.Size(); size > 16*1000 {
+		t.Fatalf("spool of %d bytes is beyond its cap", size)
+	}
+	replayed := replayAll(t, s)
+	if len(replayed) == 0 || replayed[len(replayed)-1] != records(299, 1)[0] {
+		t.Fatalf("expected the newest records to be kept, got %d records", len(replayed))
+	}
+	for i := 1; i < len(replayed); i++ {
+		if replayed[i] <= replayed[i-1] {
+			t.Fatalf("records replayed out of order: %s after %s", replayed[i][:4], replayed[i-1][:4])
+		}
+	}
+}
+
+func TestAppendDropsRecordsBeyondTheCap(t *testing.T) {
+	s, cleanup := openSpool(t, 1000)
+	defer cleanup()
+
+	if err := s.Append([]string{strings.Repeat("x", 2000)}); err != nil {
+		t.Fatal(err)
+	}
+	if n, size := s.Len(), s.Size(); n != 0 || size != 0 {
+		t.Fatalf("expected a record beyond the cap to be dropped, %d records of %d bytes are spooled", n, size)
+	}
+}
+
+func TestReplayKeepsUnsentRecords(t *testing.T) {
+	s, cleanup := openSpool(t, 0)
+	defer cleanup()
+	s.Append(records(0, 5))
+	s.Append(records(5, 5))
+
+	err := s.Replay(func(records []string) (int, error) {
+		return 3, fmt.Errorf("unreachable")
+	})
+	if err == nil {
+		t.Fatal("expected the replay to fail")
+	}
+	// the spool survives a restart
+	reopened, err := Open(s.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := replayAll(t, reopened)
+	expected := records(3, 7)
+	if strings.Join(replayed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected records 3 to 9 to be replayed, got %d records", len(replayed))
+	}
+}
@@ -2,6 +2,7 @@ package statistics
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -151,6 +152,15 @@ func NewMetric(metricType Type, metricName string, value Value, tags ...string)
 	}
 }
 
+// SplitTag splits a `key:value` tag into its key and value.
+// Tags without a value return an empty value.
+func SplitTag(tag string) (string, string) {
+	if i := strings.Index(tag, ":"); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
 // Event is an event statistic
 type Event struct {
 	Title   string
@@ -171,6 +181,18 @@ func NewEvent(title string, message string, tags ...string) *Event {
 type Statistic struct {
 	Metric *Metric
 	Event  *Event
+	// Timestamp is when the statistic was measured, reporters use the time it is reported at when zero.
+	Timestamp time.Time
+	// Window is how long the measurement took, ending at Timestamp. Zero when instantaneous or unknown.
+	Window time.Duration
+}
+
+// TimestampOr returns the timestamp of the statistic, or fallback when it has none
+func (s *Statistic) TimestampOr(fallback time.Time) time.Time {
+	if s.Timestamp.IsZero() {
+		return fallback
+	}
+	return s.Timestamp
 }
 
 // Type returns the statistic type
@@ -212,6 +234,18 @@ func (s *Statistics) Add(stat *Statistic) {
 	s.mu.Unlock()
 }
 
+// Stamp sets the timestamp and measurement window of every statistic that has no timestamp yet.
+func (s *Statistics) Stamp(ts time.Time, window time.Duration) {
+	s.mu.Lock()
+	for _, stat := range s.statistics {
+		if stat.Timestamp.IsZero() {
+			stat.Timestamp = ts
+			stat.Window = window
+		}
+	}
+	s.mu.Unlock()
+}
+
 // Stats returns the current bucket of statistics.
 func (s *Statistics) Stats() []*Statistic {
 	s.mu.RLock()
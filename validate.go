@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/platinummonkey/isp-monitor/alerting"
+	"github.com/platinummonkey/isp-monitor/api"
+	"github.com/platinummonkey/isp-monitor/collectors"
+	"github.com/platinummonkey/isp-monitor/config"
+	"github.com/platinummonkey/isp-monitor/dashboard"
+	"github.com/platinummonkey/isp-monitor/dispatch"
+	"github.com/platinummonkey/isp-monitor/outage"
+	"github.com/platinummonkey/isp-monitor/reporters"
+)
+
+// configSchema describes the options of every registered collector and reporter type and of the top level sections
+func configSchema() config.Schema {
+	return config.Schema{
+		CollectorOptions: collectors.CollectorOptions,
+		ReporterOptions:  reporters.ReporterOptions,
+		Sections: map[string]interface{}{
+			"outage":     &outage.Options{},
+			"dashboard":  &dashboard.Options{},
+			"api":        &api.Options{},
+			"dispatcher": &dispatch.Options{},
+		},
+		Alert: &alerting.Rule{},
+	}
+}
+
+// runValidate implements the `validate` subcommand, returning the exit code
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := flags.String("config", options.config, "config file to validate")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	contents, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read configuration file: %v\n", err)
+		return 1
+	}
+	errs := config.Validate(contents, configSchema())
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s:%s\n", *configPath, e)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s) found\n", *configPath, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *configPath)
+	return 0
+}